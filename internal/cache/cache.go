@@ -0,0 +1,392 @@
+package cache
+
+import (
+	"container/list"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Key identifies a cached response.
+type Key struct {
+	Name   string
+	Qtype  uint16
+	Qclass uint16
+	DO     bool
+	// Subnet is the EDNS Client Subnet prefix the answer applies to, empty
+	// for queries without ECS.
+	Subnet string
+}
+
+// KeyFor builds the cache key for the first question of a request.
+func KeyFor(req *dns.Msg) Key {
+	q := req.Question[0]
+	k := Key{
+		Name:   strings.ToLower(q.Name),
+		Qtype:  q.Qtype,
+		Qclass: q.Qclass,
+	}
+	if opt := req.IsEdns0(); opt != nil {
+		k.DO = opt.Do()
+	}
+	if p, ok := ClientSubnet(req); ok {
+		k.Subnet = p.String()
+	}
+	return k
+}
+
+// ClientSubnet returns the EDNS Client Subnet source prefix of m (RFC 7871).
+func ClientSubnet(m *dns.Msg) (netip.Prefix, bool) {
+	o := subnetOption(m)
+	if o == nil {
+		return netip.Prefix{}, false
+	}
+	addr, ok := netip.AddrFromSlice(o.Address)
+	if !ok {
+		return netip.Prefix{}, false
+	}
+	if o.Family == 1 {
+		addr = addr.Unmap()
+	}
+	p, err := addr.Prefix(int(o.SourceNetmask))
+	if err != nil {
+		return netip.Prefix{}, false
+	}
+	return p, true
+}
+
+func subnetOption(m *dns.Msg) *dns.EDNS0_SUBNET {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	for _, o := range opt.Option {
+		if s, ok := o.(*dns.EDNS0_SUBNET); ok {
+			return s
+		}
+	}
+	return nil
+}
+
+// find returns the entry answering req at now. Answers to ECS queries are
+// stored under the scope the upstream declared, which may be shorter than the
+// query's source prefix, so shorter prefixes are tried as well: the first
+// unexpired entry wins, otherwise the first one still inside the serve-stale
+// window. Entries past that window are dropped on the way. It must be called
+// with c.mu held.
+func (c *Cache) find(req *dns.Msg, now time.Time) (*list.Element, bool) {
+	key := KeyFor(req)
+	p, ecs := ClientSubnet(req)
+	var stale *list.Element
+	for bits := p.Bits(); ; bits-- {
+		if ecs && bits < p.Bits() {
+			key.Subnet = netip.PrefixFrom(p.Addr(), bits).Masked().String()
+		}
+		if el, ok := c.items[key]; ok {
+			e := el.Value.(*entry)
+			switch {
+			case now.Before(e.expires):
+				return el, true
+			case now.Before(e.expires.Add(c.opts.ServeStale)):
+				if stale == nil {
+					stale = el
+				}
+			default:
+				c.removeElement(el)
+			}
+		}
+		if !ecs || bits <= 0 {
+			return stale, stale != nil
+		}
+	}
+}
+
+// StaleTTL is the TTL given to records served after they expired (RFC 8767).
+const StaleTTL = 30
+
+// Options controls cache sizing and expiry.
+type Options struct {
+	// Size is the maximum number of stored responses.
+	Size int
+	// MinTTL and MaxTTL clamp record TTLs; a zero MaxTTL leaves the upper bound open.
+	MinTTL time.Duration
+	MaxTTL time.Duration
+	// ServeStale keeps expired responses for this long so they can be
+	// returned when the upstream is unreachable. Zero disables it.
+	ServeStale time.Duration
+	// PrefetchHits is the number of hits after which an entry becomes eligible
+	// for prefetching. Zero disables prefetching.
+	PrefetchHits int
+	// PrefetchPercent is the share of the original TTL (0-100) that may remain
+	// before an eligible entry is refreshed.
+	PrefetchPercent int
+}
+
+// Cache is a size-bounded LRU cache of DNS responses that honors record TTLs.
+type Cache struct {
+	mu    sync.Mutex
+	opts  Options
+	ll    *list.List
+	items map[Key]*list.Element
+	now   func() time.Time
+}
+
+type entry struct {
+	key        Key
+	msg        *dns.Msg
+	stored     time.Time
+	expires    time.Time
+	hits       int
+	refreshing bool
+}
+
+// New returns a cache configured by opts.
+func New(opts Options) *Cache {
+	if opts.Size < 1 {
+		opts.Size = 1
+	}
+	return &Cache{
+		opts:  opts,
+		ll:    list.New(),
+		items: make(map[Key]*list.Element),
+		now:   time.Now,
+	}
+}
+
+// Get returns a copy of the cached response for req with its ID set to the
+// request ID and TTLs counted down by the time spent in the cache.
+func (c *Cache) Get(req *dns.Msg) (*dns.Msg, bool) {
+	now := c.now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.find(req, now)
+	if !ok {
+		return nil, false
+	}
+	e := el.Value.(*entry)
+	if !now.Before(e.expires) {
+		return nil, false
+	}
+	c.ll.MoveToFront(el)
+	e.hits++
+	return e.reply(req, now), true
+}
+
+// Prefetch reports whether the entry for req is popular and close enough to
+// expiry that it should be refreshed now. A true result also marks the entry
+// as refreshing; the caller must call EndRefresh when done.
+func (c *Cache) Prefetch(req *dns.Msg) bool {
+	if c.opts.PrefetchHits <= 0 {
+		return false
+	}
+	now := c.now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.find(req, now)
+	if !ok {
+		return false
+	}
+	e := el.Value.(*entry)
+	if e.refreshing || e.hits < c.opts.PrefetchHits || !now.Before(e.expires) {
+		return false
+	}
+	ttl := e.expires.Sub(e.stored)
+	remaining := e.expires.Sub(now)
+	if remaining*100 > ttl*time.Duration(c.opts.PrefetchPercent) {
+		return false
+	}
+	e.refreshing = true
+	return true
+}
+
+// GetStale returns an expired response that is still inside the serve-stale
+// window, with every TTL set to StaleTTL.
+func (c *Cache) GetStale(req *dns.Msg) (*dns.Msg, bool) {
+	if c.opts.ServeStale <= 0 {
+		return nil, false
+	}
+	now := c.now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.find(req, now)
+	if !ok {
+		return nil, false
+	}
+	m := el.Value.(*entry).reply(req, now)
+	forEachRR(m, func(h *dns.RR_Header) {
+		h.Ttl = StaleTTL
+	})
+	return m, true
+}
+
+// BeginRefresh marks the entry for req as being refreshed. It returns false
+// when the entry is missing or a refresh is already running.
+func (c *Cache) BeginRefresh(req *dns.Msg) bool {
+	now := c.now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.find(req, now)
+	if !ok {
+		return false
+	}
+	e := el.Value.(*entry)
+	if e.refreshing {
+		return false
+	}
+	e.refreshing = true
+	return true
+}
+
+// EndRefresh clears the refresh mark set by BeginRefresh.
+func (c *Cache) EndRefresh(req *dns.Msg) {
+	now := c.now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.find(req, now); ok {
+		el.Value.(*entry).refreshing = false
+	}
+}
+
+// Set stores resp as the answer to req when it is cacheable.
+func (c *Cache) Set(req, resp *dns.Msg) {
+	ttl, ok := c.ttlFor(resp)
+	if !ok {
+		return
+	}
+	key := KeyFor(req)
+	if p, ok := ClientSubnet(req); ok {
+		// Without an ECS option in the answer it is valid for every client.
+		scope := 0
+		if o := subnetOption(resp); o != nil {
+			scope = int(o.SourceScope)
+		}
+		if scope < p.Bits() {
+			key.Subnet = netip.PrefixFrom(p.Addr(), scope).Masked().String()
+		}
+	}
+	now := c.now()
+	e := &entry{
+		key:     key,
+		msg:     resp.Copy(),
+		stored:  now,
+		expires: now.Add(ttl),
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[key]; ok {
+		el.Value = e
+		c.ll.MoveToFront(el)
+		return
+	}
+	c.items[key] = c.ll.PushFront(e)
+	for c.ll.Len() > c.opts.Size {
+		c.removeElement(c.ll.Back())
+	}
+}
+
+// Len reports the number of stored responses.
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ll.Len()
+}
+
+func (c *Cache) removeElement(el *list.Element) {
+	c.ll.Remove(el)
+	delete(c.items, el.Value.(*entry).key)
+}
+
+// ttlFor returns how long resp may be cached. Positive answers use the
+// smallest record TTL; negative answers use the SOA minimum (RFC 2308).
+func (c *Cache) ttlFor(resp *dns.Msg) (time.Duration, bool) {
+	if resp == nil || resp.Truncated {
+		return 0, false
+	}
+	if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+		return 0, false
+	}
+
+	var (
+		min   uint32
+		found bool
+	)
+	consider := func(ttl uint32) {
+		if !found || ttl < min {
+			min = ttl
+			found = true
+		}
+	}
+
+	if len(resp.Answer) > 0 && resp.Rcode == dns.RcodeSuccess {
+		for _, rr := range resp.Answer {
+			consider(rr.Header().Ttl)
+		}
+	} else {
+		for _, rr := range resp.Ns {
+			if soa, ok := rr.(*dns.SOA); ok {
+				consider(soa.Hdr.Ttl)
+				consider(soa.Minttl)
+			}
+		}
+	}
+	if !found {
+		return 0, false
+	}
+
+	ttl := time.Duration(min) * time.Second
+	if ttl < c.opts.MinTTL {
+		ttl = c.opts.MinTTL
+	}
+	if c.opts.MaxTTL > 0 && ttl > c.opts.MaxTTL {
+		ttl = c.opts.MaxTTL
+	}
+	if ttl <= 0 {
+		return 0, false
+	}
+	return ttl, true
+}
+
+// reply copies the entry as the answer to req. The question is req's own, so
+// clients randomizing the name's case (0x20) get theirs back.
+func (e *entry) reply(req *dns.Msg, now time.Time) *dns.Msg {
+	m := e.msg.Copy()
+	m.Id = req.Id
+	m.Question = append([]dns.Question(nil), req.Question...)
+	elapsed := uint32(now.Sub(e.stored) / time.Second)
+	forEachRR(m, func(h *dns.RR_Header) {
+		if h.Ttl > elapsed {
+			h.Ttl -= elapsed
+		} else {
+			h.Ttl = 0
+		}
+	})
+	return m
+}
+
+// forEachRR calls fn for the header of every record except the OPT pseudo-record.
+func forEachRR(m *dns.Msg, fn func(*dns.RR_Header)) {
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range section {
+			h := rr.Header()
+			if h.Rrtype == dns.TypeOPT {
+				continue
+			}
+			fn(h)
+		}
+	}
+}
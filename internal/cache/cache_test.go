@@ -0,0 +1,303 @@
+package cache
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func newQuery(name string, qtype uint16) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(name), qtype)
+	return m
+}
+
+func newAnswer(req *dns.Msg, ttl uint32) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetReply(req)
+	m.Answer = append(m.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl},
+		A:   net.ParseIP("192.0.2.1"),
+	})
+	return m
+}
+
+func TestCacheCountsDownAndExpires(t *testing.T) {
+	now := time.Unix(1000, 0)
+	c := New(Options{Size: 10})
+	c.now = func() time.Time { return now }
+
+	req := newQuery("example.com", dns.TypeA)
+	c.Set(req, newAnswer(req, 60))
+
+	now = now.Add(20 * time.Second)
+	req.Id = 4242
+	got, ok := c.Get(req)
+	if !ok {
+		t.Fatalf("expected cache hit")
+	}
+	if got.Id != 4242 {
+		t.Fatalf("expected id 4242, got %d", got.Id)
+	}
+	if ttl := got.Answer[0].Header().Ttl; ttl != 40 {
+		t.Fatalf("expected ttl 40, got %d", ttl)
+	}
+
+	now = now.Add(40 * time.Second)
+	if _, ok := c.Get(req); ok {
+		t.Fatalf("expected entry to expire")
+	}
+}
+
+func TestCacheKeyIncludesTypeAndDO(t *testing.T) {
+	c := New(Options{Size: 10})
+	req := newQuery("example.com", dns.TypeA)
+	c.Set(req, newAnswer(req, 60))
+
+	if _, ok := c.Get(newQuery("EXAMPLE.com", dns.TypeA)); !ok {
+		t.Fatalf("expected case-insensitive hit")
+	}
+	if _, ok := c.Get(newQuery("example.com", dns.TypeAAAA)); ok {
+		t.Fatalf("expected miss for different qtype")
+	}
+	withDO := newQuery("example.com", dns.TypeA)
+	withDO.SetEdns0(1232, true)
+	if _, ok := c.Get(withDO); ok {
+		t.Fatalf("expected miss for DO bit")
+	}
+}
+
+func TestCacheEchoesQuestionCase(t *testing.T) {
+	now := time.Unix(1000, 0)
+	c := New(Options{Size: 10, ServeStale: time.Minute})
+	c.now = func() time.Time { return now }
+	req := newQuery("www.example.com", dns.TypeA)
+	c.Set(req, newAnswer(req, 60))
+
+	mixed := newQuery("WwW.eXample.COM", dns.TypeA)
+	got, ok := c.Get(mixed)
+	if !ok {
+		t.Fatalf("expected case-insensitive hit")
+	}
+	if name := got.Question[0].Name; name != "WwW.eXample.COM." {
+		t.Fatalf("expected the client's question, got %q", name)
+	}
+
+	now = now.Add(90 * time.Second)
+	stale, ok := c.GetStale(newQuery("www.EXAMPLE.com", dns.TypeA))
+	if !ok {
+		t.Fatalf("expected stale hit inside window")
+	}
+	if name := stale.Question[0].Name; name != "www.EXAMPLE.com." {
+		t.Fatalf("expected the client's question from the stale path, got %q", name)
+	}
+}
+
+func TestCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := New(Options{Size: 2})
+	a := newQuery("a.test", dns.TypeA)
+	b := newQuery("b.test", dns.TypeA)
+	d := newQuery("d.test", dns.TypeA)
+
+	c.Set(a, newAnswer(a, 60))
+	c.Set(b, newAnswer(b, 60))
+	c.Get(a)
+	c.Set(d, newAnswer(d, 60))
+
+	if _, ok := c.Get(b); ok {
+		t.Fatalf("expected b to be evicted")
+	}
+	if _, ok := c.Get(a); !ok {
+		t.Fatalf("expected a to survive")
+	}
+	if c.Len() != 2 {
+		t.Fatalf("expected 2 entries, got %d", c.Len())
+	}
+}
+
+func TestCacheNegativeUsesSOAMinimum(t *testing.T) {
+	now := time.Unix(1000, 0)
+	c := New(Options{Size: 10})
+	c.now = func() time.Time { return now }
+
+	req := newQuery("missing.test", dns.TypeA)
+	resp := new(dns.Msg)
+	resp.SetRcode(req, dns.RcodeNameError)
+	resp.Ns = append(resp.Ns, &dns.SOA{
+		Hdr:    dns.RR_Header{Name: "test.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 3600},
+		Ns:     "ns.test.",
+		Mbox:   "hostmaster.test.",
+		Minttl: 30,
+	})
+	c.Set(req, resp)
+
+	now = now.Add(29 * time.Second)
+	if _, ok := c.Get(req); !ok {
+		t.Fatalf("expected negative hit")
+	}
+	now = now.Add(2 * time.Second)
+	if _, ok := c.Get(req); ok {
+		t.Fatalf("expected negative entry to expire after SOA minimum")
+	}
+}
+
+func TestCacheSkipsServerFailure(t *testing.T) {
+	c := New(Options{Size: 10})
+	req := newQuery("example.com", dns.TypeA)
+	resp := new(dns.Msg)
+	resp.SetRcode(req, dns.RcodeServerFailure)
+	c.Set(req, resp)
+	if c.Len() != 0 {
+		t.Fatalf("expected SERVFAIL not to be cached")
+	}
+}
+
+func TestCacheServesStaleWithinWindow(t *testing.T) {
+	now := time.Unix(1000, 0)
+	c := New(Options{Size: 10, ServeStale: time.Minute})
+	c.now = func() time.Time { return now }
+
+	req := newQuery("example.com", dns.TypeA)
+	c.Set(req, newAnswer(req, 60))
+
+	if _, ok := c.GetStale(req); !ok {
+		t.Fatalf("expected fresh entry to be usable as stale fallback")
+	}
+
+	now = now.Add(90 * time.Second)
+	if _, ok := c.Get(req); ok {
+		t.Fatalf("expected expired entry to miss")
+	}
+	stale, ok := c.GetStale(req)
+	if !ok {
+		t.Fatalf("expected stale hit inside window")
+	}
+	if ttl := stale.Answer[0].Header().Ttl; ttl != StaleTTL {
+		t.Fatalf("expected stale ttl %d, got %d", StaleTTL, ttl)
+	}
+
+	now = now.Add(time.Minute)
+	if _, ok := c.GetStale(req); ok {
+		t.Fatalf("expected entry to be dropped after the stale window")
+	}
+	if c.Len() != 0 {
+		t.Fatalf("expected cache to be empty, got %d", c.Len())
+	}
+}
+
+func TestCacheRefreshMark(t *testing.T) {
+	c := New(Options{Size: 10})
+	req := newQuery("example.com", dns.TypeA)
+	if c.BeginRefresh(req) {
+		t.Fatalf("expected no refresh for missing entry")
+	}
+	c.Set(req, newAnswer(req, 60))
+	if !c.BeginRefresh(req) {
+		t.Fatalf("expected first refresh to start")
+	}
+	if c.BeginRefresh(req) {
+		t.Fatalf("expected concurrent refresh to be rejected")
+	}
+	c.EndRefresh(req)
+	if !c.BeginRefresh(req) {
+		t.Fatalf("expected refresh to start again after EndRefresh")
+	}
+}
+
+func TestCachePrefetchesPopularEntriesNearExpiry(t *testing.T) {
+	now := time.Unix(1000, 0)
+	c := New(Options{Size: 10, PrefetchHits: 2, PrefetchPercent: 10})
+	c.now = func() time.Time { return now }
+
+	req := newQuery("example.com", dns.TypeA)
+	c.Set(req, newAnswer(req, 100))
+
+	c.Get(req)
+	now = now.Add(95 * time.Second)
+	if c.Prefetch(req) {
+		t.Fatalf("expected no prefetch below the hit threshold")
+	}
+
+	c.Get(req)
+	now = now.Add(-10 * time.Second)
+	if c.Prefetch(req) {
+		t.Fatalf("expected no prefetch with plenty of TTL left")
+	}
+
+	now = now.Add(10 * time.Second)
+	if !c.Prefetch(req) {
+		t.Fatalf("expected prefetch for popular entry near expiry")
+	}
+	if c.Prefetch(req) {
+		t.Fatalf("expected only one prefetch while refreshing")
+	}
+}
+
+func withECS(m *dns.Msg, addr string, source, scope uint8) *dns.Msg {
+	if m.IsEdns0() == nil {
+		m.SetEdns0(dns.DefaultMsgSize, false)
+	}
+	opt := m.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        1,
+		SourceNetmask: source,
+		SourceScope:   scope,
+		Address:       net.ParseIP(addr).To4(),
+	})
+	return m
+}
+
+func TestCacheHonorsECSScope(t *testing.T) {
+	c := New(Options{Size: 10})
+
+	// The upstream says the answer holds for the whole /16.
+	req := withECS(newQuery("cdn.example", dns.TypeA), "198.51.100.0", 24, 0)
+	c.Set(req, withECS(newAnswer(req, 60), "198.51.100.0", 24, 16))
+
+	if _, ok := c.Get(withECS(newQuery("cdn.example", dns.TypeA), "198.51.7.0", 24, 0)); !ok {
+		t.Fatalf("expected a hit for another /24 inside the answer's scope")
+	}
+	if _, ok := c.Get(withECS(newQuery("cdn.example", dns.TypeA), "203.0.113.0", 24, 0)); ok {
+		t.Fatalf("expected a miss for a subnet outside the answer's scope")
+	}
+	if _, ok := c.Get(newQuery("cdn.example", dns.TypeA)); ok {
+		t.Fatalf("expected a miss for a query without ECS")
+	}
+
+	// Without ECS in the answer it is valid for every subnet.
+	req = withECS(newQuery("static.example", dns.TypeA), "198.51.100.0", 24, 0)
+	c.Set(req, newAnswer(req, 60))
+	if _, ok := c.Get(withECS(newQuery("static.example", dns.TypeA), "203.0.113.0", 24, 0)); !ok {
+		t.Fatalf("expected an answer without ECS to serve every subnet")
+	}
+}
+
+func TestCacheSkipsExpiredECSEntries(t *testing.T) {
+	now := time.Unix(1000, 0)
+	c := New(Options{Size: 10, ServeStale: time.Minute})
+	c.now = func() time.Time { return now }
+
+	// A short-lived answer for the client's own /24 and a longer one that
+	// the upstream later scoped to the whole /16.
+	req := withECS(newQuery("cdn.example", dns.TypeA), "198.51.100.0", 24, 0)
+	c.Set(req, withECS(newAnswer(req, 10), "198.51.100.0", 24, 24))
+	other := withECS(newQuery("cdn.example", dns.TypeA), "198.51.7.0", 24, 0)
+	c.Set(other, withECS(newAnswer(other, 300), "198.51.7.0", 24, 16))
+
+	for _, wait := range []time.Duration{20 * time.Second, 2 * time.Minute} {
+		now = now.Add(wait)
+		got, ok := c.Get(withECS(newQuery("cdn.example", dns.TypeA), "198.51.100.0", 24, 0))
+		if !ok {
+			t.Fatalf("after %v: expected the live /16 entry behind the expired /24 one", wait)
+		}
+		if ttl := got.Answer[0].Header().Ttl; ttl < 100 {
+			t.Fatalf("after %v: expected the /16 answer, got ttl %d", wait, ttl)
+		}
+	}
+	if c.Len() != 1 {
+		t.Fatalf("expected the /24 entry to be dropped after the stale window, got %d entries", c.Len())
+	}
+}
@@ -0,0 +1,120 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/ogpourya/dnsbro/internal/lists"
+	"github.com/ogpourya/dnsbro/internal/rules"
+	"github.com/ogpourya/dnsbro/pkg/config"
+
+	"github.com/spf13/cobra"
+)
+
+var listsCmd = &cobra.Command{
+	Use:   "lists",
+	Short: "Manage downloaded rule lists",
+}
+
+var listsUpdateCmd = &cobra.Command{
+	Use:   "update",
+	Short: "Download every rule list now and reload the running service's rules",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := requireRoot(); err != nil {
+			return err
+		}
+		if err := ensureConfigPath(); err != nil {
+			return err
+		}
+		cfg, err := config.Load(configPath)
+		if err != nil {
+			return fmt.Errorf("load config: %w", err)
+		}
+
+		store, err := lists.NewStore(cfg)
+		if err != nil {
+			return fmt.Errorf("rule lists: %w", err)
+		}
+		defer store.Close()
+		var changed, failed int
+		for _, s := range cfg.Rules.Sources {
+			if s.URL == "" {
+				continue
+			}
+			ok, err := store.Update(context.Background(), s.URL, rules.Format(s.Format))
+			switch {
+			case err != nil:
+				failed++
+				fmt.Printf("%s: %v (keeping the last good copy)\n", s.URL, err)
+			case ok:
+				changed++
+				fmt.Printf("%s: updated\n", s.URL)
+			default:
+				fmt.Printf("%s: unchanged\n", s.URL)
+			}
+		}
+
+		if changed > 0 && exec.Command("systemctl", "is-active", "--quiet", "dnsbro").Run() == nil {
+			msg, err := reloadServiceRules()
+			if err != nil {
+				return err
+			}
+			fmt.Println(msg)
+		}
+		if failed > 0 {
+			return fmt.Errorf("%d rule list(s) failed to update", failed)
+		}
+		return nil
+	},
+}
+
+// reloadServiceRules has the running service pick up the new lists. SIGUSR1
+// reloads only the rules, keeping the cache and upstreams, but a service still
+// running an older build may not handle it, so that one gets a full reload.
+func reloadServiceRules() (string, error) {
+	if serviceRunsThisBinary() {
+		if err := exec.Command("systemctl", "kill", "--kill-who=main", "--signal=SIGUSR1", "dnsbro").Run(); err != nil {
+			return "", fmt.Errorf("signal dnsbro: %w", err)
+		}
+		return "dnsbro rules reloaded", nil
+	}
+	if err := exec.Command("systemctl", "reload", "dnsbro").Run(); err != nil {
+		return "", fmt.Errorf("systemctl reload: %w", err)
+	}
+	return "dnsbro service reloaded", nil
+}
+
+// serviceRunsThisBinary reports whether the service's main process runs the
+// same executable file as this command. After an upgrade the old process
+// keeps running the replaced file until it is restarted.
+func serviceRunsThisBinary() bool {
+	out, err := exec.Command("systemctl", "show", "--property=MainPID", "--value", "dnsbro").Output()
+	if err != nil {
+		return false
+	}
+	pid := strings.TrimSpace(string(out))
+	if pid == "" || pid == "0" {
+		return false
+	}
+	self, err := os.Executable()
+	if err != nil {
+		return false
+	}
+	mine, err := os.Stat(self)
+	if err != nil {
+		return false
+	}
+	running, err := os.Stat(filepath.Join("/proc", pid, "exe"))
+	if err != nil {
+		return false
+	}
+	return os.SameFile(mine, running)
+}
+
+func init() {
+	listsCmd.AddCommand(listsUpdateCmd)
+}
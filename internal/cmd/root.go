@@ -33,6 +33,7 @@ func init() {
 	rootCmd.AddCommand(stopCmd)
 	rootCmd.AddCommand(statusCmd)
 	rootCmd.AddCommand(reloadCmd)
+	rootCmd.AddCommand(listsCmd)
 	rootCmd.AddCommand(revertCmd)
 }
 
@@ -56,7 +56,10 @@ var serveCmd = &cobra.Command{
 
 		warnIfSystemResolverBypasses(logr, cfg.Listen)
 
-		d := daemon.New(cfg, logr)
+		d, err := daemon.New(cfg, logr)
+		if err != nil {
+			return fmt.Errorf("start daemon: %w", err)
+		}
 
 		ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 		defer stop()
@@ -73,7 +76,22 @@ var serveCmd = &cobra.Command{
 				if listenOverride != "" {
 					newCfg.Listen = listenOverride
 				}
-				d.Reload(newCfg)
+				if err := d.Reload(newCfg); err != nil {
+					logr.Warnf("reload failed: %v", err)
+				}
+			}
+		}()
+
+		// SIGUSR1, sent by "dnsbro lists update", reloads only the rules.
+		rulesCh := make(chan os.Signal, 1)
+		signal.Notify(rulesCh, syscall.SIGUSR1)
+		go func() {
+			for range rulesCh {
+				if err := d.ReloadRules(); err != nil {
+					logr.Warnf("rule reload failed: %v", err)
+					continue
+				}
+				logr.Infof("rules reloaded")
 			}
 		}()
 
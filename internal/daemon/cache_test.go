@@ -0,0 +1,199 @@
+package daemon
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ogpourya/dnsbro/internal/logging"
+	"github.com/ogpourya/dnsbro/pkg/config"
+
+	"github.com/miekg/dns"
+)
+
+// fakeWriter captures the message written by ServeDNS.
+type fakeWriter struct {
+	msg *dns.Msg
+}
+
+func (w *fakeWriter) LocalAddr() net.Addr { return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53} }
+func (w *fakeWriter) RemoteAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000}
+}
+func (w *fakeWriter) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return nil
+}
+func (w *fakeWriter) Write([]byte) (int, error) { return 0, nil }
+func (w *fakeWriter) Close() error              { return nil }
+func (w *fakeWriter) TsigStatus() error         { return nil }
+func (w *fakeWriter) TsigTimersOnly(bool)       {}
+func (w *fakeWriter) Hijack()                   {}
+
+// fakeDoH is a DoH endpoint that answers every A query with 192.0.2.1.
+type fakeDoH struct {
+	*httptest.Server
+	hits     int32
+	fail     int32
+	servfail int32
+	// hold, when set before the first request, delays answers until closed.
+	hold chan struct{}
+	// stall is the number of requests left to hang until the client gives up.
+	stall int32
+}
+
+// newDoHServer starts a fakeDoH; setting fail makes it return HTTP 502 and
+// setting servfail makes it answer SERVFAIL.
+func newDoHServer(t *testing.T, ttl uint32) *fakeDoH {
+	t.Helper()
+	f := &fakeDoH{}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&f.hits, 1)
+		if atomic.AddInt32(&f.stall, -1) >= 0 {
+			// The request context only ends on disconnect once the body is read.
+			_, _ = io.ReadAll(r.Body)
+			<-r.Context().Done()
+			return
+		}
+		if f.hold != nil {
+			<-f.hold
+		}
+		if atomic.LoadInt32(&f.fail) != 0 {
+			http.Error(w, "upstream down", http.StatusBadGateway)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		var req dns.Msg
+		if err := req.Unpack(body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		resp := new(dns.Msg)
+		resp.SetReply(&req)
+		if atomic.LoadInt32(&f.servfail) != 0 {
+			resp.Rcode = dns.RcodeServerFailure
+		}
+		resp.Answer = append(resp.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl},
+			A:   net.ParseIP("192.0.2.1"),
+		})
+		wire, _ := resp.Pack()
+		w.Header().Set("Content-Type", "application/dns-message")
+		_, _ = w.Write(wire)
+	}))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func newTestDaemon(t *testing.T, endpoint string, tweak ...func(*config.Config)) *Daemon {
+	t.Helper()
+	cfg := config.Defaults()
+	cfg.Upstream.DoHEndpoint = endpoint
+	cfg.Upstream.Timeout = time.Second
+	for _, fn := range tweak {
+		fn(&cfg)
+	}
+	logr, err := logging.New("", "silent", "")
+	if err != nil {
+		t.Fatalf("logger: %v", err)
+	}
+	d, err := New(cfg, logr)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	return d
+}
+
+func TestServeDNSAnswersFromCache(t *testing.T) {
+	srv := newDoHServer(t, 300)
+	d := newTestDaemon(t, srv.URL)
+
+	for i := 0; i < 3; i++ {
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeA)
+		w := &fakeWriter{}
+		d.ServeDNS(w, req)
+		if w.msg == nil || len(w.msg.Answer) != 1 {
+			t.Fatalf("query %d: expected one answer, got %v", i, w.msg)
+		}
+		if w.msg.Id != req.Id {
+			t.Fatalf("query %d: id mismatch: got %d want %d", i, w.msg.Id, req.Id)
+		}
+	}
+
+	if got := atomic.LoadInt32(&srv.hits); got != 1 {
+		t.Fatalf("expected 1 upstream request, got %d", got)
+	}
+	stats := d.Stats()
+	if stats.CacheHits != 2 || stats.CacheMisses != 1 {
+		t.Fatalf("unexpected cache stats: hits=%d misses=%d", stats.CacheHits, stats.CacheMisses)
+	}
+}
+
+func TestServeDNSServesStaleWhenUpstreamFails(t *testing.T) {
+	srv := newDoHServer(t, 300)
+	d := newTestDaemon(t, srv.URL, func(cfg *config.Config) {
+		cfg.Upstream.Timeout = 200 * time.Millisecond
+		cfg.Cache.MaxTTL = time.Millisecond
+		cfg.Cache.ServeStale = time.Hour
+	})
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	req.SetEdns0(1232, false)
+	d.ServeDNS(&fakeWriter{}, req)
+
+	time.Sleep(5 * time.Millisecond)
+	atomic.StoreInt32(&srv.fail, 1)
+
+	w := &fakeWriter{}
+	d.ServeDNS(w, req)
+	if w.msg == nil || w.msg.Rcode != dns.RcodeSuccess || len(w.msg.Answer) != 1 {
+		t.Fatalf("expected stale answer, got %v", w.msg)
+	}
+	if ttl := w.msg.Answer[0].Header().Ttl; ttl != 30 {
+		t.Fatalf("expected stale ttl 30, got %d", ttl)
+	}
+	var ede *dns.EDNS0_EDE
+	if opt := w.msg.IsEdns0(); opt != nil {
+		for _, o := range opt.Option {
+			if e, ok := o.(*dns.EDNS0_EDE); ok {
+				ede = e
+			}
+		}
+	}
+	if ede == nil || ede.InfoCode != dns.ExtendedErrorCodeStaleAnswer {
+		t.Fatalf("expected Stale Answer EDE, got %v", ede)
+	}
+	if got := d.Stats().Stale; got != 1 {
+		t.Fatalf("expected 1 stale answer in stats, got %d", got)
+	}
+}
+
+func TestServeDNSPrefetchesPopularNames(t *testing.T) {
+	srv := newDoHServer(t, 300)
+	d := newTestDaemon(t, srv.URL, func(cfg *config.Config) {
+		cfg.Cache.Prefetch.Hits = 1
+		cfg.Cache.Prefetch.Percent = 100
+	})
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	d.ServeDNS(&fakeWriter{}, req)
+	d.ServeDNS(&fakeWriter{}, req)
+
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt32(&srv.hits) < 2 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got := atomic.LoadInt32(&srv.hits); got != 2 {
+		t.Fatalf("expected prefetch to reach the upstream, got %d requests", got)
+	}
+	if got := d.Stats().Prefetches; got != 1 {
+		t.Fatalf("expected 1 prefetch in stats, got %d", got)
+	}
+}
@@ -0,0 +1,66 @@
+package daemon
+
+import (
+	"sync"
+
+	"github.com/ogpourya/dnsbro/internal/cache"
+
+	"github.com/miekg/dns"
+)
+
+// flight is one upstream resolution shared by identical concurrent queries.
+type flight struct {
+	done     chan struct{}
+	resp     *dns.Msg
+	upstream string
+	err      error
+}
+
+// flights deduplicates in-flight queries so that concurrent identical
+// questions wait on a single upstream call. The zero value is ready to use.
+type flights struct {
+	mu sync.Mutex
+	// calls is keyed like the cache: queries with the same question, DNSSEC
+	// OK bit and client subnet can share an answer.
+	calls map[cache.Key]*flight
+}
+
+// do runs fn for r unless an identical query is already in flight, in which
+// case it waits for that call instead. The answer is a copy carrying r's ID
+// and question; shared reports whether another caller's call was reused.
+func (f *flights) do(r *dns.Msg, fn func() (*dns.Msg, string, error)) (resp *dns.Msg, upstream string, err error, shared bool) {
+	key := cache.KeyFor(r)
+
+	f.mu.Lock()
+	if c, ok := f.calls[key]; ok {
+		f.mu.Unlock()
+		<-c.done
+		return reply(r, c.resp), c.upstream, c.err, true
+	}
+	if f.calls == nil {
+		f.calls = make(map[cache.Key]*flight)
+	}
+	c := &flight{done: make(chan struct{})}
+	f.calls[key] = c
+	f.mu.Unlock()
+
+	defer func() {
+		f.mu.Lock()
+		delete(f.calls, key)
+		f.mu.Unlock()
+		close(c.done)
+	}()
+	c.resp, c.upstream, c.err = fn()
+	return reply(r, c.resp), c.upstream, c.err, false
+}
+
+// reply copies resp as the answer to req.
+func reply(req, resp *dns.Msg) *dns.Msg {
+	if resp == nil {
+		return nil
+	}
+	out := resp.Copy()
+	out.Id = req.Id
+	out.Question = append([]dns.Question(nil), req.Question...)
+	return out
+}
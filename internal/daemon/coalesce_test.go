@@ -0,0 +1,69 @@
+package daemon
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ogpourya/dnsbro/pkg/config"
+
+	"github.com/miekg/dns"
+)
+
+func TestServeDNSCoalescesIdenticalQueries(t *testing.T) {
+	srv := newDoHServer(t, 300)
+	srv.hold = make(chan struct{})
+	d := newTestDaemon(t, srv.URL, func(cfg *config.Config) {
+		cfg.Cache.Enabled = false
+	})
+
+	const n = 30
+	writers := make([]*fakeWriter, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		writers[i] = &fakeWriter{}
+		req := new(dns.Msg)
+		req.SetQuestion("cdn.example.com.", dns.TypeA)
+		req.Id = uint16(1000 + i)
+		wg.Add(1)
+		go func(w *fakeWriter, req *dns.Msg) {
+			defer wg.Done()
+			d.ServeDNS(w, req)
+		}(writers[i], req)
+	}
+
+	// A query with the DO bit set must not share the plain one's answer.
+	dnssec := new(dns.Msg)
+	dnssec.SetQuestion("cdn.example.com.", dns.TypeA)
+	dnssec.SetEdns0(dns.DefaultMsgSize, true)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		d.ServeDNS(&fakeWriter{}, dnssec)
+	}()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for atomic.LoadInt32(&srv.hits) < 2 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	// Give the remaining queries time to join the flight.
+	time.Sleep(50 * time.Millisecond)
+	close(srv.hold)
+	wg.Wait()
+
+	if got := atomic.LoadInt32(&srv.hits); got != 2 {
+		t.Fatalf("expected 2 upstream requests, got %d", got)
+	}
+	for i, w := range writers {
+		if w.msg == nil || len(w.msg.Answer) != 1 {
+			t.Fatalf("query %d: expected an answer, got %v", i, w.msg)
+		}
+		if w.msg.Id != uint16(1000+i) {
+			t.Fatalf("query %d: answer has ID %d", i, w.msg.Id)
+		}
+	}
+	if got := d.Stats().Coalesced; got != n-1 {
+		t.Fatalf("expected %d coalesced queries, got %d", n-1, got)
+	}
+}
@@ -0,0 +1,161 @@
+package daemon
+
+import (
+	"net/netip"
+	"strings"
+
+	"github.com/ogpourya/dnsbro/internal/cache"
+	"github.com/ogpourya/dnsbro/pkg/config"
+
+	"github.com/miekg/dns"
+)
+
+// Prefix lengths the anonymize policy truncates client subnets to.
+const (
+	anonymizeBits4 = 24
+	anonymizeBits6 = 56
+)
+
+// ecsPolicy decides which EDNS Client Subnet, if any, goes upstream.
+type ecsPolicy struct {
+	mode  string
+	fixed netip.Prefix
+}
+
+func newECSPolicy(cfg config.Config) ecsPolicy {
+	p := ecsPolicy{mode: strings.ToLower(cfg.ECS.Policy)}
+	if p.mode == "fixed" {
+		if prefix, err := netip.ParsePrefix(cfg.ECS.Subnet); err == nil {
+			p.fixed = prefix.Masked()
+		}
+	}
+	return p
+}
+
+// apply returns the query to send upstream for r, asked by client. r itself
+// is returned when the policy leaves it unchanged.
+func (p ecsPolicy) apply(r *dns.Msg, client netip.Addr) *dns.Msg {
+	switch p.mode {
+	case "passthrough":
+		return r
+	case "fixed":
+		return withSubnet(r, p.fixed)
+	case "anonymize":
+		src, ok := cache.ClientSubnet(r)
+		if !ok {
+			// Only public client addresses say anything useful about location.
+			if !client.IsGlobalUnicast() || client.IsPrivate() {
+				return withSubnet(r, netip.Prefix{})
+			}
+			src = netip.PrefixFrom(client, client.BitLen())
+		}
+		bits := anonymizeBits4
+		if src.Addr().Is6() {
+			bits = anonymizeBits6
+		}
+		if src.Bits() < bits {
+			bits = src.Bits()
+		}
+		return withSubnet(r, netip.PrefixFrom(src.Addr(), bits).Masked())
+	default:
+		return withSubnet(r, netip.Prefix{})
+	}
+}
+
+// withSubnet returns a copy of r carrying prefix as its only ECS option, or
+// none when prefix is invalid.
+func withSubnet(r *dns.Msg, prefix netip.Prefix) *dns.Msg {
+	if !prefix.IsValid() {
+		if _, ok := cache.ClientSubnet(r); !ok {
+			return r
+		}
+	}
+	m := r.Copy()
+	opt := m.IsEdns0()
+	if opt == nil {
+		if !prefix.IsValid() {
+			return m
+		}
+		m.SetEdns0(dns.DefaultMsgSize, false)
+		opt = m.IsEdns0()
+	}
+	options := opt.Option[:0]
+	for _, o := range opt.Option {
+		if o.Option() != dns.EDNS0SUBNET {
+			options = append(options, o)
+		}
+	}
+	opt.Option = options
+	if prefix.IsValid() {
+		family := uint16(1)
+		if prefix.Addr().Is6() {
+			family = 2
+		}
+		opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{
+			Code:          dns.EDNS0SUBNET,
+			Family:        family,
+			SourceNetmask: uint8(prefix.Bits()),
+			Address:       prefix.Addr().AsSlice(),
+		})
+	}
+	return m
+}
+
+// fitReply adapts resp to the client's query: the OPT record is dropped when
+// the query had none, as happens when a policy added an ECS option on its
+// behalf. Otherwise an ECS option in resp, which describes the subnet sent
+// upstream or that of another client sharing the cache entry, is rewritten to
+// echo the client's own option (RFC 7871 7.2.1), or removed when the client
+// sent none.
+func fitReply(req, resp *dns.Msg) *dns.Msg {
+	ropt := resp.IsEdns0()
+	if ropt == nil {
+		return resp
+	}
+	if req.IsEdns0() == nil {
+		extra := resp.Extra[:0]
+		for _, rr := range resp.Extra {
+			if rr.Header().Rrtype != dns.TypeOPT {
+				extra = append(extra, rr)
+			}
+		}
+		resp.Extra = extra
+		return resp
+	}
+
+	client := subnetOf(req.IsEdns0())
+	options := ropt.Option[:0]
+	for _, o := range ropt.Option {
+		ecs, ok := o.(*dns.EDNS0_SUBNET)
+		if !ok {
+			options = append(options, o)
+			continue
+		}
+		if client == nil {
+			continue
+		}
+		scope := ecs.SourceScope
+		if scope > client.SourceNetmask {
+			scope = client.SourceNetmask
+		}
+		options = append(options, &dns.EDNS0_SUBNET{
+			Code:          dns.EDNS0SUBNET,
+			Family:        client.Family,
+			SourceNetmask: client.SourceNetmask,
+			SourceScope:   scope,
+			Address:       client.Address,
+		})
+	}
+	ropt.Option = options
+	return resp
+}
+
+// subnetOf returns the ECS option in opt, if any.
+func subnetOf(opt *dns.OPT) *dns.EDNS0_SUBNET {
+	for _, o := range opt.Option {
+		if ecs, ok := o.(*dns.EDNS0_SUBNET); ok {
+			return ecs
+		}
+	}
+	return nil
+}
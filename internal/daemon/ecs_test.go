@@ -0,0 +1,138 @@
+package daemon
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/ogpourya/dnsbro/internal/cache"
+	"github.com/ogpourya/dnsbro/pkg/config"
+
+	"github.com/miekg/dns"
+)
+
+func TestECSPolicy(t *testing.T) {
+	query := func(subnet string) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion("cdn.example.", dns.TypeA)
+		if subnet == "" {
+			return m
+		}
+		p := netip.MustParsePrefix(subnet)
+		family := uint16(1)
+		if p.Addr().Is6() {
+			family = 2
+		}
+		m.SetEdns0(dns.DefaultMsgSize, false)
+		m.IsEdns0().Option = append(m.IsEdns0().Option, &dns.EDNS0_SUBNET{
+			Code:          dns.EDNS0SUBNET,
+			Family:        family,
+			SourceNetmask: uint8(p.Bits()),
+			Address:       net.IP(p.Addr().AsSlice()),
+		})
+		return m
+	}
+	public := netip.MustParseAddr("198.51.100.77")
+	loopback := netip.MustParseAddr("127.0.0.1")
+
+	tests := []struct {
+		name   string
+		policy string
+		subnet string
+		query  string
+		client netip.Addr
+		want   string
+	}{
+		{name: "strip removes ecs", policy: "strip", query: "198.51.100.0/24", client: loopback},
+		{name: "passthrough keeps ecs", policy: "passthrough", query: "198.51.100.77/32", client: loopback, want: "198.51.100.77/32"},
+		{name: "anonymize truncates ipv4", policy: "anonymize", query: "198.51.100.77/32", client: loopback, want: "198.51.100.0/24"},
+		{name: "anonymize truncates ipv6", policy: "anonymize", query: "2001:db8:aa:bbcc::1/128", client: loopback, want: "2001:db8:aa:bb00::/56"},
+		{name: "anonymize keeps shorter prefixes", policy: "anonymize", query: "198.51.0.0/16", client: loopback, want: "198.51.0.0/16"},
+		{name: "anonymize uses public client", policy: "anonymize", client: public, want: "198.51.100.0/24"},
+		{name: "anonymize skips loopback client", policy: "anonymize", client: loopback},
+		{name: "fixed replaces ecs", policy: "fixed", subnet: "203.0.113.0/24", query: "198.51.100.0/24", client: public, want: "203.0.113.0/24"},
+		{name: "fixed adds ecs", policy: "fixed", subnet: "203.0.113.9/24", client: loopback, want: "203.0.113.0/24"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config.Defaults()
+			cfg.ECS.Policy = tt.policy
+			cfg.ECS.Subnet = tt.subnet
+			r := query(tt.query)
+			before := r.String()
+
+			out := newECSPolicy(cfg).apply(r, tt.client)
+			got, ok := cache.ClientSubnet(out)
+			if tt.want == "" && ok {
+				t.Fatalf("expected no ECS, got %s", got)
+			}
+			if tt.want != "" && (!ok || got.String() != tt.want) {
+				t.Fatalf("ECS = %v (%v), want %s", got, ok, tt.want)
+			}
+			if r.String() != before {
+				t.Fatalf("the client's query was modified")
+			}
+		})
+	}
+}
+
+func TestFitReplyDropsAddedOPT(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion("cdn.example.", dns.TypeA)
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	resp.SetEdns0(dns.DefaultMsgSize, false)
+
+	if fitReply(req, resp).IsEdns0() != nil {
+		t.Fatalf("expected the OPT record to be dropped for a client without EDNS")
+	}
+}
+
+func TestFitReplyEchoesClientSubnet(t *testing.T) {
+	for _, policy := range []string{"anonymize", "fixed"} {
+		t.Run(policy, func(t *testing.T) {
+			cfg := config.Defaults()
+			cfg.ECS.Policy = policy
+			cfg.ECS.Subnet = "203.0.113.0/24"
+			p := newECSPolicy(cfg)
+
+			// upstream answers fwd, echoing its ECS with a /20 scope.
+			upstream := func(fwd *dns.Msg) *dns.Msg {
+				resp := new(dns.Msg)
+				resp.SetReply(fwd)
+				resp.SetEdns0(dns.DefaultMsgSize, false)
+				sent := subnetOf(fwd.IsEdns0())
+				if sent == nil {
+					t.Fatalf("expected an ECS option upstream")
+				}
+				echo := *sent
+				echo.SourceScope = 20
+				resp.IsEdns0().Option = append(resp.IsEdns0().Option, &echo)
+				return resp
+			}
+
+			req := new(dns.Msg)
+			req.SetQuestion("cdn.example.", dns.TypeA)
+			req.SetEdns0(dns.DefaultMsgSize, false)
+			req.IsEdns0().Option = append(req.IsEdns0().Option, &dns.EDNS0_SUBNET{
+				Code:          dns.EDNS0SUBNET,
+				Family:        1,
+				SourceNetmask: 32,
+				Address:       net.ParseIP("198.51.100.77").To4(),
+			})
+			got := subnetOf(fitReply(req, upstream(p.apply(req, netip.Addr{}))).IsEdns0())
+			if got == nil || got.Family != 1 || got.SourceNetmask != 32 || got.SourceScope != 20 || !got.Address.Equal(net.ParseIP("198.51.100.77")) {
+				t.Fatalf("expected the client's subnet echoed with scope 20, got %v", got)
+			}
+
+			// A client without ECS gets none back.
+			plain := new(dns.Msg)
+			plain.SetQuestion("cdn.example.", dns.TypeA)
+			plain.SetEdns0(dns.DefaultMsgSize, false)
+			resp := fitReply(plain, upstream(p.apply(plain, netip.MustParseAddr("198.51.100.77"))))
+			if resp.IsEdns0() == nil || subnetOf(resp.IsEdns0()) != nil {
+				t.Fatalf("expected the OPT record without an ECS option, got %v", resp.IsEdns0())
+			}
+		})
+	}
+}
@@ -0,0 +1,175 @@
+package daemon
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"reflect"
+	"time"
+
+	"github.com/ogpourya/dnsbro/internal/lists"
+	"github.com/ogpourya/dnsbro/internal/logging"
+	"github.com/ogpourya/dnsbro/internal/rules"
+	"github.com/ogpourya/dnsbro/pkg/config"
+)
+
+const (
+	// listCheckInterval is how often the refresher looks for lists that are due.
+	listCheckInterval = time.Minute
+	// listRetryInterval is the wait before retrying a list whose download failed.
+	listRetryInterval = 5 * time.Minute
+)
+
+// newRules combines the inline lists with the rule source files and the
+// cached copies of URL sources. URL sources not downloaded yet are skipped
+// so the daemon starts offline; the refresher adds them once they arrive.
+func newRules(cfg config.Config, logger *logging.Logger) (rules.RuleSet, error) {
+	sources := make([]rules.Source, 0, len(cfg.Rules.Sources))
+	for _, s := range cfg.Rules.Sources {
+		path := s.Path
+		if s.URL != "" {
+			path = lists.Path(cfg.Rules.CacheDir, s.URL)
+			if _, err := os.Stat(path); errors.Is(err, fs.ErrNotExist) {
+				logger.Warnf("rule list %s not downloaded yet; skipping it", s.URL)
+				continue
+			}
+		}
+		sources = append(sources, rules.Source{Path: path, Format: rules.Format(s.Format)})
+	}
+	rs, skipped, err := rules.Load(cfg.Rules.Blocklist, cfg.Rules.Allowlist, sources)
+	if err != nil {
+		return rules.RuleSet{}, err
+	}
+	for _, sk := range skipped {
+		for _, line := range sk.Lines {
+			logger.Warnf("skipping rule %v", line)
+		}
+		if more := sk.Count - len(sk.Lines); more > 0 {
+			logger.Warnf("skipping %d more unsupported lines in %s", more, sk.File)
+		}
+	}
+	return rs, nil
+}
+
+// listRefresher downloads URL sources when they are due and swaps the rebuilt
+// rules into the daemon.
+type listRefresher struct {
+	d *Daemon
+	// failed holds when each URL last failed, to space out retries.
+	failed map[string]time.Time
+	// store is built from the config fields in storeFor and rebuilt only
+	// when they change.
+	store    *lists.Store
+	storeFor listStoreConfig
+}
+
+// listStoreConfig is what a lists.Store is built from.
+type listStoreConfig struct {
+	dir string
+	srv config.UpstreamServer
+}
+
+// run checks for due lists until ctx is done.
+func (l *listRefresher) run(ctx context.Context) {
+	ticker := time.NewTicker(listCheckInterval)
+	defer ticker.Stop()
+	defer l.close()
+	for {
+		l.update(ctx, time.Now())
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// update downloads every URL source due at now and reloads the rules if any
+// list changed. A failed download keeps the last good copy in use.
+func (l *listRefresher) update(ctx context.Context, now time.Time) {
+	l.d.mu.RLock()
+	cfg := l.d.cfg
+	l.d.mu.RUnlock()
+
+	store, err := l.storeOf(cfg)
+	if err != nil {
+		l.d.logger.Warnf("rule lists: %v", err)
+		return
+	}
+	changed := false
+	for _, s := range cfg.Rules.Sources {
+		if s.URL == "" {
+			continue
+		}
+		refresh := s.Refresh
+		if refresh == 0 {
+			refresh = cfg.Rules.Refresh
+		}
+		if now.Sub(store.Fetched(s.URL)) < refresh || now.Sub(l.failed[s.URL]) < listRetryInterval {
+			continue
+		}
+		ok, err := store.Update(ctx, s.URL, rules.Format(s.Format))
+		if err != nil {
+			l.failed[s.URL] = now
+			l.d.logger.Warnf("updating rule list %s: %v; keeping the last good copy", s.URL, err)
+			continue
+		}
+		delete(l.failed, s.URL)
+		if ok {
+			l.d.logger.Infof("rule list %s updated", s.URL)
+			changed = true
+		}
+	}
+	if changed {
+		if err := l.d.ReloadRules(); err != nil {
+			l.d.logger.Errorf("reloading rules: %v", err)
+		}
+	}
+}
+
+// storeOf returns the store for cfg, replacing the current one if the cache
+// directory or the primary upstream changed.
+func (l *listRefresher) storeOf(cfg config.Config) (*lists.Store, error) {
+	want := listStoreConfig{dir: cfg.Rules.CacheDir, srv: cfg.UpstreamServers()[0]}
+	if l.store != nil && reflect.DeepEqual(l.storeFor, want) {
+		return l.store, nil
+	}
+	store, err := lists.NewStore(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if l.store != nil {
+		l.store.Close()
+	}
+	l.store, l.storeFor = store, want
+	return store, nil
+}
+
+// close releases the store's connections.
+func (l *listRefresher) close() {
+	if l.store != nil {
+		l.store.Close()
+	}
+}
+
+// ReloadRules rebuilds the rules from the current configuration and the
+// cached rule lists and swaps them in, leaving the cache and upstreams alone;
+// queries in flight keep the previous set.
+func (d *Daemon) ReloadRules() error {
+	d.reloadMu.Lock()
+	defer d.reloadMu.Unlock()
+
+	d.mu.RLock()
+	cfg := d.cfg
+	d.mu.RUnlock()
+
+	rs, err := newRules(cfg, d.logger)
+	if err != nil {
+		return err
+	}
+	d.mu.Lock()
+	d.rules = rs
+	d.mu.Unlock()
+	return nil
+}
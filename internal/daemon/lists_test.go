@@ -0,0 +1,59 @@
+package daemon
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ogpourya/dnsbro/pkg/config"
+
+	"github.com/miekg/dns"
+)
+
+func TestListRefresherSwapsRules(t *testing.T) {
+	body := "ads.example\n"
+	lists := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(body))
+	}))
+	defer lists.Close()
+
+	srv := newDoHServer(t, 300)
+	d := newTestDaemon(t, srv.URL, func(cfg *config.Config) {
+		cfg.Rules.CacheDir = t.TempDir()
+		cfg.Rules.Sources = []config.RuleSource{{URL: lists.URL, Format: "domains"}}
+	})
+	if d.rules.ShouldBlock("ads.example.", dns.TypeA) {
+		t.Fatalf("a list that was never downloaded must not block")
+	}
+
+	l := &listRefresher{d: d, failed: make(map[string]time.Time)}
+	now := time.Now()
+	l.update(context.Background(), now)
+	if !d.rules.ShouldBlock("ads.example.", dns.TypeA) {
+		t.Fatalf("expected the downloaded list to be swapped in")
+	}
+
+	// Not due yet: the list is left alone.
+	body = "tracker.example\n"
+	l.update(context.Background(), now.Add(time.Hour))
+	if d.rules.ShouldBlock("tracker.example.", dns.TypeA) {
+		t.Fatalf("expected the list to wait for its refresh interval")
+	}
+
+	// A failed download keeps the last good copy.
+	lists.Close()
+	l.update(context.Background(), now.Add(48*time.Hour))
+	if !d.rules.ShouldBlock("ads.example.", dns.TypeA) {
+		t.Fatalf("expected the last good copy to stay in use")
+	}
+
+	// The cached copy is loaded on startup without the network.
+	d2 := newTestDaemon(t, srv.URL, func(cfg *config.Config) {
+		cfg.Rules = d.cfg.Rules
+	})
+	if !d2.rules.ShouldBlock("ads.example.", dns.TypeA) {
+		t.Fatalf("expected the cached list to load offline")
+	}
+}
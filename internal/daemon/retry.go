@@ -0,0 +1,119 @@
+package daemon
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"time"
+
+	"github.com/ogpourya/dnsbro/internal/upstream"
+	"github.com/ogpourya/dnsbro/pkg/config"
+
+	"github.com/miekg/dns"
+)
+
+// errRetryLimit is returned instead of retrying while too many queries are
+// already retrying.
+var errRetryLimit = errors.New("too many queries are retrying")
+
+// retryPolicy holds the upstream.retry settings.
+type retryPolicy struct {
+	attempts int
+	backoff  time.Duration
+	// timeout is the overall deadline; zero derives it from the upstreams.
+	timeout    time.Duration
+	minTimeout time.Duration
+	// slots bounds concurrent retries; nil means no limit.
+	slots chan struct{}
+}
+
+func newRetryPolicy(cfg config.Config) retryPolicy {
+	r := cfg.Upstream.Retry
+	p := retryPolicy{
+		attempts:   r.Attempts,
+		backoff:    r.Backoff,
+		timeout:    r.Timeout,
+		minTimeout: cfg.Upstream.Timeout,
+	}
+	if p.attempts < 1 {
+		p.attempts = 1
+	}
+	if r.MaxInflight > 0 {
+		p.slots = make(chan struct{}, r.MaxInflight)
+	}
+	return p
+}
+
+// deadline returns the time allowed to answer a query via ups, retries
+// included.
+func (p retryPolicy) deadline(ups upstreamSet) time.Duration {
+	if p.timeout > 0 {
+		return p.timeout
+	}
+	if ups.budget < p.minTimeout {
+		return p.minTimeout
+	}
+	return ups.budget
+}
+
+// limit wraps fn so that every call after the first needs a free retry slot.
+func (p retryPolicy) limit(fn func(context.Context) (*dns.Msg, error)) func(context.Context) (*dns.Msg, error) {
+	if p.slots == nil {
+		return fn
+	}
+	calls := 0
+	return func(ctx context.Context) (*dns.Msg, error) {
+		calls++
+		if calls == 1 {
+			return fn(ctx)
+		}
+		select {
+		case p.slots <- struct{}{}:
+			defer func() { <-p.slots }()
+			return fn(ctx)
+		default:
+			return nil, errRetryLimit
+		}
+	}
+}
+
+// queryWithRetry calls fn up to attempts times. The pause after the first
+// failure is delay and doubles after every further one, with up to half of
+// it randomized so retries from many clients do not line up.
+func queryWithRetry(ctx context.Context, attempts int, delay time.Duration, fn func(context.Context) (*dns.Msg, error)) (*dns.Msg, error) {
+	if attempts < 1 {
+		attempts = 1
+	}
+	var lastErr error
+	for i := 1; i <= attempts; i++ {
+		resp, err := fn(ctx)
+		if err == nil {
+			return resp, nil
+		}
+		if errors.Is(err, errRetryLimit) {
+			break
+		}
+		lastErr = err
+
+		// Retrying cannot help while every upstream's circuit is open.
+		if i == attempts || errors.Is(err, upstream.ErrNoHealthyUpstream) {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(jitter(delay << (i - 1))):
+		}
+	}
+	return nil, lastErr
+}
+
+// jitter returns a random duration between d/2 and d.
+func jitter(d time.Duration) time.Duration {
+	if d <= 1 {
+		return d
+	}
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(d-half)+1))
+}
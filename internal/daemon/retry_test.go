@@ -0,0 +1,126 @@
+package daemon
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ogpourya/dnsbro/internal/logging"
+	"github.com/ogpourya/dnsbro/pkg/config"
+
+	"github.com/miekg/dns"
+)
+
+func TestQueryWithRetryBacksOffExponentially(t *testing.T) {
+	var calls []time.Time
+	_, err := queryWithRetry(context.Background(), 4, 10*time.Millisecond, func(context.Context) (*dns.Msg, error) {
+		calls = append(calls, time.Now())
+		return nil, errors.New("fail")
+	})
+	if err == nil || len(calls) != 4 {
+		t.Fatalf("expected 4 failed attempts, got %d (%v)", len(calls), err)
+	}
+	// Pauses are at least half of 10ms, 20ms and 40ms.
+	for i, min := range []time.Duration{5, 10, 20} {
+		if gap := calls[i+1].Sub(calls[i]); gap < min*time.Millisecond {
+			t.Fatalf("pause %d was %v, want at least %vms", i, gap, min)
+		}
+	}
+}
+
+func TestRetryPolicyLimitsInflightRetries(t *testing.T) {
+	cfg := config.Defaults()
+	cfg.Upstream.Retry.MaxInflight = 1
+	p := newRetryPolicy(cfg)
+
+	// Occupy the only retry slot, as a query in the middle of retrying would.
+	p.slots <- struct{}{}
+
+	calls := 0
+	_, err := queryWithRetry(context.Background(), 3, time.Millisecond, p.limit(func(context.Context) (*dns.Msg, error) {
+		calls++
+		return nil, errors.New("upstream down")
+	}))
+	if calls != 1 {
+		t.Fatalf("expected the retry to be skipped, got %d calls", calls)
+	}
+	if err == nil || err.Error() != "upstream down" {
+		t.Fatalf("expected the upstream error, got %v", err)
+	}
+
+	<-p.slots
+	calls = 0
+	_, _ = queryWithRetry(context.Background(), 3, time.Millisecond, p.limit(func(context.Context) (*dns.Msg, error) {
+		calls++
+		return nil, errors.New("upstream down")
+	}))
+	if calls != 3 {
+		t.Fatalf("expected every attempt with a free slot, got %d calls", calls)
+	}
+}
+
+func TestRetryPolicyDeadline(t *testing.T) {
+	cfg := config.Defaults()
+	cfg.Upstream.Timeout = time.Second
+	p := newRetryPolicy(cfg)
+	if got := p.deadline(upstreamSet{budget: 3 * time.Second}); got != 3*time.Second {
+		t.Fatalf("deadline = %v, want the upstream budget", got)
+	}
+	if got := p.deadline(upstreamSet{budget: 100 * time.Millisecond}); got != time.Second {
+		t.Fatalf("deadline = %v, want upstream.timeout", got)
+	}
+
+	cfg.Upstream.Retry.Timeout = 500 * time.Millisecond
+	p = newRetryPolicy(cfg)
+	if got := p.deadline(upstreamSet{budget: 3 * time.Second}); got != 500*time.Millisecond {
+		t.Fatalf("deadline = %v, want retry.timeout", got)
+	}
+}
+
+func TestUpstreamSetUsesServerTimeout(t *testing.T) {
+	cfg := config.Defaults()
+	logr, err := logging.New("", "silent", "")
+	if err != nil {
+		t.Fatalf("logger: %v", err)
+	}
+	for _, tt := range []struct {
+		timeout time.Duration
+		want    time.Duration
+	}{
+		{10 * time.Second, 10 * time.Second},
+		{0, cfg.Upstream.Retry.AttemptTimeout},
+	} {
+		cfg.Upstream.Servers = []config.UpstreamServer{{Endpoint: "udp://10.0.0.1", Timeout: tt.timeout}}
+		set, err := newUpstreamSet(cfg, cfg.UpstreamServers(), logr)
+		if err != nil {
+			t.Fatalf("newUpstreamSet() error = %v", err)
+		}
+		_ = set.close()
+		if set.budget != tt.want {
+			t.Fatalf("timeout %v: budget = %v, want %v", tt.timeout, set.budget, tt.want)
+		}
+	}
+}
+
+func TestServeDNSRetriesHungUpstream(t *testing.T) {
+	srv := newDoHServer(t, 300)
+	atomic.StoreInt32(&srv.stall, 1)
+	d := newTestDaemon(t, srv.URL, func(cfg *config.Config) {
+		*cfg = config.Defaults()
+		cfg.Upstream.DoHEndpoint = srv.URL
+		cfg.Upstream.Health.Interval = 0
+	})
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	w := &fakeWriter{}
+	d.ServeDNS(w, req)
+	if w.msg == nil || w.msg.Rcode != dns.RcodeSuccess {
+		t.Fatalf("expected the retry to answer within the deadline, got %v", w.msg)
+	}
+	if got := atomic.LoadInt32(&srv.hits); got != 2 {
+		t.Fatalf("expected a second attempt after the hung one, got %d requests", got)
+	}
+}
@@ -4,12 +4,15 @@ import (
 	"context"
 	"errors"
 	"net"
+	"net/netip"
+	"reflect"
 	"sync"
 	"time"
 
+	"github.com/ogpourya/dnsbro/internal/cache"
 	"github.com/ogpourya/dnsbro/internal/logging"
 	"github.com/ogpourya/dnsbro/internal/rules"
-	"github.com/ogpourya/dnsbro/internal/upstream/doh"
+	"github.com/ogpourya/dnsbro/internal/upstream"
 	"github.com/ogpourya/dnsbro/pkg/config"
 
 	"github.com/miekg/dns"
@@ -24,53 +27,127 @@ type QueryEvent struct {
 	RCode       int
 	Duration    time.Duration
 	Blocked     bool
+	Cached      bool
+	Stale       bool
 	Err         error
 }
 
 // Stats stores runtime counters.
 type Stats struct {
-	mu       sync.Mutex
-	Queries  int
-	Blocked  int
-	Failures int
-	Last     QueryEvent
+	Queries     int
+	Blocked     int
+	Failures    int
+	CacheHits   int
+	CacheMisses int
+	Stale       int
+	Prefetches  int
+	// Coalesced counts upstream calls saved by answering a query from an
+	// identical one already in flight.
+	Coalesced int
+	Last      QueryEvent
+	// Upstreams holds per-upstream query counts, wins and latency.
+	Upstreams []upstream.Stat
 }
 
-// Daemon runs the DNS server and forwards requests to DoH.
+// Daemon runs the DNS server and forwards requests to DoH upstreams.
 type Daemon struct {
-	cfg    config.Config
-	rules  rules.RuleSet
-	logger *logging.Logger
-	doh    *doh.Client
-	mu     sync.RWMutex
-	stats  Stats
+	cfg     config.Config
+	rules   rules.RuleSet
+	logger  *logging.Logger
+	ups     router
+	retry   retryPolicy
+	ecs     ecsPolicy
+	cache   *cache.Cache
+	flights flights
+	mu      sync.RWMutex
+	// reloadMu serializes configuration and rule list reloads.
+	reloadMu sync.Mutex
+	statsMu  sync.Mutex
+	stats    Stats
 }
 
 // New returns a configured Daemon.
-func New(cfg config.Config, logger *logging.Logger) *Daemon {
-	r := rules.RuleSet{
-		Blocklist: cfg.Rules.Blocklist,
-		Allowlist: cfg.Rules.Allowlist,
+func New(cfg config.Config, logger *logging.Logger) (*Daemon, error) {
+	r, err := newRules(cfg, logger)
+	if err != nil {
+		return nil, err
+	}
+	ups, err := newRouter(cfg, logger)
+	if err != nil {
+		return nil, err
 	}
 	return &Daemon{
 		cfg:    cfg,
 		rules:  r,
 		logger: logger,
-		doh:    doh.New(cfg.Upstream.DoHEndpoint, cfg.Upstream.Timeout, cfg.Upstream.Bootstrap),
+		ups:    ups,
+		retry:  newRetryPolicy(cfg),
+		ecs:    newECSPolicy(cfg),
+		cache:  newCache(cfg),
+	}, nil
+}
+
+func newCache(cfg config.Config) *cache.Cache {
+	if !cfg.Cache.Enabled {
+		return nil
 	}
+	return cache.New(cache.Options{
+		Size:            cfg.Cache.Size,
+		MinTTL:          cfg.Cache.MinTTL,
+		MaxTTL:          cfg.Cache.MaxTTL,
+		ServeStale:      cfg.Cache.ServeStale,
+		PrefetchHits:    cfg.Cache.Prefetch.Hits,
+		PrefetchPercent: cfg.Cache.Prefetch.Percent,
+	})
 }
 
-// Reload swaps the daemon configuration at runtime.
-func (d *Daemon) Reload(cfg config.Config) {
+// Reload swaps the daemon configuration at runtime. On error the previous
+// configuration stays active.
+func (d *Daemon) Reload(cfg config.Config) error {
+	d.reloadMu.Lock()
+	defer d.reloadMu.Unlock()
+
+	rs, err := newRules(cfg, d.logger)
+	if err != nil {
+		return err
+	}
+
+	d.mu.RLock()
+	prev := d.cfg
+	d.mu.RUnlock()
+
+	// Unchanged upstreams keep their connections and health state, and the
+	// cache keeps its entries while neither its settings nor the upstreams
+	// its answers came from have changed.
+	keepUpstreams := reflect.DeepEqual(prev.Upstream, cfg.Upstream) && reflect.DeepEqual(prev.Forward, cfg.Forward)
+	var ups router
+	if !keepUpstreams {
+		if ups, err = newRouter(cfg, d.logger); err != nil {
+			return err
+		}
+	}
+
 	d.mu.Lock()
-	defer d.mu.Unlock()
+	old := d.ups
 	d.cfg = cfg
-	d.rules = rules.RuleSet{
-		Blocklist: cfg.Rules.Blocklist,
-		Allowlist: cfg.Rules.Allowlist,
+	d.rules = rs
+	if !keepUpstreams {
+		d.ups = ups
+	}
+	d.retry = newRetryPolicy(cfg)
+	d.ecs = newECSPolicy(cfg)
+	if !keepUpstreams || prev.Cache != cfg.Cache {
+		d.cache = newCache(cfg)
+	}
+	d.mu.Unlock()
+
+	if !keepUpstreams {
+		if err := old.close(); err != nil {
+			d.logger.Warnf("closing previous upstreams: %v", err)
+		}
 	}
-	d.doh = doh.New(cfg.Upstream.DoHEndpoint, cfg.Upstream.Timeout, cfg.Upstream.Bootstrap)
 	d.logger.Infof("configuration reloaded")
+	return nil
 }
 
 // Start launches UDP and TCP listeners. Caller should cancel the context to stop.
@@ -89,10 +166,16 @@ func (d *Daemon) Start(ctx context.Context) error {
 
 	d.logger.Infof("dnsbro listening on %s (udp/tcp)", d.cfg.Listen)
 
+	refresher := &listRefresher{d: d, failed: make(map[string]time.Time)}
+	go refresher.run(ctx)
+
 	select {
 	case <-ctx.Done():
 		_ = udpServer.Shutdown()
 		_ = tcpServer.Shutdown()
+		d.mu.RLock()
+		_ = d.ups.close()
+		d.mu.RUnlock()
 		return ctx.Err()
 	case err := <-errCh:
 		return err
@@ -107,26 +190,32 @@ func (d *Daemon) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
 	}
 
 	d.mu.RLock()
-	cfg := d.cfg
 	rs := d.rules
-	upstream := d.doh
+	rt := d.ups
+	rp := d.retry
+	ep := d.ecs
+	rc := d.cache
 	d.mu.RUnlock()
 
 	question := r.Question[0]
 	domain := question.Name
+	ups := rt.route(domain)
 	clientIP, _, _ := net.SplitHostPort(w.RemoteAddr().String())
 
 	start := time.Now()
 	ev := QueryEvent{
-		Domain:   domain,
-		Client:   clientIP,
-		Upstream: cfg.Upstream.DoHEndpoint,
+		Domain: domain,
+		Client: clientIP,
 	}
 
-	if rs.ShouldBlock(domain) {
+	if blocked, typeOnly := rs.Lookup(domain, question.Qtype); blocked {
 		m := new(dns.Msg)
 		m.SetReply(r)
-		m.Rcode = dns.RcodeNameError
+		// A type-qualified block leaves the name's other types alone, so
+		// answer NODATA rather than NXDOMAIN, which would deny them all.
+		if !typeOnly {
+			m.Rcode = dns.RcodeNameError
+		}
 		_ = w.WriteMsg(m)
 		ev.Blocked = true
 		ev.RCode = m.Rcode
@@ -134,13 +223,61 @@ func (d *Daemon) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
 		return
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), cfg.Upstream.Timeout)
+	// fwd is the query as sent upstream and cached, after the ECS policy.
+	clientAddr, _ := netip.ParseAddr(clientIP)
+	fwd := ep.apply(r, clientAddr.Unmap())
+
+	if rc != nil {
+		if cached, ok := rc.Get(fwd); ok {
+			_ = w.WriteMsg(fitReply(r, cached))
+			ev.Cached = true
+			ev.Duration = time.Since(start)
+			ev.RCode = cached.Rcode
+			ev.ResponseIPs = responseIPs(cached)
+			d.recordEvent(ev)
+			if rc.Prefetch(fwd) {
+				d.recordPrefetch()
+				go d.refresh(rc, ups, rp, fwd.Copy())
+			}
+			return
+		}
+		d.recordCacheMiss()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), rp.deadline(ups))
 	defer cancel()
 
-	resp, err := queryWithRetry(ctx, 3, time.Second, func(ctx context.Context) (*dns.Msg, error) {
-		return upstream.Query(ctx, r)
+	resp, endpoint, err, shared := d.flights.do(fwd, func() (*dns.Msg, string, error) {
+		var endpoint string
+		resp, err := queryWithRetry(ctx, rp.attempts, rp.backoff, rp.limit(func(ctx context.Context) (*dns.Msg, error) {
+			resp, up, err := ups.query(ctx, fwd)
+			endpoint = up
+			return resp, err
+		}))
+		return resp, endpoint, err
 	})
+	ev.Upstream = endpoint
+	if shared {
+		d.recordCoalesced()
+	}
 	if err != nil {
+		if rc != nil {
+			if stale, ok := rc.GetStale(fwd); ok {
+				d.logger.Warnf("serving stale answer for %s: %v", domain, err)
+				stale = fitReply(r, stale)
+				markStale(r, stale)
+				_ = w.WriteMsg(stale)
+				ev.Stale = true
+				ev.Duration = time.Since(start)
+				ev.RCode = stale.Rcode
+				ev.ResponseIPs = responseIPs(stale)
+				d.recordEvent(ev)
+				if rc.BeginRefresh(fwd) {
+					go d.refresh(rc, ups, rp, fwd.Copy())
+				}
+				return
+			}
+		}
 		ev.Err = err
 		d.logger.Errorf("doh query failed for %s after retries: %v", domain, err)
 		m := new(dns.Msg)
@@ -154,63 +291,119 @@ func (d *Daemon) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
 
 	ev.Duration = time.Since(start)
 	ev.RCode = resp.Rcode
+	ev.ResponseIPs = responseIPs(resp)
+
+	if rc != nil && !shared {
+		rc.Set(fwd, resp)
+	}
+
+	_ = w.WriteMsg(fitReply(r, resp))
+	d.recordEvent(ev)
+}
+
+// refresh re-resolves req in the background and replaces the cached answer on success.
+func (d *Daemon) refresh(rc *cache.Cache, ups upstreamSet, rp retryPolicy, req *dns.Msg) {
+	defer rc.EndRefresh(req)
+
+	ctx, cancel := context.WithTimeout(context.Background(), rp.deadline(ups))
+	defer cancel()
+
+	resp, _, err := ups.query(ctx, req)
+	if err != nil {
+		d.logger.Debugf("background refresh for %s failed: %v", req.Question[0].Name, err)
+		return
+	}
+	rc.Set(req, resp)
+}
+
+// markStale attaches an Extended DNS Error "Stale Answer" (RFC 8914) when the
+// client speaks EDNS.
+func markStale(req, resp *dns.Msg) {
+	if req.IsEdns0() == nil {
+		return
+	}
+	opt := resp.IsEdns0()
+	if opt == nil {
+		resp.SetEdns0(dns.DefaultMsgSize, req.IsEdns0().Do())
+		opt = resp.IsEdns0()
+	}
+	opt.Option = append(opt.Option, &dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeStaleAnswer})
+}
+
+// Stats returns a snapshot of the runtime counters.
+func (d *Daemon) Stats() Stats {
+	d.mu.RLock()
+	ups := d.ups
+	d.mu.RUnlock()
+
+	d.statsMu.Lock()
+	s := d.stats
+	d.statsMu.Unlock()
+
+	s.Upstreams = ups.stats()
+	return s
+}
+
+func responseIPs(resp *dns.Msg) []string {
+	var ips []string
 	for _, ans := range resp.Answer {
 		if arec, ok := ans.(*dns.A); ok {
-			ev.ResponseIPs = append(ev.ResponseIPs, arec.A.String())
+			ips = append(ips, arec.A.String())
 		}
 		if aaaa, ok := ans.(*dns.AAAA); ok {
-			ev.ResponseIPs = append(ev.ResponseIPs, aaaa.AAAA.String())
+			ips = append(ips, aaaa.AAAA.String())
 		}
 	}
+	return ips
+}
 
-	_ = w.WriteMsg(resp)
-	d.recordEvent(ev)
+func (d *Daemon) recordPrefetch() {
+	d.statsMu.Lock()
+	d.stats.Prefetches++
+	d.statsMu.Unlock()
+}
+
+func (d *Daemon) recordCoalesced() {
+	d.statsMu.Lock()
+	d.stats.Coalesced++
+	d.statsMu.Unlock()
+}
+
+func (d *Daemon) recordCacheMiss() {
+	d.statsMu.Lock()
+	d.stats.CacheMisses++
+	d.statsMu.Unlock()
 }
 
 func (d *Daemon) recordEvent(ev QueryEvent) {
-	d.stats.mu.Lock()
+	d.statsMu.Lock()
 	d.stats.Queries++
 	if ev.Blocked {
 		d.stats.Blocked++
 	}
+	if ev.Cached {
+		d.stats.CacheHits++
+	}
+	if ev.Stale {
+		d.stats.Stale++
+	}
 	if ev.Err != nil {
 		d.stats.Failures++
 	}
 	d.stats.Last = ev
-	d.stats.mu.Unlock()
+	d.statsMu.Unlock()
 
 	if ev.Blocked {
 		d.logger.Infof("blocked %s from %s", ev.Domain, ev.Client)
 	} else if ev.Err != nil {
 		d.logger.Errorf("error handling %s: %v", ev.Domain, ev.Err)
+	} else if ev.Stale {
+		d.logger.Debugf("resolved %s from stale cache -> %v", ev.Domain, ev.ResponseIPs)
+	} else if ev.Cached {
+		d.logger.Debugf("resolved %s from cache -> %v", ev.Domain, ev.ResponseIPs)
 	} else {
 		d.logger.Debugf("resolved %s via %s -> %v", ev.Domain, ev.Upstream, ev.ResponseIPs)
 	}
 
 	// Non-blocking send so DNS path isn't stalled by slow UI.
 }
-
-func queryWithRetry(ctx context.Context, attempts int, delay time.Duration, fn func(context.Context) (*dns.Msg, error)) (*dns.Msg, error) {
-	if attempts < 1 {
-		attempts = 1
-	}
-	var lastErr error
-	for i := 1; i <= attempts; i++ {
-		resp, err := fn(ctx)
-		if err == nil {
-			return resp, nil
-		}
-		lastErr = err
-
-		if i == attempts {
-			break
-		}
-
-		select {
-		case <-ctx.Done():
-			return nil, ctx.Err()
-		case <-time.After(delay):
-		}
-	}
-	return nil, lastErr
-}
@@ -3,9 +3,12 @@ package daemon
 import (
 	"context"
 	"errors"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/ogpourya/dnsbro/pkg/config"
+
 	"github.com/miekg/dns"
 )
 
@@ -48,3 +51,32 @@ func TestQueryWithRetryHonorsContext(t *testing.T) {
 		t.Fatalf("context should have cancelled early, took %v", time.Since(start))
 	}
 }
+
+func TestServeDNSTypeQualifiedBlockAnswersNoData(t *testing.T) {
+	srv := newDoHServer(t, 300)
+	d := newTestDaemon(t, srv.URL, func(cfg *config.Config) {
+		cfg.Rules.Blocklist = []string{"ads.example", "ech.example$dnstype=HTTPS"}
+	})
+
+	for _, tt := range []struct {
+		name  string
+		qtype uint16
+		rcode int
+		hits  int32
+	}{
+		{"ads.example.", dns.TypeA, dns.RcodeNameError, 0},
+		{"ech.example.", dns.TypeHTTPS, dns.RcodeSuccess, 0},
+		{"ech.example.", dns.TypeA, dns.RcodeSuccess, 1},
+	} {
+		req := new(dns.Msg)
+		req.SetQuestion(tt.name, tt.qtype)
+		w := &fakeWriter{}
+		d.ServeDNS(w, req)
+		if w.msg == nil || w.msg.Rcode != tt.rcode {
+			t.Fatalf("%s %s: expected rcode %d, got %v", tt.name, dns.TypeToString[tt.qtype], tt.rcode, w.msg)
+		}
+		if got := atomic.LoadInt32(&srv.hits); got != tt.hits {
+			t.Fatalf("%s %s: expected %d upstream hits, got %d", tt.name, dns.TypeToString[tt.qtype], tt.hits, got)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package daemon
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ogpourya/dnsbro/internal/logging"
+	"github.com/ogpourya/dnsbro/internal/upstream"
+	_ "github.com/ogpourya/dnsbro/internal/upstream/all"
+	"github.com/ogpourya/dnsbro/pkg/config"
+
+	"github.com/miekg/dns"
+)
+
+// upstreamSet wraps the selector built from the configured upstreams.
+type upstreamSet struct {
+	sel *upstream.Selector
+	// budget is the time needed for one attempt at every upstream.
+	budget time.Duration
+}
+
+func newUpstreamSet(cfg config.Config, servers []config.UpstreamServer, logger *logging.Logger) (upstreamSet, error) {
+	var (
+		s          upstreamSet
+		candidates []upstream.Candidate
+	)
+	for _, srv := range servers {
+		attempt := srv.AttemptTimeout
+		if attempt == 0 {
+			attempt = srv.Timeout
+		}
+		up, err := upstream.New(srv.Endpoint, upstream.Options{
+			Timeout:      srv.Timeout,
+			Bootstrap:    srv.Bootstrap,
+			BootstrapIPs: srv.BootstrapIPs,
+			Method:       srv.Method,
+			Relay:        srv.Relay,
+			Proxy:        srv.Proxy,
+			TLS: upstream.TLSOptions{
+				ServerName: srv.TLS.ServerName,
+				CAFile:     srv.TLS.CAFile,
+				SPKIPins:   srv.TLS.SPKIPins,
+				MinVersion: srv.TLS.MinVersion,
+				CertFile:   srv.TLS.CertFile,
+				KeyFile:    srv.TLS.KeyFile,
+			},
+		})
+		if err != nil {
+			for _, c := range candidates {
+				_ = c.Upstream.Close()
+			}
+			return s, fmt.Errorf("upstream %s: %w", srv.Endpoint, err)
+		}
+		candidates = append(candidates, upstream.Candidate{Upstream: up, Weight: srv.Weight, Timeout: attempt})
+		s.budget += attempt
+	}
+	s.sel = upstream.NewSelector(upstream.Strategy(cfg.Upstream.Strategy), candidates, cfg.Upstream.Race)
+	if cfg.Upstream.Retry.Hedge {
+		s.sel.EnableHedging()
+	}
+	h := cfg.Upstream.Health
+	s.sel.EnableHealth(upstream.HealthOptions{
+		Failures: h.Failures,
+		Cooldown: h.Cooldown,
+		Interval: h.Interval,
+		Canary:   h.Query,
+		OnChange: func(name string, from, to upstream.CircuitState, failures int) {
+			switch to {
+			case upstream.CircuitOpen:
+				logger.Warnf("upstream %s unhealthy after %d consecutive failures; skipping it for %s", name, failures, h.Cooldown)
+			case upstream.CircuitHalfOpen:
+				logger.Infof("upstream %s cooldown over; testing recovery", name)
+			case upstream.CircuitClosed:
+				logger.Infof("upstream %s healthy again", name)
+			}
+		},
+		OnHealth: func(name string, healthy bool, failures int) {
+			if healthy {
+				logger.Infof("upstream %s healthy again", name)
+				return
+			}
+			logger.Warnf("upstream %s unhealthy after %d consecutive failures; still querying it as the only upstream", name, failures)
+		},
+	})
+	return s, nil
+}
+
+// query forwards req through the selector and returns the answer and the
+// upstream that produced it.
+func (s upstreamSet) query(ctx context.Context, req *dns.Msg) (*dns.Msg, string, error) {
+	resp, up, err := s.sel.Query(ctx, req)
+	if err != nil {
+		return nil, "", err
+	}
+	return resp, up.String(), nil
+}
+
+func (s upstreamSet) close() error {
+	return s.sel.Close()
+}
+
+// router picks the upstreams for a query name: those of the forward zone with
+// the longest matching suffix, or the default upstreams.
+type router struct {
+	def   upstreamSet
+	zones map[string]upstreamSet
+	// forwards lists each forward zone's upstreams once, in config order.
+	forwards []upstreamSet
+}
+
+func newRouter(cfg config.Config, logger *logging.Logger) (router, error) {
+	def, err := newUpstreamSet(cfg, cfg.UpstreamServers(), logger)
+	if err != nil {
+		return router{}, err
+	}
+	r := router{def: def, zones: make(map[string]upstreamSet)}
+	for _, z := range cfg.ForwardZones() {
+		set, err := newUpstreamSet(cfg, z.Servers, logger)
+		if err != nil {
+			_ = r.close()
+			return router{}, fmt.Errorf("forward %s: %w", strings.Join(z.Domains, ", "), err)
+		}
+		r.forwards = append(r.forwards, set)
+		for _, d := range z.Domains {
+			r.zones[config.ForwardDomain(d)] = set
+		}
+	}
+	return r, nil
+}
+
+// route returns the upstreams responsible for name.
+func (r router) route(name string) upstreamSet {
+	if len(r.zones) == 0 {
+		return r.def
+	}
+	name = strings.ToLower(dns.Fqdn(name))
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		if set, ok := r.zones[name[off:]]; ok {
+			return set
+		}
+	}
+	return r.def
+}
+
+// stats returns the counters of every upstream.
+func (r router) stats() []upstream.Stat {
+	var out []upstream.Stat
+	for _, set := range append([]upstreamSet{r.def}, r.forwards...) {
+		out = append(out, set.sel.Stats()...)
+	}
+	return out
+}
+
+func (r router) close() error {
+	errs := []error{r.def.close()}
+	for _, set := range r.forwards {
+		errs = append(errs, set.close())
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,188 @@
+package daemon
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ogpourya/dnsbro/internal/upstream"
+	"github.com/ogpourya/dnsbro/pkg/config"
+
+	"github.com/miekg/dns"
+)
+
+func TestServeDNSFailsOverToNextUpstream(t *testing.T) {
+	down := newDoHServer(t, 300)
+	atomic.StoreInt32(&down.fail, 1)
+	broken := newDoHServer(t, 300)
+	atomic.StoreInt32(&broken.servfail, 1)
+	good := newDoHServer(t, 300)
+
+	d := newTestDaemon(t, "", func(cfg *config.Config) {
+		cfg.Cache.Enabled = false
+		cfg.Upstream.Servers = []config.UpstreamServer{
+			{Endpoint: down.URL},
+			{Endpoint: broken.URL},
+			{Endpoint: good.URL},
+		}
+	})
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	w := &fakeWriter{}
+	d.ServeDNS(w, req)
+
+	if w.msg == nil || w.msg.Rcode != dns.RcodeSuccess || len(w.msg.Answer) != 1 {
+		t.Fatalf("expected answer from the third upstream, got %v", w.msg)
+	}
+	if got := d.Stats().Last.Upstream; got != good.URL {
+		t.Fatalf("expected answer via %s, got %s", good.URL, got)
+	}
+	for i, srv := range []*fakeDoH{down, broken, good} {
+		if got := atomic.LoadInt32(&srv.hits); got != 1 {
+			t.Fatalf("upstream %d: expected 1 request, got %d", i, got)
+		}
+	}
+}
+
+func TestReloadKeepsConfigOnBadUpstream(t *testing.T) {
+	srv := newDoHServer(t, 300)
+	d := newTestDaemon(t, srv.URL)
+
+	cfg := config.Defaults()
+	cfg.Upstream.DoHEndpoint = "gopher://resolver.test"
+	if err := d.Reload(cfg); err == nil {
+		t.Fatalf("expected reload to fail for unsupported scheme")
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	w := &fakeWriter{}
+	d.ServeDNS(w, req)
+	if w.msg == nil || w.msg.Rcode != dns.RcodeSuccess {
+		t.Fatalf("expected previous upstream to keep answering, got %v", w.msg)
+	}
+}
+
+func TestReloadKeepsCacheAndUpstreamsWhenUnchanged(t *testing.T) {
+	srv := newDoHServer(t, 300)
+	d := newTestDaemon(t, srv.URL)
+
+	query := func() {
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeA)
+		d.ServeDNS(&fakeWriter{}, req)
+	}
+	query()
+
+	cfg := d.cfg
+	cfg.Rules.Blocklist = []string{"ads.example"}
+	upsBefore := d.ups.def.sel
+	if err := d.Reload(cfg); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+	if d.ups.def.sel != upsBefore {
+		t.Fatalf("expected unchanged upstreams to be kept")
+	}
+	query()
+	if got := atomic.LoadInt32(&srv.hits); got != 1 {
+		t.Fatalf("expected the cached answer to survive the reload, got %d upstream hits", got)
+	}
+
+	cfg.Cache.Size = 16
+	if err := d.Reload(cfg); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+	query()
+	if got := atomic.LoadInt32(&srv.hits); got != 2 {
+		t.Fatalf("expected new cache settings to start an empty cache, got %d upstream hits", got)
+	}
+
+	other := newDoHServer(t, 300)
+	cfg.Upstream.DoHEndpoint = other.URL
+	if err := d.Reload(cfg); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+	query()
+	if got := atomic.LoadInt32(&other.hits); got != 1 {
+		t.Fatalf("expected new upstreams to start an empty cache, got %d hits at the new upstream", got)
+	}
+}
+
+func TestServeDNSForwardsByLongestSuffix(t *testing.T) {
+	def := newDoHServer(t, 300)
+	corp := newDoHServer(t, 300)
+	vpn := newDoHServer(t, 300)
+
+	d := newTestDaemon(t, def.URL, func(cfg *config.Config) {
+		cfg.Cache.Enabled = false
+		cfg.Forward = []config.ForwardZone{
+			{Domains: []string{"example.com"}, Servers: []config.UpstreamServer{{Endpoint: corp.URL}}},
+			{Domains: []string{"corp.example.com", "*.internal", "10.in-addr.arpa"}, Servers: []config.UpstreamServer{{Endpoint: vpn.URL}}},
+		}
+	})
+
+	for _, tt := range []struct {
+		name string
+		want *fakeDoH
+	}{
+		{"www.example.com.", corp},
+		{"host.corp.example.com.", vpn},
+		{"CORP.example.com.", vpn},
+		{"git.internal.", vpn},
+		{"4.3.2.10.in-addr.arpa.", vpn},
+		{"example.org.", def},
+		{"notexample.com.", def},
+	} {
+		before := atomic.LoadInt32(&tt.want.hits)
+		req := new(dns.Msg)
+		req.SetQuestion(tt.name, dns.TypeA)
+		w := &fakeWriter{}
+		d.ServeDNS(w, req)
+		if w.msg == nil || w.msg.Rcode != dns.RcodeSuccess {
+			t.Fatalf("%s: expected an answer, got %v", tt.name, w.msg)
+		}
+		if got := atomic.LoadInt32(&tt.want.hits); got != before+1 {
+			t.Fatalf("%s: expected the query at %s", tt.name, tt.want.URL)
+		}
+	}
+
+	if got := len(d.Stats().Upstreams); got != 3 {
+		t.Fatalf("expected stats for 3 upstreams, got %d", got)
+	}
+}
+
+func TestServeDNSSkipsUnhealthyUpstream(t *testing.T) {
+	down := newDoHServer(t, 300)
+	atomic.StoreInt32(&down.fail, 1)
+	backup := newDoHServer(t, 300)
+	atomic.StoreInt32(&backup.fail, 1)
+
+	d := newTestDaemon(t, down.URL, func(cfg *config.Config) {
+		cfg.Upstream.Servers = []config.UpstreamServer{{Endpoint: down.URL}, {Endpoint: backup.URL}}
+		cfg.Cache.Enabled = false
+		cfg.Upstream.Health.Interval = 0
+		cfg.Upstream.Health.Failures = 1
+		cfg.Upstream.Health.Cooldown = time.Hour
+	})
+
+	for i := 0; i < 2; i++ {
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeA)
+		w := &fakeWriter{}
+		d.ServeDNS(w, req)
+		if w.msg == nil || w.msg.Rcode != dns.RcodeServerFailure {
+			t.Fatalf("query %d: expected SERVFAIL, got %v", i, w.msg)
+		}
+	}
+	for _, srv := range []*fakeDoH{down, backup} {
+		if got := atomic.LoadInt32(&srv.hits); got != 1 {
+			t.Fatalf("expected the open circuit to stop further requests, got %d", got)
+		}
+	}
+	for _, st := range d.Stats().Upstreams {
+		if st.Circuit != upstream.CircuitOpen {
+			t.Fatalf("expected an open circuit in stats, got %+v", st)
+		}
+	}
+}
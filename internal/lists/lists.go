@@ -0,0 +1,244 @@
+// Package lists downloads remote rule sources and keeps the last good copy
+// of each on disk, so the daemon can start without network access.
+package lists
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/ogpourya/dnsbro/internal/rules"
+	"github.com/ogpourya/dnsbro/internal/upstream/bootstrap"
+	"github.com/ogpourya/dnsbro/internal/upstream/proxy"
+	"github.com/ogpourya/dnsbro/pkg/config"
+)
+
+// downloadTimeout bounds a single list download.
+const downloadTimeout = time.Minute
+
+// maxListSize bounds a single download.
+const maxListSize = 64 << 20
+
+// Store keeps downloaded rule lists in Dir.
+type Store struct {
+	Dir    string
+	Client *http.Client
+}
+
+// NewStore returns a Store for cfg.Rules.CacheDir whose downloads take the
+// same network path as the primary upstream: its bootstrap servers and
+// pinned addresses resolve hostnames, and its proxy, if any, carries the
+// connections. Lists can then be fetched before dnsbro answers queries and
+// without bypassing a proxy the upstreams rely on.
+func NewStore(cfg config.Config) (*Store, error) {
+	srv := cfg.UpstreamServers()[0]
+	resolver := bootstrap.New(srv.Bootstrap, downloadTimeout)
+	if u, err := url.Parse(srv.Endpoint); err == nil && u.Hostname() != "" {
+		if err := resolver.Pin(u.Hostname(), srv.BootstrapIPs); err != nil {
+			return nil, err
+		}
+	}
+	dial := resolver.DialContext
+	if srv.Proxy != "" {
+		p, err := proxy.New(srv.Proxy, resolver, downloadTimeout)
+		if err != nil {
+			return nil, err
+		}
+		dial = p.DialContext
+	}
+	tr := &http.Transport{
+		DialContext:         dial,
+		TLSHandshakeTimeout: downloadTimeout,
+		IdleConnTimeout:     90 * time.Second,
+	}
+	return &Store{Dir: cfg.Rules.CacheDir, Client: &http.Client{Transport: tr, Timeout: downloadTimeout}}, nil
+}
+
+// Close drops the store's idle connections.
+func (s *Store) Close() {
+	s.Client.CloseIdleConnections()
+}
+
+// meta records the validators and fetch time of a downloaded list. SHA256
+// ties them to the body they were received with, since the two files are
+// replaced one after the other.
+type meta struct {
+	URL          string    `json:"url"`
+	SHA256       string    `json:"sha256"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"last_modified,omitempty"`
+	Fetched      time.Time `json:"fetched"`
+}
+
+// Path returns the file in dir that holds the list downloaded from url. The
+// name is derived from url, so the daemon and the CLI agree on it.
+func Path(dir, url string) string {
+	sum := sha256.Sum256([]byte(url))
+	return filepath.Join(dir, hex.EncodeToString(sum[:8])+".txt")
+}
+
+// Path returns the file in the store's directory that holds the list
+// downloaded from url.
+func (s *Store) Path(url string) string {
+	return Path(s.Dir, url)
+}
+
+// metaPath returns the file next to Path(url) that holds the list's meta.
+func (s *Store) metaPath(url string) string {
+	return s.Path(url) + ".json"
+}
+
+// Fetched returns when url was last downloaded or confirmed unchanged, or
+// the zero time if it never was.
+func (s *Store) Fetched(url string) time.Time {
+	m, _ := s.readMeta(url)
+	return m.Fetched
+}
+
+// Update downloads url unless the server reports it unchanged since the last
+// download. The new copy replaces the stored one only if it holds rules in
+// format, so a failed or broken download keeps the last good list. It
+// reports whether the stored list changed.
+func (s *Store) Update(ctx context.Context, url string, format rules.Format) (bool, error) {
+	m, _ := s.readMeta(url)
+	old, err := os.ReadFile(s.Path(url))
+	if err != nil || m.SHA256 != digest(old) {
+		// Validators are useless without the body they describe, and a
+		// crash between replacing the body and its meta leaves them apart.
+		m = meta{}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return false, fmt.Errorf("create request for %s: %w", url, err)
+	}
+	if m.ETag != "" {
+		req.Header.Set("If-None-Match", m.ETag)
+	}
+	if m.LastModified != "" {
+		req.Header.Set("If-Modified-Since", m.LastModified)
+	}
+
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("download %s: %w", url, err)
+	}
+	defer resp.Body.Close()
+
+	now := time.Now()
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		m.URL = url
+		m.Fetched = now
+		return false, s.writeMeta(url, m)
+	case http.StatusOK:
+	default:
+		return false, fmt.Errorf("download %s: status %s", url, resp.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxListSize+1))
+	if err != nil {
+		return false, fmt.Errorf("download %s: %w", url, err)
+	}
+	if len(body) > maxListSize {
+		return false, fmt.Errorf("download %s: list larger than %d bytes", url, maxListSize)
+	}
+	block, allow, skipped, err := rules.Parse(bytes.NewReader(body), url, format)
+	if err != nil {
+		return false, err
+	}
+	// A body with no usable rule at all is an error page or the wrong
+	// format, not a list.
+	if len(block)+len(allow) == 0 && skipped.Count > 0 {
+		return false, fmt.Errorf("download %s: no %s rules in %d lines, first: %v", url, format, skipped.Count, skipped.Lines[0])
+	}
+
+	changed := !bytes.Equal(old, body)
+	if changed {
+		if err := writeAtomic(s.Path(url), body); err != nil {
+			return false, err
+		}
+	}
+	// The meta is written last and names the body it belongs to.
+	m = meta{
+		URL:          url,
+		SHA256:       digest(body),
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+		Fetched:      now,
+	}
+	return changed, s.writeMeta(url, m)
+}
+
+// digest returns the hex SHA-256 of a list body.
+func digest(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+func (s *Store) readMeta(url string) (meta, error) {
+	var m meta
+	b, err := os.ReadFile(s.metaPath(url))
+	if err != nil {
+		return m, err
+	}
+	if err := json.Unmarshal(b, &m); err != nil {
+		return meta{}, err
+	}
+	if m.URL != url {
+		return meta{}, errors.New("list metadata belongs to another url")
+	}
+	return m, nil
+}
+
+func (s *Store) writeMeta(url string, m meta) error {
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeAtomic(s.metaPath(url), b)
+}
+
+// writeAtomic replaces path with data so readers see either the old or the
+// new file, never a partial one.
+func writeAtomic(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("create list dir: %w", err)
+	}
+	f, err := os.CreateTemp(dir, "."+filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("create temp list: %w", err)
+	}
+	tmp := f.Name()
+	defer os.Remove(tmp)
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return fmt.Errorf("write %s: %w", path, err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("sync %s: %w", path, err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("close %s: %w", path, err)
+	}
+	if err := os.Chmod(tmp, 0o644); err != nil {
+		return fmt.Errorf("chmod %s: %w", path, err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("replace %s: %w", path, err)
+	}
+	return nil
+}
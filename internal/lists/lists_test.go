@@ -0,0 +1,189 @@
+package lists
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/ogpourya/dnsbro/internal/rules"
+	"github.com/ogpourya/dnsbro/pkg/config"
+)
+
+// listServer serves body with an ETag and counts full and conditional responses.
+type listServer struct {
+	mu          sync.Mutex
+	body        string
+	status      int
+	full        int
+	notModified int
+}
+
+func (s *listServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.status != 0 {
+		w.WriteHeader(s.status)
+		return
+	}
+	etag := fmt.Sprintf(`"%x"`, sha256.Sum256([]byte(s.body)))
+	if r.Header.Get("If-None-Match") == etag {
+		s.notModified++
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	s.full++
+	w.Header().Set("ETag", etag)
+	_, _ = w.Write([]byte(s.body))
+}
+
+func (s *listServer) set(body string, status int) {
+	s.mu.Lock()
+	s.body, s.status = body, status
+	s.mu.Unlock()
+}
+
+// newStore returns a Store in dir that downloads through proxy, if set.
+func newStore(t *testing.T, dir, proxy string) *Store {
+	t.Helper()
+	cfg := config.Defaults()
+	cfg.Rules.CacheDir = dir
+	cfg.Upstream.Servers = []config.UpstreamServer{{Endpoint: "https://dns.example/dns-query", BootstrapIPs: []string{"192.0.2.1"}, Proxy: proxy}}
+	store, err := NewStore(cfg)
+	if err != nil {
+		t.Fatalf("NewStore() error = %v", err)
+	}
+	t.Cleanup(store.Close)
+	return store
+}
+
+func TestStoreUpdate(t *testing.T) {
+	ls := &listServer{body: "ads.example\n"}
+	srv := httptest.NewServer(ls)
+	defer srv.Close()
+
+	store := newStore(t, t.TempDir(), "")
+	update := func() bool {
+		t.Helper()
+		changed, err := store.Update(context.Background(), srv.URL, rules.FormatDomains)
+		if err != nil {
+			t.Fatalf("Update() error = %v", err)
+		}
+		return changed
+	}
+
+	if !update() {
+		t.Fatalf("expected the first download to change the list")
+	}
+	if update() {
+		t.Fatalf("expected an unchanged list on the second update")
+	}
+	if ls.full != 1 || ls.notModified != 1 {
+		t.Fatalf("expected one full and one conditional response, got %d and %d", ls.full, ls.notModified)
+	}
+	if store.Fetched(srv.URL).IsZero() {
+		t.Fatalf("expected the fetch time to be recorded")
+	}
+
+	// A body replaced without its meta, as after a crash between the two
+	// renames, must not be revalidated with the old ETag.
+	if err := os.WriteFile(store.Path(srv.URL), []byte("stale.example\n"), 0o644); err != nil {
+		t.Fatalf("write list: %v", err)
+	}
+	if !update() {
+		t.Fatalf("expected a full download to replace the mismatched body")
+	}
+	if ls.full != 2 || ls.notModified != 1 {
+		t.Fatalf("expected a full response for the mismatched body, got %d full and %d conditional", ls.full, ls.notModified)
+	}
+
+	// Lines that are not rules are skipped, not fatal.
+	ls.set("tracker.example\nnot a domain!\n", 0)
+	if !update() {
+		t.Fatalf("expected a new list to replace the cached one")
+	}
+	if b, _ := os.ReadFile(store.Path(srv.URL)); string(b) != "tracker.example\nnot a domain!\n" {
+		t.Fatalf("cached list = %q", b)
+	}
+}
+
+func TestStoreKeepsLastGoodCopy(t *testing.T) {
+	ls := &listServer{body: "ads.example\n"}
+	srv := httptest.NewServer(ls)
+	defer srv.Close()
+
+	dir := t.TempDir()
+	store := newStore(t, dir, "")
+	if _, err := store.Update(context.Background(), srv.URL, rules.FormatDomains); err != nil {
+		t.Fatalf("Update() error = %v", err)
+	}
+
+	ls.set("", http.StatusInternalServerError)
+	if _, err := store.Update(context.Background(), srv.URL, rules.FormatDomains); err == nil {
+		t.Fatalf("expected an error for a failed download")
+	}
+	ls.set("not a domain!\n", 0)
+	if _, err := store.Update(context.Background(), srv.URL, rules.FormatDomains); err == nil {
+		t.Fatalf("expected an error for a list that does not parse")
+	}
+
+	if b, _ := os.ReadFile(store.Path(srv.URL)); string(b) != "ads.example\n" {
+		t.Fatalf("expected the last good copy to stay, got %q", b)
+	}
+	// Nothing but the list and its metadata is left behind.
+	entries, _ := os.ReadDir(dir)
+	for _, e := range entries {
+		if name := e.Name(); name != filepath.Base(store.Path(srv.URL)) && name != filepath.Base(store.metaPath(srv.URL)) {
+			t.Fatalf("unexpected file %s in the cache dir", name)
+		}
+	}
+}
+
+func TestStoreUsesUpstreamProxy(t *testing.T) {
+	ls := &listServer{body: "ads.example\n"}
+	srv := httptest.NewServer(ls)
+	defer srv.Close()
+
+	var connects int32
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			http.Error(w, "CONNECT only", http.StatusMethodNotAllowed)
+			return
+		}
+		atomic.AddInt32(&connects, 1)
+		target, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			target.Close()
+			return
+		}
+		_, _ = conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		go func() {
+			_, _ = io.Copy(target, conn)
+			target.Close()
+		}()
+		_, _ = io.Copy(conn, target)
+		conn.Close()
+	}))
+	defer proxy.Close()
+
+	store := newStore(t, t.TempDir(), proxy.URL)
+	if _, err := store.Update(context.Background(), srv.URL, rules.FormatDomains); err != nil {
+		t.Fatalf("Update() error = %v", err)
+	}
+	if atomic.LoadInt32(&connects) == 0 {
+		t.Fatalf("expected the download to go through the upstream proxy")
+	}
+}
@@ -0,0 +1,103 @@
+package rules
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// IsPattern reports whether rule is a /regular expression/ or a wildcard
+// rather than a plain domain.
+func IsPattern(rule string) bool {
+	rule = strings.TrimSpace(rule)
+	return isRegexp(rule) || strings.Contains(rule, "*")
+}
+
+func isRegexp(rule string) bool {
+	return len(rule) >= 2 && rule[0] == '/' && rule[len(rule)-1] == '/'
+}
+
+// ValidateRule reports why rule cannot be compiled: a malformed pattern or
+// $dnstype= qualifier. Plain domains are always accepted.
+func ValidateRule(rule string) error {
+	base, filter, err := splitRule(rule)
+	if err != nil {
+		return err
+	}
+	if filter != nil && canonical(base) == "" {
+		return fmt.Errorf("rule %q has no domain; use * to match every name", rule)
+	}
+	if !IsPattern(base) {
+		return nil
+	}
+	_, err = compilePattern(base)
+	return err
+}
+
+// compilePattern turns a pattern rule into the expression it stands for.
+//
+// A /regular expression/ uses RE2 syntax and is matched against the
+// lower-case name without its trailing dot; anchor it with ^ and $ to match
+// whole names. In a wildcard, * stands for any run of characters, dots
+// included, and like a plain rule it also matches every subdomain: ads.*
+// matches ads.example and cdn.ads.example.
+func compilePattern(rule string) (string, error) {
+	rule = strings.TrimSpace(rule)
+	if isRegexp(rule) {
+		expr := rule[1 : len(rule)-1]
+		if _, err := regexp.Compile(expr); err != nil {
+			return "", fmt.Errorf("invalid regular expression %s: %w", rule, err)
+		}
+		return expr, nil
+	}
+
+	w := canonical(rule)
+	if strings.Contains(w, "..") || strings.HasPrefix(w, ".") {
+		return "", fmt.Errorf("invalid wildcard %q: empty label", rule)
+	}
+	for i := 0; i < len(w); i++ {
+		c := w[i]
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.' || c == '*') {
+			return "", fmt.Errorf("invalid wildcard %q: unexpected %q", rule, c)
+		}
+	}
+	parts := strings.Split(w, "*")
+	for i, p := range parts {
+		parts[i] = regexp.QuoteMeta(p)
+	}
+	return `^(?:.*\.)?` + strings.Join(parts, ".*") + `$`, nil
+}
+
+// patternSet holds pattern rules compiled into a single expression, so a
+// lookup is one pass over the name however many patterns there are.
+type patternSet struct {
+	exprs []string
+	re    *regexp.Regexp
+}
+
+func (p *patternSet) add(rule string) error {
+	expr, err := compilePattern(rule)
+	if err != nil {
+		return err
+	}
+	p.exprs = append(p.exprs, "(?:"+expr+")")
+	return nil
+}
+
+// compile builds the combined expression; call it after the last add.
+func (p *patternSet) compile() error {
+	if len(p.exprs) == 0 {
+		p.re = nil
+		return nil
+	}
+	re, err := regexp.Compile(strings.Join(p.exprs, "|"))
+	if err != nil {
+		return fmt.Errorf("compile pattern rules: %w", err)
+	}
+	p.re = re
+	return nil
+}
+
+func (p *patternSet) match(name string) bool {
+	return p.re != nil && p.re.MatchString(name)
+}
@@ -0,0 +1,58 @@
+package rules
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestPatternRules(t *testing.T) {
+	rs, err := New(
+		[]string{"ads.*", "*-tracker.example.com", `/^[a-z0-9]{20,}\.cloudfront\.net$/`},
+		[]string{"ads.good.org", `/^ok-[a-z]+-tracker\.example\.com$/`},
+	)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	for domain, want := range map[string]bool{
+		"ads.example.":                            true,
+		"cdn.ads.co.uk":                           true,
+		"myads.example":                           false,
+		"foo-tracker.example.com":                 true,
+		"a.foo-tracker.example.com":               true,
+		"tracker.example.com":                     false,
+		"abcdefghij0123456789xyz.cloudfront.net.": true,
+		"short.cloudfront.net":                    false,
+		"ads.good.org":                            false,
+		"ok-fine-tracker.example.com":             false,
+		"OK-Fine-Tracker.Example.com":             false,
+	} {
+		if got := rs.ShouldBlock(domain, dns.TypeA); got != want {
+			t.Fatalf("ShouldBlock(%s) = %v, want %v", domain, got, want)
+		}
+	}
+}
+
+func TestValidateRule(t *testing.T) {
+	for rule, wantErr := range map[string]string{
+		"example.com":     "",
+		"ads.*":           "",
+		`/^ads[0-9]+\./`:  "",
+		"/ads(/":          "invalid regular expression",
+		"ads..*":          "empty label",
+		"ad s.*":          "unexpected",
+		"*.example.com/x": "unexpected",
+	} {
+		err := ValidateRule(rule)
+		if wantErr == "" && err != nil {
+			t.Fatalf("ValidateRule(%q) = %v", rule, err)
+		}
+		if wantErr != "" && (err == nil || !strings.Contains(err.Error(), wantErr)) {
+			t.Fatalf("ValidateRule(%q) = %v, want %q", rule, err, wantErr)
+		}
+	}
+	if _, err := New([]string{"/ads(/"}, nil); err == nil {
+		t.Fatalf("expected New to reject an invalid pattern")
+	}
+}
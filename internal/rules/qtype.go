@@ -0,0 +1,108 @@
+package rules
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// typeOption is the rule option that limits a rule to some query types,
+// e.g. "example.com$dnstype=HTTPS|SVCB" or "*$dnstype=~A|~AAAA".
+const typeOption = "dnstype="
+
+// typeFilter limits a rule to the listed query types, or with except to all
+// other types.
+type typeFilter struct {
+	types  []uint16
+	except bool
+}
+
+func (f typeFilter) match(qtype uint16) bool {
+	return slices.Contains(f.types, qtype) != f.except
+}
+
+// splitRule separates a rule from its $dnstype= qualifier. filter is nil
+// when the rule applies to every query type.
+func splitRule(rule string) (base string, filter *typeFilter, err error) {
+	rule = strings.TrimSpace(rule)
+	i := strings.LastIndexByte(rule, '$')
+	if isRegexp(rule) || i < 0 || (rule[0] == '/' && (i == 0 || rule[i-1] != '/')) {
+		return rule, nil, nil
+	}
+	base, opts := rule[:i], rule[i+1:]
+	for _, opt := range strings.Split(opts, ",") {
+		val, ok := strings.CutPrefix(strings.TrimSpace(opt), typeOption)
+		if !ok {
+			return "", nil, fmt.Errorf("rule %q: unsupported option %q, want %s", rule, opt, typeOption)
+		}
+		if filter != nil {
+			return "", nil, fmt.Errorf("rule %q: %s given more than once", rule, typeOption)
+		}
+		if filter, err = parseTypeFilter(val); err != nil {
+			return "", nil, fmt.Errorf("rule %q: %w", rule, err)
+		}
+	}
+	return base, filter, nil
+}
+
+// parseTypeFilter reads "A|AAAA" or "~A|~AAAA". Types are mnemonics such as
+// HTTPS or ANY, or TYPEnnn.
+func parseTypeFilter(val string) (*typeFilter, error) {
+	f := &typeFilter{}
+	for n, name := range strings.Split(val, "|") {
+		name = strings.ToUpper(strings.TrimSpace(name))
+		neg := strings.HasPrefix(name, "~")
+		if n == 0 {
+			f.except = neg
+		} else if neg != f.except {
+			return nil, fmt.Errorf("%s mixes negated and plain types", typeOption)
+		}
+		name = strings.TrimPrefix(name, "~")
+		t, ok := dns.StringToType[name]
+		if !ok {
+			num, err := strconv.ParseUint(strings.TrimPrefix(name, "TYPE"), 10, 16)
+			if err != nil || !strings.HasPrefix(name, "TYPE") {
+				return nil, fmt.Errorf("unknown query type %q", name)
+			}
+			t = uint16(num)
+		}
+		f.types = append(f.types, t)
+	}
+	return f, nil
+}
+
+// typedSet maps canonical domains to the type filters of their rules; a name
+// matches if it or a parent domain has a filter admitting the query type.
+type typedSet map[string][]typeFilter
+
+func (s typedSet) match(name string, qtype uint16) bool {
+	if len(s) == 0 {
+		return false
+	}
+	for name != "" {
+		for _, f := range s[name] {
+			if f.match(qtype) {
+				return true
+			}
+		}
+		i := strings.IndexByte(name, '.')
+		if i < 0 {
+			return false
+		}
+		name = name[i+1:]
+	}
+	return false
+}
+
+// typedPattern is a pattern rule limited to some query types.
+type typedPattern struct {
+	filter typeFilter
+	set    patternSet
+}
+
+func (p *typedPattern) match(name string, qtype uint16) bool {
+	return p.filter.match(qtype) && p.set.match(name)
+}
@@ -0,0 +1,62 @@
+package rules
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestTypeQualifiedRules(t *testing.T) {
+	rs, err := New(
+		[]string{"ech.example$dnstype=HTTPS|SVCB", "*$dnstype=ANY", "*$dnstype=TXT", "ads.example", `/^cdn[0-9]+\./$dnstype=AAAA`},
+		[]string{"txt-ok.example$dnstype=TXT", "ads.example$dnstype=~A|~AAAA"},
+	)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	tests := []struct {
+		domain   string
+		qtype    uint16
+		blocked  bool
+		typeOnly bool
+	}{
+		{"www.ech.example.", dns.TypeHTTPS, true, true},
+		{"www.ech.example.", dns.TypeSVCB, true, true},
+		{"www.ech.example.", dns.TypeA, false, false},
+		{"anything.org.", dns.TypeANY, true, true},
+		{"anything.org.", dns.TypeTXT, true, true},
+		{"mail.txt-ok.example.", dns.TypeTXT, false, false},
+		{"ads.example.", dns.TypeA, true, false},
+		{"ads.example.", dns.TypeMX, false, false},
+		{"cdn7.example.", dns.TypeAAAA, true, true},
+		{"cdn7.example.", dns.TypeA, false, false},
+	}
+	for _, tt := range tests {
+		blocked, typeOnly := rs.Lookup(tt.domain, tt.qtype)
+		if blocked != tt.blocked || typeOnly != tt.typeOnly {
+			t.Fatalf("Lookup(%s, %s) = %v, %v; want %v, %v", tt.domain, dns.TypeToString[tt.qtype], blocked, typeOnly, tt.blocked, tt.typeOnly)
+		}
+	}
+}
+
+func TestValidateRuleQualifier(t *testing.T) {
+	for rule, wantErr := range map[string]string{
+		"example.com$dnstype=TYPE65":      "",
+		"ads.*$dnstype=~a|~aaaa":          "",
+		"/^ads\\./$dnstype=HTTPS":         "",
+		"example.com$dnstype=BOGUS":       "unknown query type",
+		"example.com$dnstype=A|~AAAA":     "mixes negated",
+		"example.com$important":           "unsupported option",
+		"$dnstype=ANY":                    "has no domain",
+		"example.com$dnstype=A,dnstype=A": "more than once",
+	} {
+		err := ValidateRule(rule)
+		if wantErr == "" && err != nil {
+			t.Fatalf("ValidateRule(%q) = %v", rule, err)
+		}
+		if wantErr != "" && (err == nil || !strings.Contains(err.Error(), wantErr)) {
+			t.Fatalf("ValidateRule(%q) = %v, want %q", rule, err, wantErr)
+		}
+	}
+}
@@ -1,33 +1,185 @@
 package rules
 
-import "strings"
+import (
+	"fmt"
+	"strings"
+)
 
-// RuleSet holds simple allow/block lists.
+// RuleSet holds compiled allow/block lists. A domain rule matches its domain
+// and every subdomain; pattern rules are described at compilePattern. A
+// $dnstype= qualifier limits a rule to some query types. Allow rules win
+// over block rules. Build one with New or Load; the zero RuleSet blocks
+// nothing.
 type RuleSet struct {
-	Blocklist []string
-	Allowlist []string
+	block *ruleList
+	allow *ruleList
 }
 
-// ShouldBlock returns true if the domain should be blocked.
-func (r RuleSet) ShouldBlock(domain string) bool {
-	d := strings.TrimSuffix(strings.ToLower(domain), ".")
-	for _, allow := range r.Allowlist {
-		if matchDomain(d, allow) {
-			return false
+// ruleList is one compiled list. Plain domains live in hashed suffix sets and
+// patterns in patternSets, consulted only when the sets miss; rules with a
+// type qualifier are kept apart so unqualified lookups pay nothing for them.
+type ruleList struct {
+	exact         suffixSet
+	typed         typedSet
+	patterns      patternSet
+	typedPatterns []*typedPattern
+}
+
+// New compiles the lists into a RuleSet. Domain lookups take time
+// proportional to the number of labels in the queried name, however many
+// rules there are. It fails on the first invalid rule.
+func New(blocklist, allowlist []string) (RuleSet, error) {
+	rs := RuleSet{
+		block: &ruleList{exact: make(suffixSet, len(blocklist)), typed: make(typedSet)},
+		allow: &ruleList{exact: make(suffixSet, len(allowlist)), typed: make(typedSet)},
+	}
+	if err := rs.add(blocklist, allowlist); err != nil {
+		return RuleSet{}, err
+	}
+	if err := rs.compile(); err != nil {
+		return RuleSet{}, err
+	}
+	return rs, nil
+}
+
+// add puts more rules into rs; compile must run before rs is used.
+func (r RuleSet) add(blocklist, allowlist []string) error {
+	if err := r.block.add(blocklist); err != nil {
+		return err
+	}
+	return r.allow.add(allowlist)
+}
+
+func (r RuleSet) compile() error {
+	for _, l := range []*ruleList{r.block, r.allow} {
+		if err := l.patterns.compile(); err != nil {
+			return err
+		}
+		for _, p := range l.typedPatterns {
+			if err := p.set.compile(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Len returns the number of distinct block and allow rules.
+func (r RuleSet) Len() (block, allow int) {
+	return r.block.len(), r.allow.len()
+}
+
+// ShouldBlock returns true if a query for domain and qtype should be blocked.
+func (r RuleSet) ShouldBlock(domain string, qtype uint16) bool {
+	blocked, _ := r.Lookup(domain, qtype)
+	return blocked
+}
+
+// Lookup is ShouldBlock that also reports whether only type-qualified rules
+// blocked the query, in which case the name itself should still resolve for
+// other types.
+func (r RuleSet) Lookup(domain string, qtype uint16) (blocked, typeOnly bool) {
+	if r.block == nil {
+		return false, false
+	}
+	d := canonical(domain)
+	if r.allow.exact.match(d) || r.allow.typed.match(d, qtype) {
+		return false, false
+	}
+	switch {
+	case r.block.exact.match(d) || r.block.patterns.match(d):
+	case r.block.typed.match(d, qtype) || r.block.matchTypedPatterns(d, qtype):
+		typeOnly = true
+	default:
+		return false, false
+	}
+	if r.allow.patterns.match(d) || r.allow.matchTypedPatterns(d, qtype) {
+		return false, false
+	}
+	return true, typeOnly
+}
+
+func (l *ruleList) add(rules []string) error {
+	for _, rule := range rules {
+		base, filter, err := splitRule(rule)
+		if err != nil {
+			return err
+		}
+		switch {
+		case filter != nil && canonical(base) == "":
+			return fmt.Errorf("rule %q has no domain; use * to match every name", rule)
+		case IsPattern(base) && filter != nil:
+			p := &typedPattern{filter: *filter}
+			if err := p.set.add(base); err != nil {
+				return err
+			}
+			l.typedPatterns = append(l.typedPatterns, p)
+		case IsPattern(base):
+			if err := l.patterns.add(base); err != nil {
+				return err
+			}
+		case filter != nil:
+			d := canonical(base)
+			l.typed[d] = append(l.typed[d], *filter)
+		default:
+			if d := canonical(base); d != "" {
+				l.exact[d] = struct{}{}
+			}
 		}
 	}
-	for _, block := range r.Blocklist {
-		if matchDomain(d, block) {
+	return nil
+}
+
+func (l *ruleList) matchTypedPatterns(name string, qtype uint16) bool {
+	for _, p := range l.typedPatterns {
+		if p.match(name, qtype) {
 			return true
 		}
 	}
 	return false
 }
 
-func matchDomain(domain, rule string) bool {
-	r := strings.TrimSuffix(strings.ToLower(rule), ".")
-	if r == "" {
+func (l *ruleList) len() int {
+	if l == nil {
+		return 0
+	}
+	n := len(l.exact) + len(l.patterns.exprs) + len(l.typedPatterns)
+	for _, filters := range l.typed {
+		n += len(filters)
+	}
+	return n
+}
+
+// suffixSet holds canonical domains; a name matches if it or one of its
+// parent domains is in the set.
+type suffixSet map[string]struct{}
+
+// match looks up name and each parent domain, one map probe per label.
+func (s suffixSet) match(name string) bool {
+	if len(s) == 0 {
 		return false
 	}
-	return domain == r || strings.HasSuffix(domain, "."+r)
+	for name != "" {
+		if _, ok := s[name]; ok {
+			return true
+		}
+		i := strings.IndexByte(name, '.')
+		if i < 0 {
+			return false
+		}
+		name = name[i+1:]
+	}
+	return false
+}
+
+// canonical lowercases d and drops surrounding space and the trailing dot,
+// allocating only when d has upper-case letters.
+func canonical(d string) string {
+	d = strings.TrimSuffix(strings.TrimSpace(d), ".")
+	for i := 0; i < len(d); i++ {
+		if c := d[i]; 'A' <= c && c <= 'Z' {
+			return strings.ToLower(d)
+		}
+	}
+	return d
 }
@@ -1,11 +1,17 @@
 package rules
 
-import "testing"
+import (
+	"fmt"
+	"runtime"
+	"testing"
+
+	"github.com/miekg/dns"
+)
 
 func TestShouldBlock(t *testing.T) {
-	rs := RuleSet{
-		Blocklist: []string{"example.com", "ads.test"},
-		Allowlist: []string{"allowed.example.com"},
+	rs, err := New([]string{"example.com", "ads.test", "Tracker.Example."}, []string{"allowed.example.com"})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
 	}
 
 	cases := []struct {
@@ -18,11 +24,59 @@ func TestShouldBlock(t *testing.T) {
 		{"sub.allowed.example.com", false},
 		{"ads.test", true},
 		{"safe.com", false},
+		{"WWW.Tracker.example.", true},
+		{"notexample.com", false},
+		{"com", false},
 	}
 
 	for _, c := range cases {
-		if got := rs.ShouldBlock(c.domain); got != c.block {
+		if got := rs.ShouldBlock(c.domain, dns.TypeA); got != c.block {
 			t.Fatalf("domain %s expected block=%v got %v", c.domain, c.block, got)
 		}
 	}
 }
+
+// benchRules returns n distinct domains shaped like blocklist entries.
+func benchRules(n int) []string {
+	out := make([]string, n)
+	for i := range out {
+		out[i] = fmt.Sprintf("ads%d.tracker%d.example", i, i%1000)
+	}
+	return out
+}
+
+func BenchmarkNew1M(b *testing.B) {
+	domains := benchRules(1_000_000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var before, after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+		rs, _ := New(domains, nil)
+		runtime.GC()
+		runtime.ReadMemStats(&after)
+		b.ReportMetric(float64(int64(after.HeapAlloc)-int64(before.HeapAlloc))/float64(len(domains)), "heap-B/rule")
+		runtime.KeepAlive(rs)
+	}
+}
+
+func BenchmarkShouldBlock1M(b *testing.B) {
+	rs, err := New(benchRules(1_000_000), []string{"ads7.tracker7.example"})
+	if err != nil {
+		b.Fatalf("New() error = %v", err)
+	}
+	for _, bc := range []struct{ name, domain string }{
+		{"hit", "cdn.eu.ads123456.tracker456.example."},
+		{"allowed", "x.ads7.tracker7.example."},
+		{"miss", "www.a.long.name.that.is.not.listed.example.org."},
+		{"upper", "CDN.Ads123456.Tracker456.Example."},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				rs.ShouldBlock(bc.domain, dns.TypeA)
+			}
+		})
+	}
+}
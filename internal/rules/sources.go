@@ -0,0 +1,286 @@
+package rules
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"strings"
+)
+
+// Format names the syntax of a rule source file.
+type Format string
+
+const (
+	// FormatHosts is hosts-file syntax: "0.0.0.0 domain [domain...]".
+	FormatHosts Format = "hosts"
+	// FormatAdblock is Adblock Plus syntax: "||domain^" blocks and
+	// "@@||domain^" allows.
+	FormatAdblock Format = "adblock"
+	// FormatDnsmasq is dnsmasq syntax: "address=/domain/[addr]".
+	FormatDnsmasq Format = "dnsmasq"
+	// FormatDomains is one domain per line.
+	FormatDomains Format = "domains"
+)
+
+// Formats lists the supported source formats.
+var Formats = []Format{FormatHosts, FormatAdblock, FormatDnsmasq, FormatDomains}
+
+// Source is a file of rules in one format.
+type Source struct {
+	Path   string
+	Format Format
+}
+
+// maxSkippedLines bounds how many skipped lines are kept per source.
+const maxSkippedLines = 10
+
+// ParseError reports a malformed or unsupported line in a rule source.
+type ParseError struct {
+	File string
+	Line int
+	Msg  string
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("%s:%d: %s", e.File, e.Line, e.Msg)
+}
+
+// Skipped describes the lines of a source that were skipped because they were
+// malformed or used syntax that does not apply to DNS filtering, such as
+// cosmetic adblock rules.
+type Skipped struct {
+	File  string
+	Count int
+	// Lines holds the first few skipped lines.
+	Lines []*ParseError
+}
+
+// Load builds a RuleSet from inline lists and source files. Skipped lines do
+// not fail the load; they are reported per source that had any.
+func Load(blocklist, allowlist []string, sources []Source) (RuleSet, []Skipped, error) {
+	rs, err := New(blocklist, allowlist)
+	if err != nil {
+		return RuleSet{}, nil, err
+	}
+	var skipped []Skipped
+	for _, src := range sources {
+		block, allow, sk, err := LoadFile(src.Path, src.Format)
+		if err != nil {
+			return RuleSet{}, nil, err
+		}
+		if sk.Count > 0 {
+			skipped = append(skipped, sk)
+		}
+		if err := rs.add(block, allow); err != nil {
+			return RuleSet{}, nil, fmt.Errorf("%s: %w", src.Path, err)
+		}
+	}
+	if err := rs.compile(); err != nil {
+		return RuleSet{}, nil, err
+	}
+	return rs, skipped, nil
+}
+
+// LoadFile reads the rules in path.
+func LoadFile(path string, format Format) (block, allow []string, skipped Skipped, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, Skipped{}, fmt.Errorf("open rule source: %w", err)
+	}
+	defer f.Close()
+	return Parse(f, path, format)
+}
+
+// Parse reads rules in format from r. name identifies the source in the
+// skipped lines, which carry their line number. Only read errors fail.
+func Parse(r io.Reader, name string, format Format) (block, allow []string, skipped Skipped, err error) {
+	var parseLine func(line string) (domains []string, allowed bool, err error)
+	switch format {
+	case FormatHosts:
+		parseLine = parseHostsLine
+	case FormatAdblock:
+		parseLine = parseAdblockLine
+	case FormatDnsmasq:
+		parseLine = parseDnsmasqLine
+	case FormatDomains:
+		parseLine = parseDomainLine
+	default:
+		return nil, nil, Skipped{}, fmt.Errorf("%s: unknown rule format %q", name, format)
+	}
+
+	skipped.File = name
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" {
+			continue
+		}
+		domains, allowed, err := parseLine(line)
+		if err != nil {
+			skipped.Count++
+			if len(skipped.Lines) < maxSkippedLines {
+				skipped.Lines = append(skipped.Lines, &ParseError{File: name, Line: n, Msg: err.Error()})
+			}
+			continue
+		}
+		if allowed {
+			allow = append(allow, domains...)
+		} else {
+			block = append(block, domains...)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, nil, Skipped{}, fmt.Errorf("read %s: %w", name, err)
+	}
+	return block, allow, skipped, nil
+}
+
+// stripComment removes a trailing "#" comment.
+func stripComment(line string) string {
+	if i := strings.IndexByte(line, '#'); i >= 0 {
+		line = line[:i]
+	}
+	return strings.TrimSpace(line)
+}
+
+// hostsSkip are names hosts files map to themselves; they are never blocked.
+var hostsSkip = map[string]bool{
+	"localhost":             true,
+	"localhost.localdomain": true,
+	"local":                 true,
+	"broadcasthost":         true,
+	"ip6-localhost":         true,
+	"ip6-loopback":          true,
+	"0.0.0.0":               true,
+}
+
+func parseHostsLine(line string) ([]string, bool, error) {
+	fields := strings.Fields(stripComment(line))
+	if len(fields) == 0 {
+		return nil, false, nil
+	}
+	if _, err := netip.ParseAddr(fields[0]); err != nil {
+		return nil, false, fmt.Errorf("expected an IP address, got %q", fields[0])
+	}
+	if len(fields) == 1 {
+		return nil, false, errors.New("missing domain after the address")
+	}
+	var out []string
+	for _, f := range fields[1:] {
+		d := normalizeDomain(f)
+		if hostsSkip[d] {
+			continue
+		}
+		if !validDomain(d) {
+			return nil, false, fmt.Errorf("invalid domain %q", f)
+		}
+		out = append(out, d)
+	}
+	return out, false, nil
+}
+
+func parseAdblockLine(line string) ([]string, bool, error) {
+	if line[0] == '!' || line[0] == '[' || line[0] == '#' {
+		return nil, false, nil
+	}
+	allowed := strings.HasPrefix(line, "@@")
+	rule := strings.TrimPrefix(line, "@@")
+	// $dnstype= carries over; $important changes nothing here. Any other
+	// option narrows or cancels the rule in ways not modelled, so the rule is
+	// skipped rather than applied unconditionally.
+	var qualifier string
+	if i := strings.LastIndexByte(rule, '$'); i >= 0 && !isRegexp(rule) {
+		for _, opt := range strings.Split(rule[i+1:], ",") {
+			switch {
+			case strings.HasPrefix(opt, typeOption):
+				qualifier = "$" + opt
+			case opt == "important":
+			default:
+				return nil, false, fmt.Errorf("unsupported adblock option %q", opt)
+			}
+		}
+		rule = rule[:i]
+	}
+	if isRegexp(rule) {
+		if err := ValidateRule(rule + qualifier); err != nil {
+			return nil, false, err
+		}
+		return []string{rule + qualifier}, allowed, nil
+	}
+	if !strings.HasPrefix(rule, "||") {
+		return nil, false, fmt.Errorf("unsupported adblock rule %q: want ||domain^ or /regexp/", line)
+	}
+	d := normalizeDomain(strings.TrimSuffix(rule[2:], "^"))
+	if !strings.Contains(d, "*") && !validDomain(d) {
+		return nil, false, fmt.Errorf("invalid domain in adblock rule %q", line)
+	}
+	if err := ValidateRule(d + qualifier); err != nil {
+		return nil, false, err
+	}
+	return []string{d + qualifier}, allowed, nil
+}
+
+func parseDnsmasqLine(line string) ([]string, bool, error) {
+	line = stripComment(line)
+	if line == "" {
+		return nil, false, nil
+	}
+	rest, ok := strings.CutPrefix(line, "address=/")
+	if !ok {
+		return nil, false, fmt.Errorf("unsupported dnsmasq directive %q: want address=/domain/", line)
+	}
+	parts := strings.Split(rest, "/")
+	if len(parts) < 2 {
+		return nil, false, fmt.Errorf("unterminated address directive %q", line)
+	}
+	// address=/a/b/addr lists several domains before the address.
+	var out []string
+	for _, p := range parts[:len(parts)-1] {
+		d := normalizeDomain(p)
+		if !validDomain(d) {
+			return nil, false, fmt.Errorf("invalid domain %q", p)
+		}
+		out = append(out, d)
+	}
+	return out, false, nil
+}
+
+func parseDomainLine(line string) ([]string, bool, error) {
+	line = stripComment(line)
+	if line == "" {
+		return nil, false, nil
+	}
+	d := normalizeDomain(line)
+	if strings.ContainsAny(d, " \t") || !validDomain(d) {
+		return nil, false, fmt.Errorf("invalid domain %q", line)
+	}
+	return []string{d}, false, nil
+}
+
+func normalizeDomain(s string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(s)), ".")
+}
+
+// validDomain accepts dot-separated labels of letters, digits, hyphens and
+// underscores.
+func validDomain(d string) bool {
+	if d == "" || len(d) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(d, ".") {
+		if label == "" || len(label) > 63 {
+			return false
+		}
+		for i := 0; i < len(label); i++ {
+			c := label[i]
+			if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return false
+			}
+		}
+	}
+	return true
+}
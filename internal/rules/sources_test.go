@@ -0,0 +1,136 @@
+package rules
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestParseFormats(t *testing.T) {
+	tests := []struct {
+		format Format
+		input  string
+		block  []string
+		allow  []string
+	}{
+		{
+			format: FormatHosts,
+			input:  "# comment\n127.0.0.1 localhost\n0.0.0.0 ads.example.com tracker.example.net # inline\n:: Ads6.Example.com.\n",
+			block:  []string{"ads.example.com", "tracker.example.net", "ads6.example.com"},
+		},
+		{
+			format: FormatAdblock,
+			input:  "[Adblock Plus 2.0]\n! Title: test\n||ads.example.com^\n@@||good.example.com^\n||tracker.example.net^$important\n||*-ads.example^\n/^ad[0-9]+\\./\n||ech.example^$important,dnstype=HTTPS|SVCB\n",
+			block:  []string{"ads.example.com", "tracker.example.net", "*-ads.example", `/^ad[0-9]+\./`, "ech.example$dnstype=HTTPS|SVCB"},
+			allow:  []string{"good.example.com"},
+		},
+		{
+			format: FormatDnsmasq,
+			input:  "address=/ads.example.com/\naddress=/a.example/b.example/0.0.0.0\n# comment\n",
+			block:  []string{"ads.example.com", "a.example", "b.example"},
+		},
+		{
+			format: FormatDomains,
+			input:  "ads.example.com\n\n# comment\ntracker.example.net\n",
+			block:  []string{"ads.example.com", "tracker.example.net"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.format), func(t *testing.T) {
+			block, allow, skipped, err := Parse(strings.NewReader(tt.input), "list.txt", tt.format)
+			if err != nil || skipped.Count != 0 {
+				t.Fatalf("Parse() error = %v, skipped %v", err, skipped.Lines)
+			}
+			if !reflect.DeepEqual(block, tt.block) || !reflect.DeepEqual(allow, tt.allow) {
+				t.Fatalf("Parse() = %v, %v; want %v, %v", block, allow, tt.block, tt.allow)
+			}
+		})
+	}
+}
+
+func TestParseSkipsBadLines(t *testing.T) {
+	input := "ads.example.com\nnot a domain\nok.example\nbad..example\n"
+	block, _, skipped, err := Parse(strings.NewReader(input), "/etc/dnsbro/block.txt", FormatDomains)
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	if !reflect.DeepEqual(block, []string{"ads.example.com", "ok.example"}) {
+		t.Fatalf("expected the good lines to load, got %v", block)
+	}
+	if skipped.Count != 2 || len(skipped.Lines) != 2 {
+		t.Fatalf("expected two skipped lines, got %+v", skipped)
+	}
+	if pe := skipped.Lines[0]; pe.File != "/etc/dnsbro/block.txt" || pe.Line != 2 {
+		t.Fatalf("expected line 2 to be reported first, got %v", pe)
+	}
+	if !strings.Contains(skipped.Lines[1].Error(), "/etc/dnsbro/block.txt:4:") {
+		t.Fatalf("expected line 4 to be reported too, got %v", skipped.Lines[1])
+	}
+
+	for format, line := range map[Format]string{
+		FormatHosts:   "ads.example.com",
+		FormatAdblock: "example.com##.banner",
+		FormatDnsmasq: "server=/corp/10.0.0.1",
+	} {
+		_, _, skipped, err := Parse(strings.NewReader(line), "x", format)
+		if err != nil || skipped.Count != 1 {
+			t.Fatalf("%s: expected %q to be skipped, got %v, %+v", format, line, err, skipped)
+		}
+	}
+	_, _, skipped, _ = Parse(strings.NewReader("/ad(/"), "x", FormatAdblock)
+	if skipped.Count != 1 || !strings.Contains(skipped.Lines[0].Error(), "x:1: invalid regular expression") {
+		t.Fatalf("expected an invalid regexp to be skipped, got %+v", skipped)
+	}
+}
+
+func TestParseAdblockSkipsUnknownOptions(t *testing.T) {
+	input := "||ads.example^$important\n||cdn.example^$badfilter\n||tracker.example^$client=10.0.0.1\n@@||good.example^$denyallow=x.example\n|http://x^\n/ads.js\n"
+	block, allow, skipped, err := Parse(strings.NewReader(input), "filter.txt", FormatAdblock)
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	if !reflect.DeepEqual(block, []string{"ads.example"}) || len(allow) != 0 {
+		t.Fatalf("Parse() = %v, %v; want only ads.example", block, allow)
+	}
+	if skipped.Count != 5 {
+		t.Fatalf("expected 5 skipped lines, got %+v", skipped)
+	}
+}
+
+func TestLoadMergesSources(t *testing.T) {
+	dir := t.TempDir()
+	hosts := filepath.Join(dir, "hosts")
+	abp := filepath.Join(dir, "filter.txt")
+	if err := os.WriteFile(hosts, []byte("0.0.0.0 ads.example.com\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(abp, []byte("@@||cdn.ads.example.com^\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	rs, _, err := Load([]string{"inline.example"}, nil, []Source{
+		{Path: hosts, Format: FormatHosts},
+		{Path: abp, Format: FormatAdblock},
+	})
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	for domain, want := range map[string]bool{
+		"inline.example":         true,
+		"www.ads.example.com":    true,
+		"cdn.ads.example.com":    false,
+		"unrelated.example.com.": false,
+	} {
+		if got := rs.ShouldBlock(domain, dns.TypeA); got != want {
+			t.Fatalf("ShouldBlock(%s) = %v, want %v", domain, got, want)
+		}
+	}
+
+	if _, _, err := Load(nil, nil, []Source{{Path: filepath.Join(dir, "missing"), Format: FormatDomains}}); err == nil {
+		t.Fatalf("expected an error for a missing source")
+	}
+}
@@ -105,6 +105,7 @@ ExecReload=/bin/kill -HUP $MAINPID
 Restart=on-failure
 User=root
 AmbientCapabilities=CAP_NET_BIND_SERVICE
+StateDirectory=dnsbro
 
 [Install]
 WantedBy=multi-user.target
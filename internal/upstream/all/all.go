@@ -0,0 +1,12 @@
+// Package all registers every built-in upstream transport.
+package all
+
+import (
+	// Transports register themselves with the upstream package on init.
+	_ "github.com/ogpourya/dnsbro/internal/upstream/doh"
+	_ "github.com/ogpourya/dnsbro/internal/upstream/doq"
+	_ "github.com/ogpourya/dnsbro/internal/upstream/dot"
+	_ "github.com/ogpourya/dnsbro/internal/upstream/odoh"
+	_ "github.com/ogpourya/dnsbro/internal/upstream/plain"
+	_ "github.com/ogpourya/dnsbro/internal/upstream/stamp"
+)
@@ -0,0 +1,270 @@
+// Package bootstrap resolves the hostnames of upstream resolvers without
+// going through the system resolver, which may point back at dnsbro itself.
+package bootstrap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// minTTL keeps answers with a zero or tiny TTL from being looked up on every
+// new connection.
+const minTTL = 30 * time.Second
+
+// minDialTimeout is the least time a single address gets when a dial falls
+// back across several addresses.
+const minDialTimeout = 2 * time.Second
+
+// Resolver looks up upstream hostnames via the bootstrap DNS servers and
+// caches the answers for their TTL. Hosts pinned to static addresses are
+// never looked up.
+type Resolver struct {
+	servers []string
+	timeout time.Duration
+	pinned  map[string][]netip.Addr
+	now     func() time.Time
+
+	mu    sync.Mutex
+	cache map[string]cacheEntry
+}
+
+type cacheEntry struct {
+	addrs   []netip.Addr
+	expires time.Time
+}
+
+// New returns a Resolver that sends its lookups to servers, or to public
+// resolvers when none are given.
+func New(servers []string, timeout time.Duration) *Resolver {
+	if timeout == 0 {
+		timeout = 5 * time.Second
+	}
+	return &Resolver{
+		servers: NormalizeServers(servers),
+		timeout: timeout,
+		pinned:  make(map[string][]netip.Addr),
+		now:     time.Now,
+		cache:   make(map[string]cacheEntry),
+	}
+}
+
+// Pin makes host resolve to ips without any bootstrap traffic. It must be
+// called before the resolver is used; an empty ips is a no-op.
+func (r *Resolver) Pin(host string, ips []string) error {
+	if len(ips) == 0 {
+		return nil
+	}
+	addrs := make([]netip.Addr, 0, len(ips))
+	for _, s := range ips {
+		ip, err := netip.ParseAddr(strings.Trim(s, "[]"))
+		if err != nil {
+			return fmt.Errorf("invalid bootstrap ip %q", s)
+		}
+		addrs = append(addrs, ip.Unmap())
+	}
+	r.pinned[strings.ToLower(strings.TrimSuffix(host, "."))] = sortAddrs(addrs)
+	return nil
+}
+
+// LookupNetIP returns the addresses of host, IPv4 first. IP literals are
+// returned as is.
+func (r *Resolver) LookupNetIP(ctx context.Context, host string) ([]netip.Addr, error) {
+	if ip, err := netip.ParseAddr(strings.Trim(host, "[]")); err == nil {
+		return []netip.Addr{ip.Unmap()}, nil
+	}
+	key := strings.ToLower(strings.TrimSuffix(host, "."))
+	if addrs, ok := r.pinned[key]; ok {
+		return addrs, nil
+	}
+
+	r.mu.Lock()
+	e, ok := r.cache[key]
+	r.mu.Unlock()
+	if ok && r.now().Before(e.expires) {
+		return e.addrs, nil
+	}
+
+	v4, ttl4, err4 := r.lookup(ctx, key, dns.TypeA)
+	v6, ttl6, err6 := r.lookup(ctx, key, dns.TypeAAAA)
+	addrs := append(v4, v6...)
+	if len(addrs) == 0 {
+		if err := errors.Join(err4, err6); err != nil {
+			return nil, fmt.Errorf("bootstrap lookup of %s: %w", host, err)
+		}
+		return nil, fmt.Errorf("bootstrap lookup of %s: no addresses", host)
+	}
+
+	ttl := ttl4
+	if len(v4) == 0 || (len(v6) > 0 && ttl6 < ttl) {
+		ttl = ttl6
+	}
+	r.mu.Lock()
+	r.cache[key] = cacheEntry{addrs: addrs, expires: r.now().Add(ttl)}
+	r.mu.Unlock()
+	return addrs, nil
+}
+
+// lookup queries the bootstrap servers in turn for host's records of qtype
+// and returns them with their lowest TTL.
+func (r *Resolver) lookup(ctx context.Context, host string, qtype uint16) ([]netip.Addr, time.Duration, error) {
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(host), qtype)
+
+	var lastErr error
+	for _, server := range r.servers {
+		resp, err := r.exchange(ctx, msg, server)
+		if err != nil {
+			lastErr = err
+			if ctx.Err() != nil {
+				break
+			}
+			continue
+		}
+		if resp.Rcode != dns.RcodeSuccess {
+			return nil, 0, fmt.Errorf("%s from %s", dns.RcodeToString[resp.Rcode], server)
+		}
+
+		var (
+			addrs []netip.Addr
+			ttl   uint32
+		)
+		for _, rr := range resp.Answer {
+			var ip net.IP
+			switch rec := rr.(type) {
+			case *dns.A:
+				ip = rec.A
+			case *dns.AAAA:
+				ip = rec.AAAA
+			default:
+				continue
+			}
+			if addr, ok := netip.AddrFromSlice(ip); ok {
+				addrs = append(addrs, addr.Unmap())
+				if ttl == 0 || rr.Header().Ttl < ttl {
+					ttl = rr.Header().Ttl
+				}
+			}
+		}
+		d := time.Duration(ttl) * time.Second
+		if d < minTTL {
+			d = minTTL
+		}
+		return addrs, d, nil
+	}
+	return nil, 0, lastErr
+}
+
+// exchange sends msg to server over UDP, retrying over TCP when truncated.
+func (r *Resolver) exchange(ctx context.Context, msg *dns.Msg, server string) (*dns.Msg, error) {
+	c := &dns.Client{Net: "udp", Timeout: r.timeout}
+	resp, _, err := c.ExchangeContext(ctx, msg, server)
+	if err == nil && resp.Truncated {
+		c.Net = "tcp"
+		resp, _, err = c.ExchangeContext(ctx, msg, server)
+	}
+	return resp, err
+}
+
+// DialContext connects to addr (host:port), resolving host via LookupNetIP
+// and trying its addresses in turn until one answers.
+func (r *Resolver) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := r.LookupNetIP(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ips = filterFamily(ips, network)
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("no %s address for %s", network, host)
+	}
+
+	var lastErr error
+	for i, ip := range ips {
+		// Leave time for the remaining addresses if this one is unreachable.
+		timeout := r.timeout / time.Duration(len(ips)-i)
+		if timeout < minDialTimeout {
+			timeout = minDialTimeout
+		}
+		d := net.Dialer{Timeout: timeout, KeepAlive: r.timeout}
+		conn, err := d.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, lastErr
+}
+
+// filterFamily drops addresses that network (e.g. "tcp4") cannot reach.
+func filterFamily(ips []netip.Addr, network string) []netip.Addr {
+	switch {
+	case strings.HasSuffix(network, "4"):
+		var out []netip.Addr
+		for _, ip := range ips {
+			if ip.Is4() {
+				out = append(out, ip)
+			}
+		}
+		return out
+	case strings.HasSuffix(network, "6"):
+		var out []netip.Addr
+		for _, ip := range ips {
+			if ip.Is6() {
+				out = append(out, ip)
+			}
+		}
+		return out
+	}
+	return ips
+}
+
+// sortAddrs puts IPv4 addresses before IPv6 ones, keeping their order.
+func sortAddrs(addrs []netip.Addr) []netip.Addr {
+	out := make([]netip.Addr, 0, len(addrs))
+	for _, ip := range addrs {
+		if ip.Is4() {
+			out = append(out, ip)
+		}
+	}
+	for _, ip := range addrs {
+		if !ip.Is4() {
+			out = append(out, ip)
+		}
+	}
+	return out
+}
+
+// NormalizeServers adds the default port to bootstrap addresses and falls
+// back to public resolvers when none are configured.
+func NormalizeServers(servers []string) []string {
+	if len(servers) == 0 {
+		return []string{"1.1.1.1:53", "8.8.8.8:53"}
+	}
+
+	out := make([]string, 0, len(servers))
+	for _, s := range servers {
+		host, port, err := net.SplitHostPort(s)
+		if err != nil || port == "" {
+			s = net.JoinHostPort(s, "53")
+		} else {
+			s = net.JoinHostPort(host, port)
+		}
+		out = append(out, s)
+	}
+
+	return out
+}
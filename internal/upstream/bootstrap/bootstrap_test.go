@@ -0,0 +1,121 @@
+package bootstrap
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// startServer runs a bootstrap DNS server that answers every name with
+// 192.0.2.1 and 2001:db8::1, and counts the queries it gets.
+func startServer(t *testing.T, ttl uint32) (string, *int32) {
+	t.Helper()
+	var queries int32
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	srv := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		atomic.AddInt32(&queries, 1)
+		resp := new(dns.Msg)
+		resp.SetReply(r)
+		hdr := dns.RR_Header{Name: r.Question[0].Name, Rrtype: r.Question[0].Qtype, Class: dns.ClassINET, Ttl: ttl}
+		switch r.Question[0].Qtype {
+		case dns.TypeA:
+			resp.Answer = append(resp.Answer, &dns.A{Hdr: hdr, A: net.ParseIP("192.0.2.1")})
+		case dns.TypeAAAA:
+			resp.Answer = append(resp.Answer, &dns.AAAA{Hdr: hdr, AAAA: net.ParseIP("2001:db8::1")})
+		}
+		_ = w.WriteMsg(resp)
+	})}
+	go func() { _ = srv.ActivateAndServe() }()
+	t.Cleanup(func() { _ = srv.Shutdown() })
+	return pc.LocalAddr().String(), &queries
+}
+
+func TestLookupCachesForTTL(t *testing.T) {
+	addr, queries := startServer(t, 300)
+	r := New([]string{addr}, time.Second)
+	now := time.Now()
+	r.now = func() time.Time { return now }
+
+	want := []netip.Addr{netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("2001:db8::1")}
+	for i := 0; i < 3; i++ {
+		got, err := r.LookupNetIP(context.Background(), "doh.example")
+		if err != nil {
+			t.Fatalf("LookupNetIP() error = %v", err)
+		}
+		if len(got) != 2 || got[0] != want[0] || got[1] != want[1] {
+			t.Fatalf("LookupNetIP() = %v, want %v", got, want)
+		}
+	}
+	if got := atomic.LoadInt32(queries); got != 2 {
+		t.Fatalf("expected one A and one AAAA query, got %d", got)
+	}
+
+	now = now.Add(301 * time.Second)
+	if _, err := r.LookupNetIP(context.Background(), "doh.example"); err != nil {
+		t.Fatalf("LookupNetIP() error = %v", err)
+	}
+	if got := atomic.LoadInt32(queries); got != 4 {
+		t.Fatalf("expected a new lookup after the TTL, got %d queries", got)
+	}
+}
+
+func TestPinnedHostSkipsBootstrap(t *testing.T) {
+	addr, queries := startServer(t, 300)
+	r := New([]string{addr}, time.Second)
+	if err := r.Pin("DoH.example.", []string{"2001:db8::2", "198.51.100.1"}); err != nil {
+		t.Fatalf("Pin() error = %v", err)
+	}
+	got, err := r.LookupNetIP(context.Background(), "doh.example")
+	if err != nil {
+		t.Fatalf("LookupNetIP() error = %v", err)
+	}
+	if len(got) != 2 || got[0].String() != "198.51.100.1" || got[1].String() != "2001:db8::2" {
+		t.Fatalf("LookupNetIP() = %v, want IPv4 first", got)
+	}
+	if n := atomic.LoadInt32(queries); n != 0 {
+		t.Fatalf("pinned host was looked up %d times", n)
+	}
+	if err := r.Pin("doh.example", []string{"not-an-ip"}); err == nil {
+		t.Fatalf("expected an error for an invalid address")
+	}
+}
+
+func TestDialFallsBackAcrossAddresses(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		if conn, err := ln.Accept(); err == nil {
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	r := New(nil, time.Second)
+	// Nothing listens on 127.0.0.2, so the first address is refused.
+	if err := r.Pin("doh.example", []string{"127.0.0.2", "127.0.0.1"}); err != nil {
+		t.Fatalf("Pin() error = %v", err)
+	}
+	conn, err := r.DialContext(context.Background(), "tcp", net.JoinHostPort("doh.example", port))
+	if err != nil {
+		t.Fatalf("DialContext() error = %v", err)
+	}
+	defer conn.Close()
+	if got := conn.RemoteAddr().(*net.TCPAddr).IP.String(); got != "127.0.0.1" {
+		t.Fatalf("connected to %s, want 127.0.0.1", got)
+	}
+
+	if _, err := r.DialContext(context.Background(), "tcp6", net.JoinHostPort("doh.example", port)); err == nil {
+		t.Fatalf("expected an error when no address matches the network")
+	}
+}
@@ -0,0 +1,335 @@
+package dnscrypt
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/crypto/curve25519"
+)
+
+var (
+	certMagic     = []byte("DNSC")
+	resolverMagic = []byte{0x72, 0x36, 0x66, 0x6e, 0x76, 0x57, 0x6a, 0x38}
+)
+
+const (
+	// certRefreshInterval bounds how long a certificate is used before the
+	// provider is asked again, so rotated certificates are picked up early.
+	certRefreshInterval = 4 * time.Hour
+	// certRefreshMargin is how long before expiry a certificate is replaced.
+	certRefreshMargin = time.Hour
+	// maxResponseSize bounds the buffer used to read encrypted responses.
+	maxResponseSize = 65535
+)
+
+// Client forwards DNS queries using the DNSCrypt v2 protocol.
+type Client struct {
+	// Addr is the resolver address (ip:port).
+	Addr string
+	// ProviderName is the certificate provider, e.g. 2.dnscrypt-cert.example.com.
+	ProviderName string
+	// ProviderKey verifies the resolver certificates.
+	ProviderKey ed25519.PublicKey
+	Timeout     time.Duration
+
+	endpoint string
+	now      func() time.Time
+
+	mu   sync.Mutex
+	cert *cert
+}
+
+// cert is a verified resolver certificate together with the client key pair
+// used for it.
+type cert struct {
+	es          uint16
+	serial      uint32
+	clientMagic [8]byte
+	resolverPK  [32]byte
+	notAfter    time.Time
+	refreshAt   time.Time
+	publicKey   [32]byte
+	sharedKey   [32]byte
+}
+
+// New creates a DNSCrypt client. endpoint is reported by String.
+func New(addr, providerName string, providerKey ed25519.PublicKey, timeout time.Duration, endpoint string) *Client {
+	if timeout == 0 {
+		timeout = 5 * time.Second
+	}
+	return &Client{
+		Addr:         addr,
+		ProviderName: dns.Fqdn(providerName),
+		ProviderKey:  providerKey,
+		Timeout:      timeout,
+		endpoint:     endpoint,
+		now:          time.Now,
+	}
+}
+
+// Query encrypts msg with the current resolver certificate and sends it over
+// UDP, retrying over TCP when the answer is truncated.
+func (c *Client) Query(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+
+	cert, err := c.currentCert(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.exchange(ctx, cert, msg, "udp")
+	if err != nil {
+		return nil, err
+	}
+	if resp.Truncated {
+		resp, err = c.exchange(ctx, cert, msg, "tcp")
+		if err != nil {
+			return nil, err
+		}
+	}
+	resp.Id = msg.Id
+	return resp, nil
+}
+
+// String returns the endpoint the client was built from.
+func (c *Client) String() string {
+	return c.endpoint
+}
+
+// Close is a no-op; every query uses its own socket.
+func (c *Client) Close() error {
+	return nil
+}
+
+// currentCert returns a valid certificate, fetching a new one when the
+// current one is due for rotation. A still-valid certificate is kept if the
+// refresh fails.
+func (c *Client) currentCert(ctx context.Context) (*cert, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	if c.cert != nil && now.Before(c.cert.refreshAt) {
+		return c.cert, nil
+	}
+
+	fresh, err := c.fetchCert(ctx)
+	if err != nil {
+		if c.cert != nil && now.Before(c.cert.notAfter) {
+			return c.cert, nil
+		}
+		return nil, err
+	}
+	c.cert = fresh
+	return fresh, nil
+}
+
+// fetchCert asks the resolver for its certificates and returns the newest one
+// that is correctly signed and currently valid.
+func (c *Client) fetchCert(ctx context.Context) (*cert, error) {
+	q := new(dns.Msg)
+	q.SetQuestion(c.ProviderName, dns.TypeTXT)
+	q.SetEdns0(4096, false)
+
+	client := &dns.Client{Net: "udp", Timeout: c.Timeout}
+	resp, _, err := client.ExchangeContext(ctx, q, c.Addr)
+	if err == nil && resp.Truncated {
+		client.Net = "tcp"
+		resp, _, err = client.ExchangeContext(ctx, q, c.Addr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("fetch dnscrypt certificate from %s: %w", c.Addr, err)
+	}
+
+	now := c.now()
+	var (
+		best    *cert
+		lastErr = fmt.Errorf("no dnscrypt certificate for %s", c.ProviderName)
+	)
+	for _, rr := range resp.Answer {
+		txt, ok := rr.(*dns.TXT)
+		if !ok {
+			continue
+		}
+		crt, err := parseCert(unescapeTXT(strings.Join(txt.Txt, "")), c.ProviderKey, now)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if best == nil || crt.serial > best.serial || (crt.serial == best.serial && crt.es > best.es) {
+			best = crt
+		}
+	}
+	if best == nil {
+		return nil, lastErr
+	}
+
+	// A fresh client key pair for every certificate.
+	var secret [32]byte
+	if _, err := rand.Read(secret[:]); err != nil {
+		return nil, err
+	}
+	pub, err := curve25519.X25519(secret[:], curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	copy(best.publicKey[:], pub)
+	best.sharedKey, err = sharedKey(best.es, &secret, &best.resolverPK)
+	if err != nil {
+		return nil, err
+	}
+
+	best.refreshAt = now.Add(certRefreshInterval)
+	if limit := best.notAfter.Add(-certRefreshMargin); limit.Before(best.refreshAt) {
+		best.refreshAt = limit
+	}
+	return best, nil
+}
+
+func parseCert(b []byte, providerKey ed25519.PublicKey, now time.Time) (*cert, error) {
+	if len(b) < 124 || !bytes.Equal(b[:4], certMagic) {
+		return nil, errors.New("malformed dnscrypt certificate")
+	}
+	es := binary.BigEndian.Uint16(b[4:6])
+	if es != XSalsa20Poly1305 && es != XChaCha20Poly1305 {
+		return nil, fmt.Errorf("unsupported dnscrypt encryption system %d", es)
+	}
+	if !ed25519.Verify(providerKey, b[72:], b[8:72]) {
+		return nil, errors.New("dnscrypt certificate signature is invalid")
+	}
+
+	crt := &cert{es: es}
+	copy(crt.resolverPK[:], b[72:104])
+	copy(crt.clientMagic[:], b[104:112])
+	crt.serial = binary.BigEndian.Uint32(b[112:116])
+	notBefore := time.Unix(int64(binary.BigEndian.Uint32(b[116:120])), 0)
+	crt.notAfter = time.Unix(int64(binary.BigEndian.Uint32(b[120:124])), 0)
+	if now.Before(notBefore) || !now.Before(crt.notAfter) {
+		return nil, errors.New("dnscrypt certificate is not currently valid")
+	}
+	return crt, nil
+}
+
+func (c *Client) exchange(ctx context.Context, crt *cert, msg *dns.Msg, network string) (*dns.Msg, error) {
+	wire, err := msg.Pack()
+	if err != nil {
+		return nil, fmt.Errorf("pack dns msg: %w", err)
+	}
+
+	var nonce [nonceSize]byte
+	if _, err := rand.Read(nonce[:halfNonceSize]); err != nil {
+		return nil, err
+	}
+	minSize := minQuerySize
+	if network == "tcp" {
+		minSize = 0
+	}
+	packet := make([]byte, 0, 8+32+halfNonceSize+tagSize+len(wire)+64)
+	packet = append(packet, crt.clientMagic[:]...)
+	packet = append(packet, crt.publicKey[:]...)
+	packet = append(packet, nonce[:halfNonceSize]...)
+	packet = append(packet, seal(crt.es, &crt.sharedKey, &nonce, pad(wire, minSize))...)
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, c.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("dial dnscrypt %s: %w", c.Addr, err)
+	}
+	defer conn.Close()
+	if dl, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(dl)
+	}
+
+	var reply []byte
+	if network == "tcp" {
+		frame := binary.BigEndian.AppendUint16(nil, uint16(len(packet)))
+		if _, err := conn.Write(append(frame, packet...)); err != nil {
+			return nil, fmt.Errorf("write dnscrypt query: %w", err)
+		}
+		var hdr [2]byte
+		if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+			return nil, fmt.Errorf("read dnscrypt response: %w", err)
+		}
+		reply = make([]byte, binary.BigEndian.Uint16(hdr[:]))
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return nil, fmt.Errorf("read dnscrypt response: %w", err)
+		}
+	} else {
+		if _, err := conn.Write(packet); err != nil {
+			return nil, fmt.Errorf("write dnscrypt query: %w", err)
+		}
+		buf := make([]byte, maxResponseSize)
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, fmt.Errorf("read dnscrypt response: %w", err)
+		}
+		reply = buf[:n]
+	}
+
+	return decryptResponse(crt, &nonce, reply)
+}
+
+func decryptResponse(crt *cert, queryNonce *[nonceSize]byte, reply []byte) (*dns.Msg, error) {
+	if len(reply) < len(resolverMagic)+nonceSize+tagSize || !bytes.Equal(reply[:len(resolverMagic)], resolverMagic) {
+		return nil, errors.New("malformed dnscrypt response")
+	}
+	var nonce [nonceSize]byte
+	copy(nonce[:], reply[len(resolverMagic):])
+	if !bytes.Equal(nonce[:halfNonceSize], queryNonce[:halfNonceSize]) {
+		return nil, errors.New("dnscrypt response nonce does not match the query")
+	}
+
+	plain, err := open(crt.es, &crt.sharedKey, &nonce, reply[len(resolverMagic)+nonceSize:])
+	if err != nil {
+		return nil, err
+	}
+	plain, err = unpad(plain)
+	if err != nil {
+		return nil, err
+	}
+
+	var out dns.Msg
+	if err := out.Unpack(plain); err != nil {
+		return nil, fmt.Errorf("unpack dnscrypt response: %w", err)
+	}
+	return &out, nil
+}
+
+// unescapeTXT turns the presentation form miekg/dns uses for TXT data
+// (\DDD and \X escapes) back into raw bytes.
+func unescapeTXT(s string) []byte {
+	out := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 >= len(s) {
+			out = append(out, s[i])
+			continue
+		}
+		if i+3 < len(s) && isDigit(s[i+1]) && isDigit(s[i+2]) && isDigit(s[i+3]) {
+			out = append(out, (s[i+1]-'0')*100+(s[i+2]-'0')*10+(s[i+3]-'0'))
+			i += 3
+			continue
+		}
+		out = append(out, s[i+1])
+		i++
+	}
+	return out
+}
+
+func isDigit(b byte) bool {
+	return b >= '0' && b <= '9'
+}
@@ -0,0 +1,236 @@
+package dnscrypt
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/crypto/curve25519"
+)
+
+const providerName = "2.dnscrypt-cert.test."
+
+// resolver is a minimal in-process DNSCrypt server on UDP. It answers the
+// certificate TXT query in the clear and A queries with 192.0.2.1.
+type resolver struct {
+	conn        net.PacketConn
+	providerKey ed25519.PrivateKey
+
+	mu          sync.Mutex
+	es          uint16
+	serial      uint32
+	secret      [32]byte
+	clientMagic [8]byte
+	notAfter    time.Time
+	certQueries int
+}
+
+func startResolver(t *testing.T, es uint16) *resolver {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	r := &resolver{conn: conn, providerKey: priv}
+	r.rotate(es, 1, time.Now().Add(24*time.Hour))
+	go r.serve()
+	t.Cleanup(func() { _ = conn.Close() })
+	return r
+}
+
+// rotate installs a new resolver key pair and certificate.
+func (r *resolver) rotate(es uint16, serial uint32, notAfter time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.es = es
+	r.serial = serial
+	r.notAfter = notAfter
+	_, _ = rand.Read(r.secret[:])
+	_, _ = rand.Read(r.clientMagic[:])
+}
+
+func (r *resolver) cert(signer ed25519.PrivateKey) []byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	pk, _ := curve25519.X25519(r.secret[:], curve25519.Basepoint)
+
+	signed := append([]byte(nil), pk...)
+	signed = append(signed, r.clientMagic[:]...)
+	signed = binary.BigEndian.AppendUint32(signed, r.serial)
+	signed = binary.BigEndian.AppendUint32(signed, uint32(time.Now().Add(-time.Hour).Unix()))
+	signed = binary.BigEndian.AppendUint32(signed, uint32(r.notAfter.Unix()))
+
+	out := append([]byte(nil), certMagic...)
+	out = binary.BigEndian.AppendUint16(out, r.es)
+	out = append(out, 0, 0)
+	out = append(out, ed25519.Sign(signer, signed)...)
+	return append(out, signed...)
+}
+
+func (r *resolver) serve() {
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := r.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		pkt := append([]byte(nil), buf[:n]...)
+		if out := r.handle(pkt); out != nil {
+			_, _ = r.conn.WriteTo(out, addr)
+		}
+	}
+}
+
+func (r *resolver) handle(pkt []byte) []byte {
+	r.mu.Lock()
+	es, magic, secret := r.es, r.clientMagic, r.secret
+	r.mu.Unlock()
+
+	if !bytes.HasPrefix(pkt, magic[:]) {
+		var req dns.Msg
+		if err := req.Unpack(pkt); err != nil || len(req.Question) == 0 {
+			return nil
+		}
+		r.mu.Lock()
+		r.certQueries++
+		r.mu.Unlock()
+		resp := new(dns.Msg)
+		resp.SetReply(&req)
+		resp.Answer = append(resp.Answer, &dns.TXT{
+			Hdr: dns.RR_Header{Name: providerName, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60},
+			Txt: []string{escapeTXT(r.cert(r.providerKey))},
+		})
+		out, _ := resp.Pack()
+		return out
+	}
+
+	if len(pkt) < 8+32+halfNonceSize+tagSize {
+		return nil
+	}
+	var clientPK [32]byte
+	copy(clientPK[:], pkt[8:40])
+	var nonce [nonceSize]byte
+	copy(nonce[:], pkt[40:40+halfNonceSize])
+	key, err := sharedKey(es, &secret, &clientPK)
+	if err != nil {
+		return nil
+	}
+	plain, err := open(es, &key, &nonce, pkt[40+halfNonceSize:])
+	if err != nil {
+		return nil
+	}
+	if len(plain) < minQuerySize {
+		return nil
+	}
+	plain, err = unpad(plain)
+	if err != nil {
+		return nil
+	}
+	var req dns.Msg
+	if err := req.Unpack(plain); err != nil {
+		return nil
+	}
+	resp := new(dns.Msg)
+	resp.SetReply(&req)
+	resp.Answer = append(resp.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		A:   net.ParseIP("192.0.2.1"),
+	})
+	wire, _ := resp.Pack()
+
+	_, _ = rand.Read(nonce[halfNonceSize:])
+	out := append([]byte(nil), resolverMagic...)
+	out = append(out, nonce[:]...)
+	return append(out, seal(es, &key, &nonce, pad(wire, 0))...)
+}
+
+func escapeTXT(b []byte) string {
+	var sb strings.Builder
+	for _, c := range b {
+		fmt.Fprintf(&sb, "\\%03d", c)
+	}
+	return sb.String()
+}
+
+func newTestClient(r *resolver) *Client {
+	pub := r.providerKey.Public().(ed25519.PublicKey)
+	return New(r.conn.LocalAddr().String(), providerName, pub, time.Second, "sdns://test")
+}
+
+func query() *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeA)
+	return m
+}
+
+func TestQueryEncryptionSystems(t *testing.T) {
+	for _, es := range []uint16{XSalsa20Poly1305, XChaCha20Poly1305} {
+		t.Run(fmt.Sprintf("es%d", es), func(t *testing.T) {
+			r := startResolver(t, es)
+			c := newTestClient(r)
+
+			req := query()
+			resp, err := c.Query(context.Background(), req)
+			if err != nil {
+				t.Fatalf("Query() error = %v", err)
+			}
+			if resp.Id != req.Id || len(resp.Answer) != 1 {
+				t.Fatalf("unexpected response %v", resp)
+			}
+		})
+	}
+}
+
+func TestQueryRejectsUnsignedCertificate(t *testing.T) {
+	r := startResolver(t, XSalsa20Poly1305)
+	other, _, _ := ed25519.GenerateKey(rand.Reader)
+	c := New(r.conn.LocalAddr().String(), providerName, other, time.Second, "sdns://test")
+
+	if _, err := c.Query(context.Background(), query()); err == nil || !strings.Contains(err.Error(), "signature") {
+		t.Fatalf("expected a signature error, got %v", err)
+	}
+}
+
+func TestCertificateRotation(t *testing.T) {
+	r := startResolver(t, XSalsa20Poly1305)
+	c := newTestClient(r)
+	now := time.Now()
+	c.now = func() time.Time { return now }
+
+	if _, err := c.Query(context.Background(), query()); err != nil {
+		t.Fatalf("first query: %v", err)
+	}
+
+	// The resolver rotates its key; once the refresh interval passes the
+	// client must pick up the new certificate.
+	r.rotate(XChaCha20Poly1305, 2, time.Now().Add(24*time.Hour))
+	now = now.Add(certRefreshInterval + time.Minute)
+	if _, err := c.Query(context.Background(), query()); err != nil {
+		t.Fatalf("query after rotation: %v", err)
+	}
+	c.mu.Lock()
+	serial, es := c.cert.serial, c.cert.es
+	c.mu.Unlock()
+	if serial != 2 || es != XChaCha20Poly1305 {
+		t.Fatalf("expected serial 2 with xchacha20, got serial %d es %d", serial, es)
+	}
+	r.mu.Lock()
+	fetches := r.certQueries
+	r.mu.Unlock()
+	if fetches != 2 {
+		t.Fatalf("expected two certificate fetches, got %d", fetches)
+	}
+}
@@ -0,0 +1,128 @@
+package dnscrypt
+
+import (
+	"crypto/subtle"
+	"errors"
+
+	"golang.org/x/crypto/chacha20"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/nacl/box"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/poly1305"
+)
+
+// Encryption systems advertised in resolver certificates.
+const (
+	XSalsa20Poly1305  uint16 = 0x0001
+	XChaCha20Poly1305 uint16 = 0x0002
+)
+
+const (
+	nonceSize     = 24
+	halfNonceSize = nonceSize / 2
+	tagSize       = poly1305.TagSize
+	// minQuerySize is the padded length below which queries are not sent, so
+	// responses can never be larger than the questions that caused them.
+	minQuerySize = 256
+)
+
+var errOpen = errors.New("dnscrypt: message authentication failed")
+
+// sharedKey derives the symmetric key for the given encryption system.
+func sharedKey(es uint16, secret, peer *[32]byte) ([32]byte, error) {
+	var key [32]byte
+	switch es {
+	case XSalsa20Poly1305:
+		box.Precompute(&key, peer, secret)
+		return key, nil
+	case XChaCha20Poly1305:
+		dh, err := curve25519.X25519(secret[:], peer[:])
+		if err != nil {
+			return key, err
+		}
+		var zero [16]byte
+		sub, err := chacha20.HChaCha20(dh, zero[:])
+		if err != nil {
+			return key, err
+		}
+		copy(key[:], sub)
+		return key, nil
+	default:
+		return key, errors.New("dnscrypt: unsupported encryption system")
+	}
+}
+
+// seal encrypts msg; the 16-byte Poly1305 tag precedes the ciphertext as in
+// NaCl's secretbox.
+func seal(es uint16, key *[32]byte, nonce *[nonceSize]byte, msg []byte) []byte {
+	if es == XSalsa20Poly1305 {
+		return secretbox.Seal(nil, msg, nonce, key)
+	}
+
+	polyKey, stream := xchachaStream(key, nonce)
+	out := make([]byte, tagSize+len(msg))
+	stream.XORKeyStream(out[tagSize:], msg)
+	var tag [tagSize]byte
+	poly1305.Sum(&tag, out[tagSize:], &polyKey)
+	copy(out, tag[:])
+	return out
+}
+
+func open(es uint16, key *[32]byte, nonce *[nonceSize]byte, sealed []byte) ([]byte, error) {
+	if es == XSalsa20Poly1305 {
+		out, ok := secretbox.Open(nil, sealed, nonce, key)
+		if !ok {
+			return nil, errOpen
+		}
+		return out, nil
+	}
+
+	if len(sealed) < tagSize {
+		return nil, errOpen
+	}
+	polyKey, stream := xchachaStream(key, nonce)
+	var tag [tagSize]byte
+	poly1305.Sum(&tag, sealed[tagSize:], &polyKey)
+	if subtle.ConstantTimeCompare(tag[:], sealed[:tagSize]) != 1 {
+		return nil, errOpen
+	}
+	out := make([]byte, len(sealed)-tagSize)
+	stream.XORKeyStream(out, sealed[tagSize:])
+	return out, nil
+}
+
+// xchachaStream returns the one-time Poly1305 key (the first 32 bytes of the
+// keystream) and the cipher positioned right after it, mirroring secretbox.
+func xchachaStream(key *[32]byte, nonce *[nonceSize]byte) ([32]byte, *chacha20.Cipher) {
+	stream, _ := chacha20.NewUnauthenticatedCipher(key[:], nonce[:])
+	var polyKey [32]byte
+	stream.XORKeyStream(polyKey[:], polyKey[:])
+	return polyKey, stream
+}
+
+// pad applies ISO/IEC 7816-4 padding up to a multiple of 64 bytes, with at
+// least min bytes in total.
+func pad(msg []byte, min int) []byte {
+	n := len(msg) + 1
+	if n < min {
+		n = min
+	}
+	n = (n + 63) &^ 63
+	out := make([]byte, n)
+	copy(out, msg)
+	out[len(msg)] = 0x80
+	return out
+}
+
+func unpad(msg []byte) ([]byte, error) {
+	for i := len(msg) - 1; i >= 0; i-- {
+		switch msg[i] {
+		case 0x00:
+			continue
+		case 0x80:
+			return msg[:i], nil
+		}
+		break
+	}
+	return nil, errors.New("dnscrypt: invalid padding")
+}
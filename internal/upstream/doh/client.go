@@ -3,77 +3,131 @@ package doh
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
+	"encoding/base64"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"net/url"
+	"strings"
 	"time"
 
+	"github.com/ogpourya/dnsbro/internal/upstream"
+	"github.com/ogpourya/dnsbro/internal/upstream/bootstrap"
+	"github.com/ogpourya/dnsbro/internal/upstream/proxy"
+
 	"github.com/miekg/dns"
+	"golang.org/x/net/http2"
 )
 
+func init() {
+	upstream.Register("https", newUpstream)
+	// Plain HTTP is only useful behind a local TLS-terminating proxy.
+	upstream.Register("http", newUpstream)
+}
+
+func newUpstream(u *url.URL, opts upstream.Options) (upstream.Upstream, error) {
+	if u.Host == "" {
+		return nil, fmt.Errorf("doh endpoint %q has no host", u)
+	}
+	resolver := bootstrap.New(opts.Bootstrap, opts.Timeout)
+	if err := resolver.Pin(u.Hostname(), opts.BootstrapIPs); err != nil {
+		return nil, fmt.Errorf("doh endpoint %q: %w", u, err)
+	}
+	var dialer Dialer = resolver
+	if opts.Proxy != "" {
+		p, err := proxy.New(opts.Proxy, resolver, opts.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("doh endpoint %q: %w", u, err)
+		}
+		dialer = p
+	}
+	c := New(u.String(), opts.Timeout, dialer)
+	if err := opts.TLS.Apply(c.Client.Transport.(*http.Transport).TLSClientConfig); err != nil {
+		return nil, fmt.Errorf("doh endpoint %q: %w", u, err)
+	}
+	switch strings.ToLower(opts.Method) {
+	case "", "post":
+	case "get":
+		c.Method = http.MethodGet
+	default:
+		return nil, fmt.Errorf("unsupported doh method %q", opts.Method)
+	}
+	return c, nil
+}
+
 // Client forwards DNS queries over HTTPS (DoH).
 type Client struct {
 	Endpoint string
-	Client   *http.Client
+	// Method is http.MethodPost (default) or http.MethodGet (RFC 8484 section 4.1).
+	Method string
+	Client *http.Client
+	// Timeout bounds queries whose context has no deadline.
+	Timeout time.Duration
 }
 
-// New creates a DoH client with sane defaults.
-func New(endpoint string, timeout time.Duration, bootstrap []string) *Client {
+// Dialer opens the connections that DoH requests are sent over, e.g. a
+// *bootstrap.Resolver or a *proxy.Dialer.
+type Dialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// New creates a DoH client with sane defaults. A nil dialer connects
+// directly, resolving hostnames via the default bootstrap servers.
+func New(endpoint string, timeout time.Duration, dialer Dialer) *Client {
 	if timeout == 0 {
 		timeout = 5 * time.Second
 	}
+	return &Client{
+		Endpoint: endpoint,
+		Method:   http.MethodPost,
+		Client:   NewHTTPClient(timeout, dialer),
+		Timeout:  timeout,
+	}
+}
 
-	bootstrap = normalizeBootstrapServers(bootstrap)
-	resolver := &net.Resolver{
-		PreferGo: true,
-		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
-			var lastErr error
-			for _, addr := range bootstrap {
-				d := net.Dialer{Timeout: timeout}
-				conn, err := d.DialContext(ctx, network, addr)
-				if err == nil {
-					return conn, nil
-				}
-				lastErr = err
-			}
-			if lastErr == nil {
-				lastErr = fmt.Errorf("no bootstrap DNS servers available")
-			}
-			return nil, lastErr
-		},
+// NewHTTPClient returns the HTTP/2-capable client used for DoH requests.
+// Connections are opened by dialer (direct via the default bootstrap servers
+// when nil) and timeout bounds the connection setup. The client sets no
+// overall timeout: each request is limited by its context, so callers
+// control per-attempt deadlines.
+func NewHTTPClient(timeout time.Duration, dialer Dialer) *http.Client {
+	if timeout == 0 {
+		timeout = 5 * time.Second
+	}
+	if dialer == nil {
+		dialer = bootstrap.New(nil, timeout)
 	}
 
 	tr := &http.Transport{
-		DialContext: (&net.Dialer{
-			Timeout:   timeout,
-			KeepAlive: timeout,
-			Resolver:  resolver,
-		}).DialContext,
+		DialContext:         dialer.DialContext,
+		TLSClientConfig:     &tls.Config{MinVersion: tls.VersionTLS12},
 		TLSHandshakeTimeout: timeout,
+		IdleConnTimeout:     90 * time.Second,
 	}
-	return &Client{
-		Endpoint: endpoint,
-		Client: &http.Client{
-			Transport: tr,
-			Timeout:   timeout,
-		},
+	// Negotiate HTTP/2 so concurrent queries share one TLS connection as
+	// multiplexed streams. A custom DialContext disables the stdlib's
+	// automatic upgrade, hence the explicit configuration.
+	if h2, err := http2.ConfigureTransports(tr); err == nil {
+		h2.ReadIdleTimeout = 30 * time.Second
+		h2.PingTimeout = timeout
 	}
+	return &http.Client{Transport: tr}
 }
 
-// Query performs a DoH POST request and returns the DNS response message.
+// Query performs a DoH request and returns the DNS response message.
 func (c *Client) Query(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
-	wire, err := msg.Pack()
-	if err != nil {
-		return nil, fmt.Errorf("pack dns msg: %w", err)
+	if _, ok := ctx.Deadline(); !ok && c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
 	}
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.Endpoint, bytes.NewReader(wire))
+	req, err := c.newRequest(ctx, msg)
 	if err != nil {
-		return nil, fmt.Errorf("create doh request: %w", err)
+		return nil, err
 	}
-	req.Header.Set("Content-Type", "application/dns-message")
-	req.Header.Set("Accept", "application/dns-message")
 
 	resp, err := c.Client.Do(req)
 	if err != nil {
@@ -95,24 +149,57 @@ func (c *Client) Query(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
 	if err := out.Unpack(data); err != nil {
 		return nil, fmt.Errorf("unpack doh response: %w", err)
 	}
+	out.Id = msg.Id
 	return &out, nil
 }
 
-func normalizeBootstrapServers(servers []string) []string {
-	if len(servers) == 0 {
-		return []string{"1.1.1.1:53", "8.8.8.8:53"}
+// newRequest builds the HTTP request for msg. GET requests carry the query
+// base64url-encoded in the dns parameter with the ID zeroed, so identical
+// questions map to identical, cacheable URLs.
+func (c *Client) newRequest(ctx context.Context, msg *dns.Msg) (*http.Request, error) {
+	if c.Method != http.MethodGet {
+		wire, err := msg.Pack()
+		if err != nil {
+			return nil, fmt.Errorf("pack dns msg: %w", err)
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.Endpoint, bytes.NewReader(wire))
+		if err != nil {
+			return nil, fmt.Errorf("create doh request: %w", err)
+		}
+		req.Header.Set("Content-Type", "application/dns-message")
+		req.Header.Set("Accept", "application/dns-message")
+		return req, nil
 	}
 
-	out := make([]string, 0, len(servers))
-	for _, s := range servers {
-		host, port, err := net.SplitHostPort(s)
-		if err != nil || port == "" {
-			s = net.JoinHostPort(s, "53")
-		} else {
-			s = net.JoinHostPort(host, port)
-		}
-		out = append(out, s)
+	q := msg.Copy()
+	q.Id = 0
+	wire, err := q.Pack()
+	if err != nil {
+		return nil, fmt.Errorf("pack dns msg: %w", err)
 	}
+	u, err := url.Parse(c.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("parse doh endpoint: %w", err)
+	}
+	params := u.Query()
+	params.Set("dns", base64.RawURLEncoding.EncodeToString(wire))
+	u.RawQuery = params.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("create doh request: %w", err)
+	}
+	req.Header.Set("Accept", "application/dns-message")
+	return req, nil
+}
+
+// String returns the endpoint URL.
+func (c *Client) String() string {
+	return c.Endpoint
+}
 
-	return out
+// Close drops idle connections to the endpoint.
+func (c *Client) Close() error {
+	c.Client.CloseIdleConnections()
+	return nil
 }
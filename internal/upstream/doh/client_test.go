@@ -0,0 +1,174 @@
+package doh
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ogpourya/dnsbro/internal/upstream"
+
+	"github.com/miekg/dns"
+)
+
+type seenRequest struct {
+	method string
+	proto  int
+	id     uint16
+}
+
+// startServer runs an HTTP/2-capable DoH server over TLS that records how it
+// was queried.
+func startServer(t *testing.T) (*httptest.Server, func() []seenRequest) {
+	t.Helper()
+
+	var (
+		mu   sync.Mutex
+		seen []seenRequest
+	)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var wire []byte
+		var err error
+		if r.Method == http.MethodGet {
+			wire, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		} else {
+			wire, err = io.ReadAll(r.Body)
+		}
+		var req dns.Msg
+		if err == nil {
+			err = req.Unpack(wire)
+		}
+		if err != nil {
+			http.Error(w, "bad query", http.StatusBadRequest)
+			return
+		}
+
+		mu.Lock()
+		seen = append(seen, seenRequest{method: r.Method, proto: r.ProtoMajor, id: req.Id})
+		mu.Unlock()
+
+		resp := new(dns.Msg)
+		resp.SetReply(&req)
+		resp.Answer = append(resp.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.ParseIP("192.0.2.1"),
+		})
+		out, _ := resp.Pack()
+		w.Header().Set("Content-Type", "application/dns-message")
+		_, _ = w.Write(out)
+	}))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+
+	return srv, func() []seenRequest {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]seenRequest(nil), seen...)
+	}
+}
+
+func newTestClient(t *testing.T, srv *httptest.Server) *Client {
+	t.Helper()
+	c := New(srv.URL+"/dns-query", time.Second, nil)
+	tr := c.Client.Transport.(*http.Transport)
+	tr.TLSClientConfig.RootCAs = srv.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+	return c
+}
+
+func query() *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeA)
+	return m
+}
+
+func TestQueryUsesHTTP2(t *testing.T) {
+	srv, seen := startServer(t)
+	c := newTestClient(t, srv)
+
+	req := query()
+	resp, err := c.Query(context.Background(), req)
+	if err != nil {
+		t.Fatalf("Query() error = %v", err)
+	}
+	if resp.Id != req.Id || len(resp.Answer) != 1 {
+		t.Fatalf("unexpected response %v", resp)
+	}
+	got := seen()
+	if len(got) != 1 || got[0].method != http.MethodPost || got[0].proto != 2 {
+		t.Fatalf("expected one HTTP/2 POST, got %+v", got)
+	}
+}
+
+func TestQueryGETZeroesID(t *testing.T) {
+	srv, seen := startServer(t)
+	c := newTestClient(t, srv)
+	c.Method = http.MethodGet
+
+	req := query()
+	req.Id = 4242
+	resp, err := c.Query(context.Background(), req)
+	if err != nil {
+		t.Fatalf("Query() error = %v", err)
+	}
+	if resp.Id != 4242 {
+		t.Fatalf("expected response id restored to 4242, got %d", resp.Id)
+	}
+	got := seen()
+	if len(got) != 1 || got[0].method != http.MethodGet || got[0].id != 0 {
+		t.Fatalf("expected one GET with id 0, got %+v", got)
+	}
+}
+
+func TestTLSOptions(t *testing.T) {
+	srv, _ := startServer(t)
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	if err := os.WriteFile(caFile, caPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse(srv.URL + "/dns-query")
+	pin := upstream.SPKIPin(srv.Certificate())
+	otherPin := base64.StdEncoding.EncodeToString(make([]byte, 32))
+
+	tests := []struct {
+		name    string
+		tls     upstream.TLSOptions
+		wantErr error
+	}{
+		{name: "custom ca", tls: upstream.TLSOptions{CAFile: caFile}},
+		{name: "server name override", tls: upstream.TLSOptions{CAFile: caFile, ServerName: "example.com", MinVersion: "1.3"}},
+		{name: "matching pin", tls: upstream.TLSOptions{CAFile: caFile, SPKIPins: []string{otherPin, pin}}},
+		{name: "pin mismatch", tls: upstream.TLSOptions{CAFile: caFile, SPKIPins: []string{otherPin}}, wantErr: upstream.ErrPinMismatch},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			up, err := newUpstream(u, upstream.Options{Timeout: time.Second, TLS: tt.tls})
+			if err != nil {
+				t.Fatalf("newUpstream() error = %v", err)
+			}
+			defer up.Close()
+			_, err = up.Query(context.Background(), query())
+			if tt.wantErr == nil && err != nil {
+				t.Fatalf("Query() error = %v", err)
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Query() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	if _, err := newUpstream(u, upstream.Options{TLS: upstream.TLSOptions{CertFile: caFile, KeyFile: caFile}}); err == nil {
+		t.Fatalf("expected an error for an unusable client key")
+	}
+}
@@ -0,0 +1,249 @@
+package doq
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/ogpourya/dnsbro/internal/upstream"
+	"github.com/ogpourya/dnsbro/internal/upstream/bootstrap"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+func init() {
+	upstream.Register("quic", newUpstream)
+}
+
+func newUpstream(u *url.URL, opts upstream.Options) (upstream.Upstream, error) {
+	if u.Host == "" {
+		return nil, fmt.Errorf("doq endpoint %q has no host", u)
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "853")
+	}
+	resolver := bootstrap.New(opts.Bootstrap, opts.Timeout)
+	if err := resolver.Pin(u.Hostname(), opts.BootstrapIPs); err != nil {
+		return nil, fmt.Errorf("doq endpoint %q: %w", u, err)
+	}
+	c := New(addr, opts.Timeout, resolver)
+	if err := opts.TLS.Apply(c.TLSConfig); err != nil {
+		return nil, fmt.Errorf("doq endpoint %q: %w", u, err)
+	}
+	c.endpoint = u.String()
+	return c, nil
+}
+
+// NextProto is the ALPN token for DNS over QUIC.
+const NextProto = "doq"
+
+// Client forwards DNS queries over QUIC (RFC 9250). Every query uses its own
+// stream on a shared connection; reconnects try 0-RTT session resumption.
+type Client struct {
+	Addr       string
+	TLSConfig  *tls.Config
+	QUICConfig *quic.Config
+	Timeout    time.Duration
+
+	endpoint string
+	resolver *bootstrap.Resolver
+
+	mu   sync.Mutex
+	tr   *quic.Transport
+	conn quic.EarlyConnection
+}
+
+// New creates a DoQ client for addr (host:port). Hostnames are resolved via
+// resolver (the default bootstrap servers when nil), and the host is used as
+// the TLS server name.
+func New(addr string, timeout time.Duration, resolver *bootstrap.Resolver) *Client {
+	if timeout == 0 {
+		timeout = 5 * time.Second
+	}
+	if resolver == nil {
+		resolver = bootstrap.New(nil, timeout)
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	return &Client{
+		Addr: addr,
+		TLSConfig: &tls.Config{
+			ServerName:         host,
+			NextProtos:         []string{NextProto},
+			MinVersion:         tls.VersionTLS13,
+			ClientSessionCache: tls.NewLRUClientSessionCache(0),
+		},
+		QUICConfig: &quic.Config{
+			HandshakeIdleTimeout: timeout,
+			MaxIdleTimeout:       30 * time.Second,
+		},
+		Timeout:  timeout,
+		endpoint: "quic://" + addr,
+		resolver: resolver,
+	}
+}
+
+// Query sends msg on a new stream, reconnecting once if the shared
+// connection has gone away.
+func (c *Client) Query(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+
+	for attempt := 0; ; attempt++ {
+		conn, reused, err := c.getConn(ctx)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := exchange(ctx, conn, msg)
+		if err == nil {
+			return resp, nil
+		}
+		if reused && attempt == 0 && ctx.Err() == nil && conn.Context().Err() != nil {
+			continue
+		}
+		return nil, err
+	}
+}
+
+// String returns the endpoint URL.
+func (c *Client) String() string {
+	return c.endpoint
+}
+
+// Close closes the connection and the underlying UDP socket.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn != nil {
+		_ = c.conn.CloseWithError(0, "")
+		c.conn = nil
+	}
+	if c.tr != nil {
+		err := c.tr.Close()
+		c.tr = nil
+		return err
+	}
+	return nil
+}
+
+func (c *Client) getConn(ctx context.Context) (quic.EarlyConnection, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conn != nil {
+		if c.conn.Context().Err() == nil {
+			return c.conn, true, nil
+		}
+		c.conn = nil
+	}
+
+	raddrs, err := c.resolve(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	if c.tr == nil {
+		udp, err := net.ListenUDP("udp", nil)
+		if err != nil {
+			return nil, false, fmt.Errorf("open udp socket: %w", err)
+		}
+		c.tr = &quic.Transport{Conn: udp}
+	}
+	// Fall back across the host's addresses, e.g. IPv6 when IPv4 is blocked.
+	for _, raddr := range raddrs {
+		var conn quic.EarlyConnection
+		conn, err = c.tr.DialEarly(ctx, raddr, c.TLSConfig, c.QUICConfig)
+		if err == nil {
+			c.conn = conn
+			return conn, false, nil
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, false, fmt.Errorf("dial doq %s: %w", c.Addr, err)
+}
+
+func (c *Client) resolve(ctx context.Context) ([]*net.UDPAddr, error) {
+	host, port, err := net.SplitHostPort(c.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("parse doq address %q: %w", c.Addr, err)
+	}
+	portNum, err := net.LookupPort("udp", port)
+	if err != nil {
+		return nil, fmt.Errorf("parse doq port %q: %w", port, err)
+	}
+	ips, err := c.resolver.LookupNetIP(ctx, host)
+	if err != nil {
+		return nil, fmt.Errorf("resolve doq host %s: %w", host, err)
+	}
+	out := make([]*net.UDPAddr, 0, len(ips))
+	for _, ip := range ips {
+		out = append(out, net.UDPAddrFromAddrPort(netip.AddrPortFrom(ip, uint16(portNum))))
+	}
+	return out, nil
+}
+
+// exchange sends msg on a fresh stream. DoQ requires a message ID of zero, so
+// the caller's ID is restored on the response.
+func exchange(ctx context.Context, conn quic.EarlyConnection, msg *dns.Msg) (*dns.Msg, error) {
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("open doq stream: %w", err)
+	}
+	defer stream.CancelRead(0)
+
+	if dl, ok := ctx.Deadline(); ok {
+		_ = stream.SetDeadline(dl)
+	}
+
+	q := msg.Copy()
+	q.Id = 0
+	wire, err := q.Pack()
+	if err != nil {
+		return nil, fmt.Errorf("pack dns msg: %w", err)
+	}
+	frame := make([]byte, 2+len(wire))
+	binary.BigEndian.PutUint16(frame, uint16(len(wire)))
+	copy(frame[2:], wire)
+	if _, err := stream.Write(frame); err != nil {
+		return nil, fmt.Errorf("write doq query: %w", err)
+	}
+	// Closing the send side tells the server the query is complete.
+	if err := stream.Close(); err != nil {
+		return nil, fmt.Errorf("close doq stream: %w", err)
+	}
+
+	var hdr [2]byte
+	if _, err := io.ReadFull(stream, hdr[:]); err != nil {
+		return nil, fmt.Errorf("read doq response: %w", err)
+	}
+	buf := make([]byte, binary.BigEndian.Uint16(hdr[:]))
+	if _, err := io.ReadFull(stream, buf); err != nil {
+		return nil, fmt.Errorf("read doq response: %w", err)
+	}
+
+	var out dns.Msg
+	if err := out.Unpack(buf); err != nil {
+		return nil, fmt.Errorf("unpack doq response: %w", err)
+	}
+	if out.Id != 0 {
+		return nil, errors.New("doq response has non-zero message id")
+	}
+	out.Id = msg.Id
+	return &out, nil
+}
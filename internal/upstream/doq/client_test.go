@@ -0,0 +1,158 @@
+package doq
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ogpourya/dnsbro/internal/upstream/testcert"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+// doqServer is a minimal in-process DoQ server answering A queries with 192.0.2.1.
+type doqServer struct {
+	ln        *quic.EarlyListener
+	conns     int32
+	nonZeroID int32
+}
+
+func startServer(t *testing.T, certs testcert.Bundle) *doqServer {
+	t.Helper()
+	ln, err := quic.ListenAddrEarly("127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{certs.Server},
+		NextProtos:   []string{NextProto},
+	}, &quic.Config{Allow0RTT: true})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	s := &doqServer{ln: ln}
+	go s.serve()
+	t.Cleanup(func() { _ = ln.Close() })
+	return s
+}
+
+func (s *doqServer) serve() {
+	for {
+		conn, err := s.ln.Accept(context.Background())
+		if err != nil {
+			return
+		}
+		atomic.AddInt32(&s.conns, 1)
+		go func() {
+			for {
+				stream, err := conn.AcceptStream(context.Background())
+				if err != nil {
+					return
+				}
+				go s.handle(stream)
+			}
+		}()
+	}
+}
+
+func (s *doqServer) handle(stream quic.Stream) {
+	defer stream.Close()
+	var hdr [2]byte
+	if _, err := io.ReadFull(stream, hdr[:]); err != nil {
+		return
+	}
+	buf := make([]byte, binary.BigEndian.Uint16(hdr[:]))
+	if _, err := io.ReadFull(stream, buf); err != nil {
+		return
+	}
+	var req dns.Msg
+	if err := req.Unpack(buf); err != nil {
+		return
+	}
+	if req.Id != 0 {
+		atomic.AddInt32(&s.nonZeroID, 1)
+	}
+	resp := new(dns.Msg)
+	resp.SetReply(&req)
+	resp.Answer = append(resp.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		A:   net.ParseIP("192.0.2.1"),
+	})
+	wire, _ := resp.Pack()
+	out := make([]byte, 2+len(wire))
+	binary.BigEndian.PutUint16(out, uint16(len(wire)))
+	copy(out[2:], wire)
+	_, _ = stream.Write(out)
+}
+
+func newTestClient(addr string, certs testcert.Bundle) *Client {
+	c := New(addr, 2*time.Second, nil)
+	c.TLSConfig.RootCAs = certs.Pool
+	return c
+}
+
+func query(name string) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(name), dns.TypeA)
+	return m
+}
+
+func TestQueryUsesStreamsOnSharedConnection(t *testing.T) {
+	certs := testcert.New(t, "dns.test")
+	srv := startServer(t, certs)
+	c := newTestClient(srv.ln.Addr().String(), certs)
+	defer c.Close()
+
+	for i := 0; i < 5; i++ {
+		req := query("example.com")
+		resp, err := c.Query(context.Background(), req)
+		if err != nil {
+			t.Fatalf("query %d: %v", i, err)
+		}
+		if resp.Id != req.Id || len(resp.Answer) != 1 {
+			t.Fatalf("query %d: unexpected response %v", i, resp)
+		}
+	}
+	if got := atomic.LoadInt32(&srv.conns); got != 1 {
+		t.Fatalf("expected one connection, got %d", got)
+	}
+	if got := atomic.LoadInt32(&srv.nonZeroID); got != 0 {
+		t.Fatalf("expected message id 0 on the wire, got %d non-zero", got)
+	}
+}
+
+func TestQueryReconnectsWithResumption(t *testing.T) {
+	certs := testcert.New(t, "dns.test")
+	srv := startServer(t, certs)
+	c := newTestClient(srv.ln.Addr().String(), certs)
+	defer c.Close()
+
+	if _, err := c.Query(context.Background(), query("example.com")); err != nil {
+		t.Fatalf("first query: %v", err)
+	}
+
+	// Drop the connection; the next query must redial and can resume the session.
+	c.mu.Lock()
+	_ = c.conn.CloseWithError(0, "")
+	c.mu.Unlock()
+
+	resp, err := c.Query(context.Background(), query("example.com"))
+	if err != nil {
+		t.Fatalf("query after reconnect: %v", err)
+	}
+	if len(resp.Answer) != 1 {
+		t.Fatalf("unexpected response %v", resp)
+	}
+	if got := atomic.LoadInt32(&srv.conns); got != 2 {
+		t.Fatalf("expected a second connection, got %d", got)
+	}
+
+	c.mu.Lock()
+	resumed := c.conn.ConnectionState().TLS.DidResume
+	c.mu.Unlock()
+	if !resumed {
+		t.Fatalf("expected the second connection to resume the TLS session")
+	}
+}
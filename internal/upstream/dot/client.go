@@ -0,0 +1,314 @@
+package dot
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/ogpourya/dnsbro/internal/upstream"
+	"github.com/ogpourya/dnsbro/internal/upstream/bootstrap"
+
+	"github.com/miekg/dns"
+)
+
+func init() {
+	upstream.Register("tls", newUpstream)
+}
+
+func newUpstream(u *url.URL, opts upstream.Options) (upstream.Upstream, error) {
+	if u.Host == "" {
+		return nil, fmt.Errorf("dot endpoint %q has no host", u)
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "853")
+	}
+	resolver := bootstrap.New(opts.Bootstrap, opts.Timeout)
+	if err := resolver.Pin(u.Hostname(), opts.BootstrapIPs); err != nil {
+		return nil, fmt.Errorf("dot endpoint %q: %w", u, err)
+	}
+	c := New(addr, opts.Timeout, resolver)
+	if err := opts.TLS.Apply(c.TLSConfig); err != nil {
+		return nil, fmt.Errorf("dot endpoint %q: %w", u, err)
+	}
+	c.endpoint = u.String()
+	return c, nil
+}
+
+// defaultIdleTimeout closes connections that have not carried a query for this
+// long; most DoT servers drop idle clients well before that.
+const defaultIdleTimeout = 30 * time.Second
+
+// errConnClosed is returned for queries that were waiting on a connection that went away.
+var errConnClosed = errors.New("dot connection closed")
+
+// Client forwards DNS queries over TLS (RFC 7858). Queries share a single
+// connection and are pipelined; responses are matched by message ID.
+type Client struct {
+	Addr        string
+	TLSConfig   *tls.Config
+	Timeout     time.Duration
+	IdleTimeout time.Duration
+
+	endpoint string
+	resolver *bootstrap.Resolver
+
+	mu   sync.Mutex
+	conn *pipeConn
+}
+
+// New creates a DoT client for addr (host:port). Hostnames are resolved via
+// resolver (the default bootstrap servers when nil), and the host is used as
+// the TLS server name.
+func New(addr string, timeout time.Duration, resolver *bootstrap.Resolver) *Client {
+	if timeout == 0 {
+		timeout = 5 * time.Second
+	}
+	if resolver == nil {
+		resolver = bootstrap.New(nil, timeout)
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	return &Client{
+		Addr: addr,
+		TLSConfig: &tls.Config{
+			ServerName:         host,
+			MinVersion:         tls.VersionTLS12,
+			ClientSessionCache: tls.NewLRUClientSessionCache(0),
+		},
+		Timeout:     timeout,
+		IdleTimeout: defaultIdleTimeout,
+		endpoint:    "tls://" + addr,
+		resolver:    resolver,
+	}
+}
+
+// Query sends msg over the shared connection, redialing once if a reused
+// connection turns out to be dead.
+func (c *Client) Query(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+
+	for attempt := 0; ; attempt++ {
+		pc, reused, err := c.getConn(ctx)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := pc.exchange(ctx, msg)
+		if err == nil {
+			return resp, nil
+		}
+		if reused && attempt == 0 && ctx.Err() == nil && pc.failed() {
+			continue
+		}
+		return nil, err
+	}
+}
+
+// String returns the endpoint URL.
+func (c *Client) String() string {
+	return c.endpoint
+}
+
+// Close tears down the shared connection.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	pc := c.conn
+	c.conn = nil
+	c.mu.Unlock()
+	if pc != nil {
+		pc.close(errConnClosed)
+	}
+	return nil
+}
+
+// getConn returns the live connection, dialing a new one when there is none
+// or the current one has been idle for too long.
+func (c *Client) getConn(ctx context.Context) (*pipeConn, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if pc := c.conn; pc != nil {
+		if !pc.failed() && !pc.idleFor(c.IdleTimeout) {
+			return pc, true, nil
+		}
+		pc.close(errConnClosed)
+		c.conn = nil
+	}
+
+	raw, err := c.resolver.DialContext(ctx, "tcp", c.Addr)
+	if err != nil {
+		return nil, false, fmt.Errorf("dial dot %s: %w", c.Addr, err)
+	}
+	tlsConn := tls.Client(raw, c.TLSConfig)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		raw.Close()
+		return nil, false, fmt.Errorf("dot handshake with %s: %w", c.Addr, err)
+	}
+
+	pc := newPipeConn(tlsConn)
+	c.conn = pc
+	return pc, false, nil
+}
+
+type result struct {
+	msg *dns.Msg
+	err error
+}
+
+// pipeConn multiplexes queries over one stream connection.
+type pipeConn struct {
+	conn net.Conn
+	wmu  sync.Mutex
+
+	mu       sync.Mutex
+	pending  map[uint16]chan result
+	nextID   uint16
+	lastUsed time.Time
+	err      error
+}
+
+func newPipeConn(conn net.Conn) *pipeConn {
+	pc := &pipeConn{
+		conn:     conn,
+		pending:  make(map[uint16]chan result),
+		nextID:   uint16(time.Now().UnixNano()),
+		lastUsed: time.Now(),
+	}
+	go pc.readLoop()
+	return pc
+}
+
+func (pc *pipeConn) exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	ch := make(chan result, 1)
+
+	pc.mu.Lock()
+	if pc.err != nil {
+		err := pc.err
+		pc.mu.Unlock()
+		return nil, err
+	}
+	id := pc.nextID
+	for {
+		if _, busy := pc.pending[id]; !busy {
+			break
+		}
+		id++
+	}
+	pc.nextID = id + 1
+	pc.pending[id] = ch
+	pc.lastUsed = time.Now()
+	pc.mu.Unlock()
+
+	defer func() {
+		pc.mu.Lock()
+		delete(pc.pending, id)
+		pc.mu.Unlock()
+	}()
+
+	q := msg.Copy()
+	q.Id = id
+	wire, err := q.Pack()
+	if err != nil {
+		return nil, fmt.Errorf("pack dns msg: %w", err)
+	}
+	frame := make([]byte, 2+len(wire))
+	binary.BigEndian.PutUint16(frame, uint16(len(wire)))
+	copy(frame[2:], wire)
+
+	pc.wmu.Lock()
+	if dl, ok := ctx.Deadline(); ok {
+		_ = pc.conn.SetWriteDeadline(dl)
+	}
+	_, err = pc.conn.Write(frame)
+	pc.wmu.Unlock()
+	if err != nil {
+		pc.close(err)
+		return nil, fmt.Errorf("write dot query: %w", err)
+	}
+
+	select {
+	case r := <-ch:
+		if r.err != nil {
+			return nil, r.err
+		}
+		r.msg.Id = msg.Id
+		return r.msg, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (pc *pipeConn) readLoop() {
+	var hdr [2]byte
+	for {
+		if _, err := io.ReadFull(pc.conn, hdr[:]); err != nil {
+			pc.close(err)
+			return
+		}
+		buf := make([]byte, binary.BigEndian.Uint16(hdr[:]))
+		if _, err := io.ReadFull(pc.conn, buf); err != nil {
+			pc.close(err)
+			return
+		}
+		var m dns.Msg
+		if err := m.Unpack(buf); err != nil {
+			pc.close(fmt.Errorf("unpack dot response: %w", err))
+			return
+		}
+
+		pc.mu.Lock()
+		ch, ok := pc.pending[m.Id]
+		delete(pc.pending, m.Id)
+		pc.lastUsed = time.Now()
+		pc.mu.Unlock()
+		if ok {
+			ch <- result{msg: &m}
+		}
+	}
+}
+
+// close fails every pending query with err and closes the connection.
+func (pc *pipeConn) close(err error) {
+	pc.mu.Lock()
+	if pc.err != nil {
+		pc.mu.Unlock()
+		return
+	}
+	if errors.Is(err, io.EOF) {
+		err = errConnClosed
+	}
+	pc.err = err
+	pending := pc.pending
+	pc.pending = make(map[uint16]chan result)
+	pc.mu.Unlock()
+
+	_ = pc.conn.Close()
+	for _, ch := range pending {
+		ch <- result{err: err}
+	}
+}
+
+func (pc *pipeConn) failed() bool {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	return pc.err != nil
+}
+
+func (pc *pipeConn) idleFor(d time.Duration) bool {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	return d > 0 && len(pc.pending) == 0 && time.Since(pc.lastUsed) > d
+}
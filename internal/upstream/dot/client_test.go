@@ -0,0 +1,140 @@
+package dot
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ogpourya/dnsbro/internal/upstream/testcert"
+
+	"github.com/miekg/dns"
+)
+
+// startServer runs a DoT server on loopback that answers A queries with
+// 192.0.2.1 and reports the number of accepted connections.
+func startServer(t *testing.T, certs testcert.Bundle, idle time.Duration) (string, *int32) {
+	t.Helper()
+
+	var conns int32
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{certs.Server}})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	srv := &dns.Server{
+		Listener: countingListener{Listener: ln, n: &conns},
+		Net:      "tcp-tls",
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			resp := new(dns.Msg)
+			resp.SetReply(r)
+			resp.Answer = append(resp.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   net.ParseIP("192.0.2.1"),
+			})
+			_ = w.WriteMsg(resp)
+		}),
+		IdleTimeout: func() time.Duration { return idle },
+	}
+	go func() { _ = srv.ActivateAndServe() }()
+	t.Cleanup(func() { _ = srv.Shutdown() })
+	return ln.Addr().String(), &conns
+}
+
+type countingListener struct {
+	net.Listener
+	n *int32
+}
+
+func (l countingListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err == nil {
+		atomic.AddInt32(l.n, 1)
+	}
+	return c, err
+}
+
+func newTestClient(addr string, certs testcert.Bundle) *Client {
+	c := New(addr, 2*time.Second, nil)
+	c.TLSConfig.RootCAs = certs.Pool
+	return c
+}
+
+func query(name string) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(name), dns.TypeA)
+	return m
+}
+
+func TestQueryPipelinesOnOneConnection(t *testing.T) {
+	certs := testcert.New(t, "dns.test")
+	addr, conns := startServer(t, certs, time.Minute)
+	c := newTestClient(addr, certs)
+	defer c.Close()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			req := query(fmt.Sprintf("host%d.example.com", i))
+			resp, err := c.Query(context.Background(), req)
+			if err != nil {
+				errs <- err
+				return
+			}
+			if resp.Id != req.Id || resp.Question[0].Name != req.Question[0].Name {
+				errs <- fmt.Errorf("mismatched response for %s: %v", req.Question[0].Name, resp)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	if got := atomic.LoadInt32(conns); got != 1 {
+		t.Fatalf("expected a single pipelined connection, got %d", got)
+	}
+}
+
+func TestQueryReconnectsAfterServerIdleClose(t *testing.T) {
+	certs := testcert.New(t, "dns.test")
+	addr, conns := startServer(t, certs, 50*time.Millisecond)
+	c := newTestClient(addr, certs)
+	defer c.Close()
+
+	if _, err := c.Query(context.Background(), query("example.com")); err != nil {
+		t.Fatalf("first query: %v", err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if _, err := c.Query(context.Background(), query("example.com")); err != nil {
+		t.Fatalf("query after idle close: %v", err)
+	}
+	if got := atomic.LoadInt32(conns); got != 2 {
+		t.Fatalf("expected a reconnect, got %d connections", got)
+	}
+}
+
+func TestServerNameOverride(t *testing.T) {
+	certs := testcert.New(t, "dns.test")
+	addr, _ := startServer(t, certs, time.Minute)
+
+	c := newTestClient(addr, certs)
+	c.TLSConfig.ServerName = "other.test"
+	if _, err := c.Query(context.Background(), query("example.com")); err == nil {
+		t.Fatalf("expected certificate name mismatch")
+	}
+	c.Close()
+
+	c = newTestClient(addr, certs)
+	c.TLSConfig.ServerName = "dns.test"
+	defer c.Close()
+	if _, err := c.Query(context.Background(), query("example.com")); err != nil {
+		t.Fatalf("query with server name override: %v", err)
+	}
+}
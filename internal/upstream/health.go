@@ -0,0 +1,176 @@
+package upstream
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// CircuitState is the health of an upstream as tracked by its circuit breaker.
+type CircuitState int
+
+const (
+	// CircuitClosed means the upstream is healthy and receives queries.
+	CircuitClosed CircuitState = iota
+	// CircuitOpen means the upstream failed repeatedly and is skipped.
+	CircuitOpen
+	// CircuitHalfOpen means the cooldown passed and queries test recovery:
+	// the next success closes the circuit, the next failure opens it again.
+	CircuitHalfOpen
+)
+
+func (c CircuitState) String() string {
+	switch c {
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// ErrNoHealthyUpstream is returned when every upstream's circuit is open.
+var ErrNoHealthyUpstream = errors.New("no healthy upstream: every circuit is open")
+
+// HealthOptions configures circuit breaking and background canary probes.
+type HealthOptions struct {
+	// Failures is the number of consecutive failures that opens a circuit.
+	// Zero disables circuit breaking.
+	Failures int
+	// Cooldown is how long a circuit stays open before it turns half-open.
+	Cooldown time.Duration
+	// Interval is the time between canary probes of every upstream. Zero
+	// disables probing. Each probe may take up to one interval.
+	Interval time.Duration
+	// Canary is the name queried (type NS) by probes; "." when empty.
+	Canary string
+	// OnChange, when set, is called after an upstream's circuit changes state.
+	OnChange func(name string, from, to CircuitState, failures int)
+	// OnHealth, when set, is called when the only upstream of a selector,
+	// whose circuit never opens, reaches Failures consecutive failures and
+	// again when it recovers.
+	OnHealth func(name string, healthy bool, failures int)
+}
+
+// breaker tracks consecutive failures of one upstream. It is guarded by the
+// owning member's mutex.
+type breaker struct {
+	state    CircuitState
+	failures int
+	openedAt time.Time
+	// down marks a lone upstream that reached the failure limit; its
+	// circuit stays closed since there is nothing else to query.
+	down bool
+}
+
+// allow reports whether the upstream may be queried at now, moving an open
+// circuit to half-open once the cooldown has passed.
+func (b *breaker) allow(opts *HealthOptions, now time.Time) (bool, CircuitState) {
+	from := b.state
+	if b.state == CircuitOpen && now.Sub(b.openedAt) >= opts.Cooldown {
+		b.state = CircuitHalfOpen
+	}
+	return b.state != CircuitOpen, from
+}
+
+// record updates the breaker with the outcome of a query or probe. The
+// circuit of a lone upstream is only marked down instead of opened.
+func (b *breaker) record(opts *HealthOptions, ok, lone bool, now time.Time) {
+	if ok {
+		b.state = CircuitClosed
+		b.failures = 0
+		b.down = false
+		return
+	}
+	b.failures++
+	if opts.Failures == 0 || (b.state != CircuitHalfOpen && b.failures < opts.Failures) {
+		return
+	}
+	if lone {
+		b.down = true
+		return
+	}
+	b.state = CircuitOpen
+	b.openedAt = now
+}
+
+// EnableHealth turns on circuit breaking and, when opts.Interval is set,
+// starts probing every upstream in the background until Close. A lone
+// upstream has nothing to fall back to, so its circuit never opens: an outage
+// still gets retried instead of answered with SERVFAIL for the cooldown, and
+// OnHealth reports it instead. It must be called before the selector is used.
+func (s *Selector) EnableHealth(opts HealthOptions) {
+	if opts.Canary == "" {
+		opts.Canary = "."
+	}
+	s.health = opts
+	if opts.Interval <= 0 {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s.stopProbes = cancel
+	s.probes.Add(1)
+	go func() {
+		defer s.probes.Done()
+		ticker := time.NewTicker(opts.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				s.probe(ctx)
+			}
+		}
+	}()
+}
+
+// probe sends the canary query to every upstream at once and waits for the
+// results.
+func (s *Selector) probe(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, s.health.Interval)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, m := range s.members {
+		wg.Add(1)
+		go func(m *member) {
+			defer wg.Done()
+			msg := new(dns.Msg)
+			msg.SetQuestion(dns.Fqdn(s.health.Canary), dns.TypeNS)
+			_, _ = m.exchange(ctx, msg, true)
+		}(m)
+	}
+	wg.Wait()
+}
+
+// available filters members down to those whose circuit admits a query.
+func (s *Selector) available(members []*member) []*member {
+	if s.health.Failures == 0 {
+		return members
+	}
+	now := time.Now()
+	out := members[:0]
+	for _, m := range members {
+		m.mu.Lock()
+		ok, from := m.breaker.allow(&s.health, now)
+		to, failures := m.breaker.state, m.breaker.failures
+		m.mu.Unlock()
+		s.notify(m, from, to, failures)
+		if ok {
+			out = append(out, m)
+		}
+	}
+	return out
+}
+
+func (s *Selector) notify(m *member, from, to CircuitState, failures int) {
+	if from != to && s.health.OnChange != nil {
+		s.health.OnChange(m.up.String(), from, to, failures)
+	}
+}
@@ -0,0 +1,188 @@
+package upstream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// flakyUpstream fails while down is non-zero; it can be toggled while probes run.
+type flakyUpstream struct {
+	down  int32
+	calls int32
+}
+
+func (f *flakyUpstream) Query(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	atomic.AddInt32(&f.calls, 1)
+	if atomic.LoadInt32(&f.down) != 0 {
+		return nil, errors.New("down")
+	}
+	resp := new(dns.Msg)
+	resp.SetReply(msg)
+	return resp, nil
+}
+
+func (f *flakyUpstream) String() string { return "flaky" }
+
+func (f *flakyUpstream) Close() error { return nil }
+
+func TestCircuitOpensAfterConsecutiveFailures(t *testing.T) {
+	a := &fakeUpstream{name: "a", err: errors.New("down")}
+	b := &fakeUpstream{name: "b"}
+	s := NewSelector(StrategyOrder, candidates(a, b), 0)
+	s.EnableHealth(HealthOptions{Failures: 2, Cooldown: time.Hour})
+
+	for i := 0; i < 4; i++ {
+		if _, _, err := s.Query(context.Background(), newQuery()); err != nil {
+			t.Fatalf("query %d: %v", i, err)
+		}
+	}
+	if got := atomic.LoadInt32(&a.calls); got != 2 {
+		t.Fatalf("expected a to be skipped once its circuit opened, got %d calls", got)
+	}
+	if st := s.Stats()[0]; st.Circuit != CircuitOpen || st.ConsecutiveFailures != 2 {
+		t.Fatalf("unexpected stats for a: %+v", st)
+	}
+
+}
+
+func TestCircuitNeverOpensForLoneUpstream(t *testing.T) {
+	a := &fakeUpstream{name: "a", err: errors.New("down")}
+	var events []string
+	s := NewSelector(StrategyOrder, candidates(a), 0)
+	s.EnableHealth(HealthOptions{
+		Failures: 2,
+		Cooldown: time.Hour,
+		OnChange: func(name string, from, to CircuitState, failures int) {
+			t.Errorf("unexpected circuit change %s>%s for a lone upstream", from, to)
+		},
+		OnHealth: func(name string, healthy bool, failures int) {
+			events = append(events, fmt.Sprintf("%s healthy=%t failures=%d", name, healthy, failures))
+		},
+	})
+
+	for i := 0; i < 3; i++ {
+		if _, _, err := s.Query(context.Background(), newQuery()); err == nil || errors.Is(err, ErrNoHealthyUpstream) {
+			t.Fatalf("query %d: expected the upstream's own error, got %v", i, err)
+		}
+	}
+	if got := atomic.LoadInt32(&a.calls); got != 3 {
+		t.Fatalf("expected a lone upstream to be queried every time, got %d calls", got)
+	}
+	if st := s.Stats()[0]; st.Circuit != CircuitClosed || st.ConsecutiveFailures != 3 {
+		t.Fatalf("unexpected stats for a: %+v", st)
+	}
+
+	a.err = nil
+	if _, _, err := s.Query(context.Background(), newQuery()); err != nil {
+		t.Fatalf("expected the upstream to answer once it recovers, got %v", err)
+	}
+	want := []string{"a healthy=false failures=2", "a healthy=true failures=0"}
+	if fmt.Sprint(events) != fmt.Sprint(want) {
+		t.Fatalf("health events = %v, want %v", events, want)
+	}
+}
+
+func TestCircuitHalfOpenRecovers(t *testing.T) {
+	a := &fakeUpstream{name: "a", err: errors.New("down")}
+	b := &fakeUpstream{name: "b"}
+	var (
+		mu          sync.Mutex
+		transitions []string
+	)
+	s := NewSelector(StrategyOrder, candidates(a, b), 0)
+	s.EnableHealth(HealthOptions{
+		Failures: 1,
+		Cooldown: 10 * time.Millisecond,
+		OnChange: func(name string, from, to CircuitState, failures int) {
+			mu.Lock()
+			transitions = append(transitions, from.String()+">"+to.String())
+			mu.Unlock()
+		},
+	})
+
+	if _, _, err := s.Query(context.Background(), newQuery()); err != nil {
+		t.Fatalf("expected b to answer while a fails, got %v", err)
+	}
+	a.err = nil
+	time.Sleep(20 * time.Millisecond)
+	if _, _, err := s.Query(context.Background(), newQuery()); err != nil {
+		t.Fatalf("expected the half-open trial to succeed, got %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := []string{"closed>open", "open>half-open", "half-open>closed"}
+	if len(transitions) != len(want) {
+		t.Fatalf("transitions = %v, want %v", transitions, want)
+	}
+	for i := range want {
+		if transitions[i] != want[i] {
+			t.Fatalf("transitions = %v, want %v", transitions, want)
+		}
+	}
+}
+
+func TestProbesTrackHealth(t *testing.T) {
+	f := &flakyUpstream{down: 1}
+	s := NewSelector(StrategyOrder, []Candidate{{Upstream: f}, {Upstream: &flakyUpstream{}}}, 0)
+	s.EnableHealth(HealthOptions{Failures: 2, Cooldown: time.Hour, Interval: 5 * time.Millisecond})
+	defer s.Close()
+
+	waitCircuit := func(want CircuitState) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for s.Stats()[0].Circuit != want {
+			if time.Now().After(deadline) {
+				t.Fatalf("circuit did not become %s: %+v", want, s.Stats()[0])
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	waitCircuit(CircuitOpen)
+	// Probes keep going while the circuit is open and close it on recovery.
+	atomic.StoreInt32(&f.down, 0)
+	waitCircuit(CircuitClosed)
+
+	if st := s.Stats()[0]; st.Queries != 0 {
+		t.Fatalf("probes must not count as queries, got %d", st.Queries)
+	}
+}
+
+func TestProbesTrackLoneUpstream(t *testing.T) {
+	f := &flakyUpstream{down: 1}
+	events := make(chan bool, 4)
+	s := NewSelector(StrategyOrder, []Candidate{{Upstream: f}}, 0)
+	s.EnableHealth(HealthOptions{
+		Failures: 2,
+		Cooldown: time.Hour,
+		Interval: 5 * time.Millisecond,
+		OnHealth: func(name string, healthy bool, failures int) { events <- healthy },
+	})
+	defer s.Close()
+
+	wait := func(want bool) {
+		t.Helper()
+		select {
+		case got := <-events:
+			if got != want {
+				t.Fatalf("healthy = %t, want %t", got, want)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("no health event, want healthy = %t", want)
+		}
+	}
+	wait(false)
+	if st := s.Stats()[0]; st.Circuit != CircuitClosed {
+		t.Fatalf("expected the lone circuit to stay closed, got %+v", st)
+	}
+	atomic.StoreInt32(&f.down, 0)
+	wait(true)
+}
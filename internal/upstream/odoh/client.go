@@ -0,0 +1,250 @@
+package odoh
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/ogpourya/dnsbro/internal/upstream"
+	"github.com/ogpourya/dnsbro/internal/upstream/bootstrap"
+	"github.com/ogpourya/dnsbro/internal/upstream/doh"
+	"github.com/ogpourya/dnsbro/internal/upstream/proxy"
+
+	"github.com/miekg/dns"
+)
+
+func init() {
+	upstream.Register("odoh", newUpstream)
+}
+
+// newUpstream maps odoh://target/path to the HTTPS target and sends queries
+// through opts.Relay. opts.TLS applies to the target, whose key config it
+// authenticates; the relay is verified against the system roots.
+func newUpstream(u *url.URL, opts upstream.Options) (upstream.Upstream, error) {
+	if u.Host == "" {
+		return nil, fmt.Errorf("odoh endpoint %q has no host", u)
+	}
+	if opts.Relay == "" {
+		return nil, fmt.Errorf("odoh endpoint %q needs a relay", u)
+	}
+	target := *u
+	target.Scheme = "https"
+	if target.Path == "" {
+		target.Path = "/dns-query"
+	}
+	resolver := bootstrap.New(opts.Bootstrap, opts.Timeout)
+	if err := resolver.Pin(u.Hostname(), opts.BootstrapIPs); err != nil {
+		return nil, fmt.Errorf("odoh endpoint %q: %w", u, err)
+	}
+	var dialer doh.Dialer = resolver
+	if opts.Proxy != "" {
+		p, err := proxy.New(opts.Proxy, resolver, opts.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("odoh endpoint %q: %w", u, err)
+		}
+		dialer = p
+	}
+	c, err := New(target.String(), opts.Relay, opts.Timeout, dialer)
+	if err != nil {
+		return nil, err
+	}
+	if err := opts.TLS.Apply(c.TargetClient.Transport.(*http.Transport).TLSClientConfig); err != nil {
+		return nil, fmt.Errorf("odoh endpoint %q: %w", u, err)
+	}
+	c.endpoint = u.String()
+	return c, nil
+}
+
+// ContentType is the media type of ODoH queries and responses.
+const ContentType = "application/oblivious-dns-message"
+
+// configRefreshInterval bounds how long a target key config is used before
+// it is fetched again.
+const configRefreshInterval = time.Hour
+
+// Client forwards DNS queries with Oblivious DoH (RFC 9230): queries are
+// encrypted to the target's HPKE key and posted to a relay, so the relay sees
+// who asks but not what, and the target sees what is asked but not by whom.
+type Client struct {
+	// Target is the DoH URL of the resolver that decrypts the queries.
+	Target string
+	// Relay is the URL of the oblivious relay the queries are posted to.
+	Relay string
+	// Client posts queries to the relay and TargetClient fetches the
+	// target's key config.
+	Client       *http.Client
+	TargetClient *http.Client
+	// Timeout bounds queries whose context has no deadline.
+	Timeout time.Duration
+
+	endpoint string
+	target   *url.URL
+	relay    *url.URL
+
+	mu      sync.Mutex
+	config  *keyConfig
+	fetched time.Time
+}
+
+// New creates an ODoH client. The relay and the target get their own
+// HTTP/2-capable clients, both connecting through dialer, or directly via the
+// default bootstrap servers when nil.
+func New(target, relay string, timeout time.Duration, dialer doh.Dialer) (*Client, error) {
+	tu, err := url.Parse(target)
+	if err != nil || tu.Host == "" {
+		return nil, fmt.Errorf("invalid odoh target %q", target)
+	}
+	ru, err := url.Parse(relay)
+	if err != nil || ru.Host == "" {
+		return nil, fmt.Errorf("invalid odoh relay %q", relay)
+	}
+	if timeout == 0 {
+		timeout = 5 * time.Second
+	}
+	return &Client{
+		Target:       target,
+		Relay:        relay,
+		Client:       doh.NewHTTPClient(timeout, dialer),
+		TargetClient: doh.NewHTTPClient(timeout, dialer),
+		Timeout:      timeout,
+		endpoint:     target,
+		target:       tu,
+		relay:        ru,
+	}, nil
+}
+
+// errKeyRejected reports that the target no longer accepts the key config.
+var errKeyRejected = errors.New("odoh target rejected the key config")
+
+// Query encrypts msg for the target and sends it through the relay. If the
+// target rejects the key (it rotated), the config is fetched again and the
+// query retried once.
+func (c *Client) Query(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+
+	out, err := c.query(ctx, msg, false)
+	if errors.Is(err, errKeyRejected) {
+		out, err = c.query(ctx, msg, true)
+	}
+	return out, err
+}
+
+func (c *Client) query(ctx context.Context, msg *dns.Msg, refetch bool) (*dns.Msg, error) {
+	cfg, err := c.keyConfig(ctx, refetch)
+	if err != nil {
+		return nil, err
+	}
+
+	q := msg.Copy()
+	q.Id = 0
+	wire, err := q.Pack()
+	if err != nil {
+		return nil, fmt.Errorf("pack dns msg: %w", err)
+	}
+	qPlain := plaintext(wire, paddingBlock)
+	body, hctx, err := sealQuery(cfg, qPlain)
+	if err != nil {
+		return nil, fmt.Errorf("encrypt odoh query: %w", err)
+	}
+
+	u := *c.relay
+	params := u.Query()
+	params.Set("targethost", c.target.Host)
+	params.Set("targetpath", c.target.EscapedPath())
+	u.RawQuery = params.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("create odoh request: %w", err)
+	}
+	req.Header.Set("Content-Type", ContentType)
+	req.Header.Set("Accept", ContentType)
+
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("perform odoh request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		return nil, errKeyRejected
+	}
+	if resp.StatusCode != http.StatusOK {
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 256))
+		return nil, fmt.Errorf("odoh status %d: %s", resp.StatusCode, string(data))
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("read odoh body: %w", err)
+	}
+	rWire, err := openResponse(hctx, qPlain, data)
+	if err != nil {
+		return nil, err
+	}
+
+	var out dns.Msg
+	if err := out.Unpack(rWire); err != nil {
+		return nil, fmt.Errorf("unpack odoh response: %w", err)
+	}
+	out.Id = msg.Id
+	return &out, nil
+}
+
+// keyConfig returns the cached target key config, fetching it from the
+// target's well-known URL when missing, stale or refetch is set.
+func (c *Client) keyConfig(ctx context.Context, refetch bool) (*keyConfig, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.config != nil && !refetch && time.Since(c.fetched) < configRefreshInterval {
+		return c.config, nil
+	}
+
+	u := url.URL{Scheme: c.target.Scheme, Host: c.target.Host, Path: "/.well-known/odohconfigs"}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("create odoh config request: %w", err)
+	}
+	resp, err := c.TargetClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("fetch odoh configs: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetch odoh configs: status %d", resp.StatusCode)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return nil, fmt.Errorf("read odoh configs: %w", err)
+	}
+	cfg, err := parseConfigs(data)
+	if err != nil {
+		return nil, err
+	}
+	c.config = cfg
+	c.fetched = time.Now()
+	return cfg, nil
+}
+
+// String returns the endpoint the client was built from.
+func (c *Client) String() string {
+	return c.endpoint
+}
+
+// Close drops idle connections to the relay and target.
+func (c *Client) Close() error {
+	c.Client.CloseIdleConnections()
+	c.TargetClient.CloseIdleConnections()
+	return nil
+}
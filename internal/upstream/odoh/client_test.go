@@ -0,0 +1,278 @@
+package odoh
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ogpourya/dnsbro/internal/upstream"
+
+	"github.com/miekg/dns"
+)
+
+// target is an in-process ODoH target answering A queries with 192.0.2.1.
+type target struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	key      *ecdh.PrivateKey
+	config   *keyConfig
+	contents []byte
+	fetches  int32
+	rejected int32
+}
+
+func startTarget(t *testing.T) *target {
+	t.Helper()
+	tg := &target{}
+	tg.rotate(t)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/odohconfigs", tg.serveConfigs)
+	mux.HandleFunc("/dns-query", tg.serveQuery)
+	tg.Server = httptest.NewServer(mux)
+	t.Cleanup(tg.Close)
+	return tg
+}
+
+// rotate installs a new key pair.
+func (tg *target) rotate(t *testing.T) {
+	t.Helper()
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	contents := binary.BigEndian.AppendUint16(nil, kemX25519HKDFSHA256)
+	contents = binary.BigEndian.AppendUint16(contents, kdfHKDFSHA256)
+	contents = binary.BigEndian.AppendUint16(contents, aeadAES128GCM)
+	contents = appendVector(contents, key.PublicKey().Bytes())
+
+	config := binary.BigEndian.AppendUint16(nil, configVersion)
+	config = appendVector(config, contents)
+	cfg, err := parseConfigs(appendVector(nil, config))
+	if err != nil {
+		t.Fatalf("parse own config: %v", err)
+	}
+
+	tg.mu.Lock()
+	tg.key, tg.config, tg.contents = key, cfg, appendVector(nil, config)
+	tg.mu.Unlock()
+}
+
+func (tg *target) serveConfigs(w http.ResponseWriter, r *http.Request) {
+	atomic.AddInt32(&tg.fetches, 1)
+	tg.mu.Lock()
+	defer tg.mu.Unlock()
+	_, _ = w.Write(tg.contents)
+}
+
+func (tg *target) serveQuery(w http.ResponseWriter, r *http.Request) {
+	tg.mu.Lock()
+	key, cfg := tg.key, tg.config
+	tg.mu.Unlock()
+
+	body, _ := io.ReadAll(r.Body)
+	typ, keyID, encrypted, err := decodeMessage(body)
+	if err != nil || typ != messageQuery || len(encrypted) < 32 {
+		http.Error(w, "bad message", http.StatusBadRequest)
+		return
+	}
+	if !bytes.Equal(keyID, cfg.keyID) {
+		atomic.AddInt32(&tg.rejected, 1)
+		http.Error(w, "unknown key", http.StatusUnauthorized)
+		return
+	}
+	hctx, err := setupBaseR(encrypted[:32], key, []byte("odoh query"))
+	if err != nil {
+		http.Error(w, "bad key", http.StatusBadRequest)
+		return
+	}
+	qPlain, err := hctx.open(messageAAD(messageQuery, keyID), encrypted[32:])
+	if err != nil {
+		http.Error(w, "decrypt", http.StatusBadRequest)
+		return
+	}
+	wire, err := parsePlaintext(qPlain)
+	var req dns.Msg
+	if err == nil {
+		err = req.Unpack(wire)
+	}
+	if err != nil || req.Id != 0 {
+		http.Error(w, "bad query", http.StatusBadRequest)
+		return
+	}
+
+	resp := new(dns.Msg)
+	resp.SetReply(&req)
+	resp.Answer = append(resp.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		A:   net.ParseIP("192.0.2.1"),
+	})
+	rWire, _ := resp.Pack()
+
+	nonce := make([]byte, responseNonceSize)
+	_, _ = rand.Read(nonce)
+	aead, aeadNonce, err := responseKeys(hctx, qPlain, nonce)
+	if err != nil {
+		http.Error(w, "keys", http.StatusInternalServerError)
+		return
+	}
+	ct := aead.Seal(nil, aeadNonce, plaintext(rWire, 0), messageAAD(messageResponse, nonce))
+	w.Header().Set("Content-Type", ContentType)
+	_, _ = w.Write(encodeMessage(messageResponse, nonce, ct))
+}
+
+// startRelay runs an oblivious relay that forwards to http://targethost/targetpath.
+func startRelay(t *testing.T) (*httptest.Server, *int32) {
+	t.Helper()
+	var forwarded int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Type") != ContentType {
+			http.Error(w, "bad content type", http.StatusUnsupportedMediaType)
+			return
+		}
+		u := "http://" + r.URL.Query().Get("targethost") + r.URL.Query().Get("targetpath")
+		resp, err := http.Post(u, ContentType, r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+		atomic.AddInt32(&forwarded, 1)
+		w.WriteHeader(resp.StatusCode)
+		_, _ = io.Copy(w, resp.Body)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &forwarded
+}
+
+func query() *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeA)
+	m.Id = 4242
+	return m
+}
+
+func TestQueryThroughRelay(t *testing.T) {
+	tg := startTarget(t)
+	relay, forwarded := startRelay(t)
+	c, err := New(tg.URL+"/dns-query", relay.URL, time.Second, nil)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer c.Close()
+
+	for i := 0; i < 3; i++ {
+		resp, err := c.Query(context.Background(), query())
+		if err != nil {
+			t.Fatalf("query %d: %v", i, err)
+		}
+		if resp.Id != 4242 || len(resp.Answer) != 1 {
+			t.Fatalf("query %d: unexpected response %v", i, resp)
+		}
+	}
+	if got := atomic.LoadInt32(forwarded); got != 3 {
+		t.Fatalf("expected 3 queries through the relay, got %d", got)
+	}
+	if got := atomic.LoadInt32(&tg.fetches); got != 1 {
+		t.Fatalf("expected the key config to be fetched once, got %d", got)
+	}
+}
+
+func TestQueryRefetchesRotatedKey(t *testing.T) {
+	tg := startTarget(t)
+	relay, _ := startRelay(t)
+	c, err := New(tg.URL+"/dns-query", relay.URL, time.Second, nil)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer c.Close()
+
+	if _, err := c.Query(context.Background(), query()); err != nil {
+		t.Fatalf("first query: %v", err)
+	}
+	tg.rotate(t)
+	if _, err := c.Query(context.Background(), query()); err != nil {
+		t.Fatalf("query after rotation: %v", err)
+	}
+	if got := atomic.LoadInt32(&tg.rejected); got != 1 {
+		t.Fatalf("expected one rejected query, got %d", got)
+	}
+	if got := atomic.LoadInt32(&tg.fetches); got != 2 {
+		t.Fatalf("expected the key config to be fetched twice, got %d", got)
+	}
+}
+
+func TestNewUpstreamRequiresRelay(t *testing.T) {
+	u, _ := url.Parse("odoh://odoh.example/dns-query")
+	if _, err := newUpstream(u, upstream.Options{}); err == nil {
+		t.Fatalf("expected an error without relay")
+	}
+	up, err := newUpstream(u, upstream.Options{Relay: "https://relay.example/proxy"})
+	if err != nil {
+		t.Fatalf("newUpstream() error = %v", err)
+	}
+	c := up.(*Client)
+	if c.Target != "https://odoh.example/dns-query" || c.String() != "odoh://odoh.example/dns-query" {
+		t.Fatalf("unexpected client target %q endpoint %q", c.Target, c.String())
+	}
+}
+
+func TestNewUpstreamAppliesTLSToTarget(t *testing.T) {
+	tg := &target{}
+	tg.rotate(t)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/odohconfigs", tg.serveConfigs)
+	tg.Server = httptest.NewTLSServer(mux)
+	t.Cleanup(tg.Close)
+	relay, _ := startRelay(t)
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: tg.Certificate().Raw})
+	if err := os.WriteFile(caFile, ca, 0o644); err != nil {
+		t.Fatalf("write ca: %v", err)
+	}
+	u, _ := url.Parse("odoh://" + tg.Listener.Addr().String() + "/dns-query")
+	other := sha256.Sum256([]byte("another key"))
+
+	for _, tt := range []struct {
+		pin     string
+		fetches int32
+	}{
+		{base64.StdEncoding.EncodeToString(other[:]), 0},
+		{upstream.SPKIPin(tg.Certificate()), 1},
+	} {
+		up, err := newUpstream(u, upstream.Options{
+			Timeout: time.Second,
+			Relay:   relay.URL,
+			TLS:     upstream.TLSOptions{CAFile: caFile, SPKIPins: []string{tt.pin}},
+		})
+		if err != nil {
+			t.Fatalf("newUpstream() error = %v", err)
+		}
+		_, err = up.Query(context.Background(), query())
+		_ = up.Close()
+		if tt.fetches == 0 && !errors.Is(err, upstream.ErrPinMismatch) {
+			t.Fatalf("expected ErrPinMismatch from the target, got %v", err)
+		}
+		if got := atomic.LoadInt32(&tg.fetches); got != tt.fetches {
+			t.Fatalf("expected %d key config fetches, got %d (%v)", tt.fetches, got, err)
+		}
+	}
+}
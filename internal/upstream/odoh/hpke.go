@@ -0,0 +1,147 @@
+package odoh
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// HPKE (RFC 9180) identifiers of the only suite dnsbro speaks, which is the
+// one ODoH deployments use: DHKEM(X25519, HKDF-SHA256), HKDF-SHA256 and
+// AES-128-GCM.
+const (
+	kemX25519HKDFSHA256 uint16 = 0x0020
+	kdfHKDFSHA256       uint16 = 0x0001
+	aeadAES128GCM       uint16 = 0x0001
+)
+
+const (
+	nSecret = 32 // KEM shared secret
+	nh      = 32 // KDF output
+	nk      = 16 // AEAD key
+	nn      = 12 // AEAD nonce
+)
+
+var errUnsupportedSuite = errors.New("odoh: unsupported HPKE suite")
+
+var (
+	kemSuiteID  = binary.BigEndian.AppendUint16([]byte("KEM"), kemX25519HKDFSHA256)
+	hpkeSuiteID = binary.BigEndian.AppendUint16(binary.BigEndian.AppendUint16(binary.BigEndian.AppendUint16([]byte("HPKE"), kemX25519HKDFSHA256), kdfHKDFSHA256), aeadAES128GCM)
+)
+
+func labeledExtract(suite []byte, salt []byte, label string, ikm []byte) []byte {
+	in := append([]byte("HPKE-v1"), suite...)
+	in = append(in, label...)
+	in = append(in, ikm...)
+	return hkdf.Extract(sha256.New, in, salt)
+}
+
+func labeledExpand(suite []byte, prk []byte, label string, info []byte, length int) []byte {
+	in := binary.BigEndian.AppendUint16(nil, uint16(length))
+	in = append(in, "HPKE-v1"...)
+	in = append(in, suite...)
+	in = append(in, label...)
+	in = append(in, info...)
+	return expand(prk, in, length)
+}
+
+func expand(prk, info []byte, length int) []byte {
+	out := make([]byte, length)
+	_, _ = io.ReadFull(hkdf.Expand(sha256.New, prk, info), out)
+	return out
+}
+
+// hpkeContext is an HPKE base-mode context used for a single message.
+type hpkeContext struct {
+	aead     cipher.AEAD
+	nonce    []byte
+	exporter []byte
+}
+
+// setupBaseS encapsulates a fresh shared secret to the recipient key pkR and
+// returns the encapsulated key together with the sender context.
+func setupBaseS(pkR []byte, info []byte) ([]byte, *hpkeContext, error) {
+	peer, err := ecdh.X25519().NewPublicKey(pkR)
+	if err != nil {
+		return nil, nil, err
+	}
+	skE, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	dh, err := skE.ECDH(peer)
+	if err != nil {
+		return nil, nil, err
+	}
+	enc := skE.PublicKey().Bytes()
+	ctx, err := keySchedule(sharedSecret(dh, enc, pkR), info)
+	if err != nil {
+		return nil, nil, err
+	}
+	return enc, ctx, nil
+}
+
+// setupBaseR is the recipient side of setupBaseS.
+func setupBaseR(enc []byte, skR *ecdh.PrivateKey, info []byte) (*hpkeContext, error) {
+	pkE, err := ecdh.X25519().NewPublicKey(enc)
+	if err != nil {
+		return nil, err
+	}
+	dh, err := skR.ECDH(pkE)
+	if err != nil {
+		return nil, err
+	}
+	return keySchedule(sharedSecret(dh, enc, skR.PublicKey().Bytes()), info)
+}
+
+func sharedSecret(dh, enc, pkR []byte) []byte {
+	kemContext := append(append([]byte(nil), enc...), pkR...)
+	prk := labeledExtract(kemSuiteID, nil, "eae_prk", dh)
+	return labeledExpand(kemSuiteID, prk, "shared_secret", kemContext, nSecret)
+}
+
+func keySchedule(shared, info []byte) (*hpkeContext, error) {
+	pskIDHash := labeledExtract(hpkeSuiteID, nil, "psk_id_hash", nil)
+	infoHash := labeledExtract(hpkeSuiteID, nil, "info_hash", info)
+	ksc := append([]byte{0x00}, pskIDHash...) // mode_base
+	ksc = append(ksc, infoHash...)
+
+	secret := labeledExtract(hpkeSuiteID, shared, "secret", nil)
+	aead, err := newAEAD(labeledExpand(hpkeSuiteID, secret, "key", ksc, nk))
+	if err != nil {
+		return nil, err
+	}
+	return &hpkeContext{
+		aead:     aead,
+		nonce:    labeledExpand(hpkeSuiteID, secret, "base_nonce", ksc, nn),
+		exporter: labeledExpand(hpkeSuiteID, secret, "exp", ksc, nh),
+	}, nil
+}
+
+// seal and open use sequence number zero; every context carries one message.
+func (c *hpkeContext) seal(aad, pt []byte) []byte {
+	return c.aead.Seal(nil, c.nonce, pt, aad)
+}
+
+func (c *hpkeContext) open(aad, ct []byte) ([]byte, error) {
+	return c.aead.Open(nil, c.nonce, ct, aad)
+}
+
+func (c *hpkeContext) export(exporterContext []byte, length int) []byte {
+	return labeledExpand(hpkeSuiteID, c.exporter, "sec", exporterContext, length)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,44 @@
+package odoh
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"encoding/hex"
+	"testing"
+)
+
+func unhex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatalf("decode %q: %v", s, err)
+	}
+	return b
+}
+
+// TestHPKEVector checks the key schedule against RFC 9180 appendix A.1.1
+// (DHKEM(X25519, HKDF-SHA256), HKDF-SHA256, AES-128-GCM, base mode).
+func TestHPKEVector(t *testing.T) {
+	skR, err := ecdh.X25519().NewPrivateKey(unhex(t, "4612c550263fc8ad58375df3f557aac531d26850903e55a9f23f21d8534e8ac8"))
+	if err != nil {
+		t.Fatalf("private key: %v", err)
+	}
+	enc := unhex(t, "37fda3567bdbd628e88668c3c8d7e97d1d1253b6d4ea6d44c150f741f1bf4431")
+	info := unhex(t, "4f6465206f6e2061204772656369616e2055726e")
+
+	ctx, err := setupBaseR(enc, skR, info)
+	if err != nil {
+		t.Fatalf("setupBaseR() error = %v", err)
+	}
+	if want := unhex(t, "56d890e5accaaf011cff4b7d"); !bytes.Equal(ctx.nonce, want) {
+		t.Fatalf("base_nonce = %x, want %x", ctx.nonce, want)
+	}
+	if want := unhex(t, "45ff1c2e220db587171952c0592d5f5ebe103f1561a2614e38f2ffd47e99e3f8"); !bytes.Equal(ctx.exporter, want) {
+		t.Fatalf("exporter_secret = %x, want %x", ctx.exporter, want)
+	}
+
+	ct := ctx.seal(unhex(t, "436f756e742d30"), unhex(t, "4265617574792069732074727574682c20747275746820626561757479"))
+	if want := unhex(t, "f938558b5d72f1a23810b4be2ab4f84331acc02fc97babc53a52ae8218a355a96d8770ac83d07bea87e13c512a"); !bytes.Equal(ct, want) {
+		t.Fatalf("ciphertext = %x, want %x", ct, want)
+	}
+}
@@ -0,0 +1,195 @@
+package odoh
+
+import (
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// Message types and the key config version defined by RFC 9230.
+const (
+	messageQuery    byte   = 0x01
+	messageResponse byte   = 0x02
+	configVersion   uint16 = 0x0001
+)
+
+// responseNonceSize is max(Nn, Nk) for AES-128-GCM.
+const responseNonceSize = nk
+
+// paddingBlock rounds padded queries up to a multiple of this many bytes so
+// the relay cannot tell names apart by length.
+const paddingBlock = 128
+
+var errMalformed = errors.New("odoh: malformed message")
+
+// keyConfig is a target's ObliviousDoHConfigContents.
+type keyConfig struct {
+	kemID, kdfID, aeadID uint16
+	publicKey            []byte
+	keyID                []byte
+}
+
+// parseConfigs decodes an ObliviousDoHConfigs list and returns the first
+// config dnsbro can use.
+func parseConfigs(b []byte) (*keyConfig, error) {
+	r := &reader{buf: b}
+	list := r.vector()
+	if r.err != nil {
+		return nil, fmt.Errorf("decode odoh configs: %w", r.err)
+	}
+
+	lr := &reader{buf: list}
+	for len(lr.buf) > 0 {
+		version := lr.uint16()
+		contents := lr.vector()
+		if lr.err != nil {
+			return nil, fmt.Errorf("decode odoh configs: %w", lr.err)
+		}
+		if version != configVersion {
+			continue
+		}
+
+		cr := &reader{buf: contents}
+		cfg := &keyConfig{kemID: cr.uint16(), kdfID: cr.uint16(), aeadID: cr.uint16()}
+		cfg.publicKey = cr.vector()
+		if cr.err != nil {
+			return nil, fmt.Errorf("decode odoh config: %w", cr.err)
+		}
+		if cfg.kemID != kemX25519HKDFSHA256 || cfg.kdfID != kdfHKDFSHA256 || cfg.aeadID != aeadAES128GCM {
+			continue
+		}
+		cfg.keyID = expand(hkdf.Extract(sha256.New, contents, nil), []byte("odoh key id"), nh)
+		return cfg, nil
+	}
+	return nil, errUnsupportedSuite
+}
+
+// plaintext encodes an ObliviousDoHMessagePlaintext with padding.
+func plaintext(wire []byte, padTo int) []byte {
+	padding := 0
+	if padTo > 0 {
+		if rem := (len(wire) + 4) % padTo; rem != 0 {
+			padding = padTo - rem
+		}
+	}
+	out := appendVector(nil, wire)
+	return appendVector(out, make([]byte, padding))
+}
+
+func parsePlaintext(b []byte) ([]byte, error) {
+	r := &reader{buf: b}
+	wire := r.vector()
+	r.vector()
+	if r.err != nil || len(wire) == 0 {
+		return nil, errMalformed
+	}
+	return wire, nil
+}
+
+// encodeMessage encodes an ObliviousDoHMessage.
+func encodeMessage(typ byte, keyID, encrypted []byte) []byte {
+	out := appendVector([]byte{typ}, keyID)
+	return appendVector(out, encrypted)
+}
+
+func decodeMessage(b []byte) (typ byte, keyID, encrypted []byte, err error) {
+	if len(b) < 1 {
+		return 0, nil, nil, errMalformed
+	}
+	r := &reader{buf: b[1:]}
+	keyID = r.vector()
+	encrypted = r.vector()
+	if r.err != nil || len(r.buf) != 0 {
+		return 0, nil, nil, errMalformed
+	}
+	return b[0], keyID, encrypted, nil
+}
+
+func messageAAD(typ byte, keyID []byte) []byte {
+	return appendVector([]byte{typ}, keyID)
+}
+
+// sealQuery encrypts the query plaintext to the target. The returned context
+// and plaintext are needed to open the response.
+func sealQuery(cfg *keyConfig, qPlain []byte) ([]byte, *hpkeContext, error) {
+	enc, ctx, err := setupBaseS(cfg.publicKey, []byte("odoh query"))
+	if err != nil {
+		return nil, nil, err
+	}
+	ct := ctx.seal(messageAAD(messageQuery, cfg.keyID), qPlain)
+	return encodeMessage(messageQuery, cfg.keyID, append(enc, ct...)), ctx, nil
+}
+
+// openResponse decrypts a response message with the secrets exported from
+// the query context.
+func openResponse(ctx *hpkeContext, qPlain, msg []byte) ([]byte, error) {
+	typ, nonce, ct, err := decodeMessage(msg)
+	if err != nil {
+		return nil, err
+	}
+	if typ != messageResponse || len(nonce) != responseNonceSize {
+		return nil, errMalformed
+	}
+	aead, aeadNonce, err := responseKeys(ctx, qPlain, nonce)
+	if err != nil {
+		return nil, err
+	}
+	rPlain, err := aead.Open(nil, aeadNonce, ct, messageAAD(messageResponse, nonce))
+	if err != nil {
+		return nil, fmt.Errorf("odoh: decrypt response: %w", err)
+	}
+	return parsePlaintext(rPlain)
+}
+
+func responseKeys(ctx *hpkeContext, qPlain, nonce []byte) (aead cipher.AEAD, aeadNonce []byte, err error) {
+	secret := ctx.export([]byte("odoh response"), nk)
+	salt := appendVector(append([]byte(nil), qPlain...), nonce)
+	prk := hkdf.Extract(sha256.New, secret, salt)
+	aead, err = newAEAD(expand(prk, []byte("odoh key"), nk))
+	if err != nil {
+		return nil, nil, err
+	}
+	return aead, expand(prk, []byte("odoh nonce"), nn), nil
+}
+
+func appendVector(b, v []byte) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(v)))
+	return append(b, v...)
+}
+
+type reader struct {
+	buf []byte
+	err error
+}
+
+func (r *reader) uint16() uint16 {
+	if r.err != nil {
+		return 0
+	}
+	if len(r.buf) < 2 {
+		r.err = errMalformed
+		return 0
+	}
+	v := binary.BigEndian.Uint16(r.buf)
+	r.buf = r.buf[2:]
+	return v
+}
+
+// vector reads a 16-bit length-prefixed byte string.
+func (r *reader) vector() []byte {
+	n := int(r.uint16())
+	if r.err != nil {
+		return nil
+	}
+	if len(r.buf) < n {
+		r.err = errMalformed
+		return nil
+	}
+	v := r.buf[:n]
+	r.buf = r.buf[n:]
+	return v
+}
@@ -0,0 +1,119 @@
+package plain
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/ogpourya/dnsbro/internal/upstream"
+	"github.com/ogpourya/dnsbro/internal/upstream/bootstrap"
+
+	"github.com/miekg/dns"
+)
+
+func init() {
+	upstream.Register("udp", newUpstream)
+	upstream.Register("tcp", newUpstream)
+}
+
+func newUpstream(u *url.URL, opts upstream.Options) (upstream.Upstream, error) {
+	if u.Host == "" {
+		return nil, fmt.Errorf("%s endpoint %q has no host", u.Scheme, u)
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "53")
+	}
+	resolver := bootstrap.New(opts.Bootstrap, opts.Timeout)
+	if err := resolver.Pin(u.Hostname(), opts.BootstrapIPs); err != nil {
+		return nil, fmt.Errorf("%s endpoint %q: %w", u.Scheme, u, err)
+	}
+	c := New(addr, strings.ToLower(u.Scheme), opts.Timeout, resolver)
+	c.endpoint = u.String()
+	return c, nil
+}
+
+// Client forwards DNS queries over plain UDP or TCP, e.g. to LAN or VPN
+// resolvers. UDP answers with the TC bit set are retried over TCP.
+type Client struct {
+	Addr string
+	// Net is "udp" or "tcp".
+	Net string
+
+	endpoint string
+	resolver *bootstrap.Resolver
+	udp      *dns.Client
+	tcp      *dns.Client
+}
+
+// New creates a client for addr (host:port) using network "udp" or "tcp".
+// Hostnames are resolved via resolver, or the default bootstrap servers when
+// nil.
+func New(addr, network string, timeout time.Duration, resolver *bootstrap.Resolver) *Client {
+	if timeout == 0 {
+		timeout = 5 * time.Second
+	}
+	if resolver == nil {
+		resolver = bootstrap.New(nil, timeout)
+	}
+	return &Client{
+		Addr:     addr,
+		Net:      network,
+		endpoint: network + "://" + addr,
+		resolver: resolver,
+		udp:      &dns.Client{Net: "udp", Timeout: timeout},
+		tcp:      &dns.Client{Net: "tcp", Timeout: timeout},
+	}
+}
+
+// Query sends msg to the resolver, trying each of its addresses in turn.
+func (c *Client) Query(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	host, port, err := net.SplitHostPort(c.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("parse address %q: %w", c.Addr, err)
+	}
+	ips, err := c.resolver.LookupNetIP(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range ips {
+		var resp *dns.Msg
+		resp, err = c.exchange(ctx, msg, net.JoinHostPort(ip.String(), port))
+		if err == nil || ctx.Err() != nil {
+			return resp, err
+		}
+	}
+	return nil, err
+}
+
+// exchange queries addr, falling back to TCP on truncation.
+func (c *Client) exchange(ctx context.Context, msg *dns.Msg, addr string) (*dns.Msg, error) {
+	if c.Net == "udp" {
+		resp, _, err := c.udp.ExchangeContext(ctx, msg, addr)
+		if err != nil {
+			return nil, fmt.Errorf("udp query to %s: %w", addr, err)
+		}
+		if !resp.Truncated {
+			return resp, nil
+		}
+	}
+
+	resp, _, err := c.tcp.ExchangeContext(ctx, msg, addr)
+	if err != nil {
+		return nil, fmt.Errorf("tcp query to %s: %w", addr, err)
+	}
+	return resp, nil
+}
+
+// String returns the endpoint URL.
+func (c *Client) String() string {
+	return c.endpoint
+}
+
+// Close is a no-op; every query uses its own connection.
+func (c *Client) Close() error {
+	return nil
+}
@@ -0,0 +1,105 @@
+package plain
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// startServers runs UDP and TCP DNS servers on the same loopback port. Over
+// UDP every answer is truncated; over TCP the full answer is returned.
+func startServers(t *testing.T) (string, *int32) {
+	t.Helper()
+
+	var tcpQueries int32
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		resp := new(dns.Msg)
+		resp.SetReply(r)
+		if w.LocalAddr().Network() == "udp" {
+			resp.Truncated = true
+		} else {
+			atomic.AddInt32(&tcpQueries, 1)
+			resp.Answer = append(resp.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   net.ParseIP("192.0.2.1"),
+			})
+		}
+		_ = w.WriteMsg(resp)
+	})
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen udp: %v", err)
+	}
+	ln, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		pc.Close()
+		t.Skipf("tcp port matching udp port unavailable: %v", err)
+	}
+
+	udpSrv := &dns.Server{PacketConn: pc, Handler: handler}
+	tcpSrv := &dns.Server{Listener: ln, Handler: handler}
+	go func() { _ = udpSrv.ActivateAndServe() }()
+	go func() { _ = tcpSrv.ActivateAndServe() }()
+	t.Cleanup(func() {
+		_ = udpSrv.Shutdown()
+		_ = tcpSrv.Shutdown()
+	})
+	return pc.LocalAddr().String(), &tcpQueries
+}
+
+func query() *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion("big.example.com.", dns.TypeA)
+	return m
+}
+
+func TestUDPRetriesTruncatedAnswerOverTCP(t *testing.T) {
+	addr, tcpQueries := startServers(t)
+	c := New(addr, "udp", time.Second, nil)
+
+	resp, err := c.Query(context.Background(), query())
+	if err != nil {
+		t.Fatalf("Query() error = %v", err)
+	}
+	if resp.Truncated || len(resp.Answer) != 1 {
+		t.Fatalf("expected full answer after tcp retry, got %v", resp)
+	}
+	if got := atomic.LoadInt32(tcpQueries); got != 1 {
+		t.Fatalf("expected one tcp query, got %d", got)
+	}
+}
+
+func TestTCPClientSkipsUDP(t *testing.T) {
+	addr, _ := startServers(t)
+	c := New(addr, "tcp", time.Second, nil)
+
+	resp, err := c.Query(context.Background(), query())
+	if err != nil {
+		t.Fatalf("Query() error = %v", err)
+	}
+	if len(resp.Answer) != 1 {
+		t.Fatalf("expected answer over tcp, got %v", resp)
+	}
+}
+
+func TestQueryHonorsTimeout(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen udp: %v", err)
+	}
+	defer pc.Close()
+
+	c := New(pc.LocalAddr().String(), "udp", 50*time.Millisecond, nil)
+	start := time.Now()
+	if _, err := c.Query(context.Background(), query()); err == nil {
+		t.Fatalf("expected timeout from silent server")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("timeout not honored, took %v", elapsed)
+	}
+}
@@ -0,0 +1,164 @@
+// Package proxy dials upstream connections through SOCKS5 or HTTP CONNECT
+// proxies.
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/ogpourya/dnsbro/internal/upstream/bootstrap"
+
+	xproxy "golang.org/x/net/proxy"
+)
+
+// Dialer opens connections through a proxy. The proxy's own address is
+// resolved via the bootstrap resolver.
+type Dialer struct {
+	u        *url.URL
+	resolver *bootstrap.Resolver
+	timeout  time.Duration
+	socks    xproxy.ContextDialer
+}
+
+// New returns a Dialer for proxyURL: socks5:// resolves target hostnames
+// locally via resolver, socks5h:// leaves that to the proxy, and http://
+// tunnels with CONNECT, which also lets the proxy resolve.
+func New(proxyURL string, resolver *bootstrap.Resolver, timeout time.Duration) (*Dialer, error) {
+	u, err := url.Parse(proxyURL)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid proxy %q", proxyURL)
+	}
+	if timeout == 0 {
+		timeout = 5 * time.Second
+	}
+	if resolver == nil {
+		resolver = bootstrap.New(nil, timeout)
+	}
+	d := &Dialer{u: u, resolver: resolver, timeout: timeout}
+
+	switch strings.ToLower(u.Scheme) {
+	case "socks5", "socks5h":
+		var auth *xproxy.Auth
+		if u.User != nil {
+			pass, _ := u.User.Password()
+			auth = &xproxy.Auth{User: u.User.Username(), Password: pass}
+		}
+		s, err := xproxy.SOCKS5("tcp", hostPort(u, "1080"), auth, forward{resolver})
+		if err != nil {
+			return nil, fmt.Errorf("socks5 proxy %q: %w", u.Redacted(), err)
+		}
+		d.socks = s.(xproxy.ContextDialer)
+	case "http":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q (supported: socks5, socks5h, http)", u.Scheme)
+	}
+	return d, nil
+}
+
+// DialContext connects to addr (host:port) through the proxy.
+func (d *Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch strings.ToLower(d.u.Scheme) {
+	case "socks5":
+		return d.dialSOCKSLocal(ctx, network, addr)
+	case "socks5h":
+		return d.socks.DialContext(ctx, network, addr)
+	default:
+		return d.dialConnect(ctx, addr)
+	}
+}
+
+// dialSOCKSLocal resolves the target itself and hands the proxy addresses
+// only, trying them in turn.
+func (d *Dialer) dialSOCKSLocal(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := d.resolver.LookupNetIP(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	var lastErr error
+	for _, ip := range ips {
+		conn, err := d.socks.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, lastErr
+}
+
+// dialConnect opens a tunnel to addr with an HTTP CONNECT request.
+func (d *Dialer) dialConnect(ctx context.Context, addr string) (net.Conn, error) {
+	conn, err := d.resolver.DialContext(ctx, "tcp", hostPort(d.u, "80"))
+	if err != nil {
+		return nil, fmt.Errorf("dial http proxy: %w", err)
+	}
+	if dl, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(dl)
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if u := d.u.User; u != nil {
+		pass, _ := u.Password()
+		cred := base64.StdEncoding.EncodeToString([]byte(u.Username() + ":" + pass))
+		req.Header.Set("Proxy-Authorization", "Basic "+cred)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("send CONNECT: %w", err)
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("read CONNECT response: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy refused CONNECT to %s: %s", addr, resp.Status)
+	}
+	if br.Buffered() > 0 {
+		conn.Close()
+		return nil, fmt.Errorf("proxy sent data before the tunnel was established")
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// forward reaches the SOCKS proxy itself through the bootstrap resolver.
+type forward struct {
+	r *bootstrap.Resolver
+}
+
+func (f forward) Dial(network, addr string) (net.Conn, error) {
+	return f.r.DialContext(context.Background(), network, addr)
+}
+
+func (f forward) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return f.r.DialContext(ctx, network, addr)
+}
+
+func hostPort(u *url.URL, port string) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
@@ -0,0 +1,224 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ogpourya/dnsbro/internal/upstream/bootstrap"
+)
+
+// startEcho runs a TCP server that echoes one line back.
+func startEcho(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				line, _ := bufio.NewReader(conn).ReadString('\n')
+				_, _ = conn.Write([]byte(line))
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// proxyServer records the targets clients asked for and connects every
+// tunnel to upstream, the way Tor would after resolving the name.
+type proxyServer struct {
+	addr     string
+	upstream string
+
+	mu      sync.Mutex
+	targets []string
+}
+
+func (p *proxyServer) record(target string) {
+	p.mu.Lock()
+	p.targets = append(p.targets, target)
+	p.mu.Unlock()
+}
+
+func (p *proxyServer) lastTarget() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.targets) == 0 {
+		return ""
+	}
+	return p.targets[len(p.targets)-1]
+}
+
+func (p *proxyServer) serve(t *testing.T, handle func(net.Conn) bool) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	p.addr = ln.Addr().String()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if !handle(conn) {
+					return
+				}
+				up, err := net.Dial("tcp", p.upstream)
+				if err != nil {
+					return
+				}
+				defer up.Close()
+				go func() { _, _ = io.Copy(up, conn) }()
+				_, _ = io.Copy(conn, up)
+			}()
+		}
+	}()
+}
+
+// startSOCKS5 runs a minimal RFC 1928 server supporting CONNECT without auth.
+func startSOCKS5(t *testing.T, upstream string) *proxyServer {
+	p := &proxyServer{upstream: upstream}
+	p.serve(t, func(conn net.Conn) bool {
+		buf := make([]byte, 262)
+		if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+			return false
+		}
+		if _, err := io.ReadFull(conn, buf[:buf[1]]); err != nil {
+			return false
+		}
+		_, _ = conn.Write([]byte{5, 0})
+
+		if _, err := io.ReadFull(conn, buf[:4]); err != nil || buf[1] != 1 {
+			return false
+		}
+		var host string
+		switch buf[3] {
+		case 1:
+			_, _ = io.ReadFull(conn, buf[:4])
+			host = net.IP(buf[:4]).String()
+		case 4:
+			_, _ = io.ReadFull(conn, buf[:16])
+			host = net.IP(buf[:16]).String()
+		case 3:
+			_, _ = io.ReadFull(conn, buf[:1])
+			n := int(buf[0])
+			_, _ = io.ReadFull(conn, buf[:n])
+			host = string(buf[:n])
+		}
+		_, _ = io.ReadFull(conn, buf[:2])
+		p.record(net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(buf[:2])))))
+		_, _ = conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+		return true
+	})
+	return p
+}
+
+// startConnect runs an HTTP proxy that only supports CONNECT.
+func startConnect(t *testing.T, upstream string) *proxyServer {
+	p := &proxyServer{upstream: upstream}
+	p.serve(t, func(conn net.Conn) bool {
+		req, err := http.ReadRequest(bufio.NewReader(conn))
+		if err != nil || req.Method != http.MethodConnect {
+			return false
+		}
+		p.record(req.Host)
+		if req.Header.Get("Proxy-Authorization") != "Basic dXNlcjpwYXNz" {
+			_, _ = conn.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\n\r\n"))
+			return false
+		}
+		_, _ = conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		return true
+	})
+	return p
+}
+
+func roundTrip(t *testing.T, d *Dialer, addr string) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		t.Fatalf("DialContext() error = %v", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("ping\n")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || line != "ping\n" {
+		t.Fatalf("echo = %q, %v", line, err)
+	}
+}
+
+func TestSOCKS5hLetsProxyResolve(t *testing.T) {
+	p := startSOCKS5(t, startEcho(t))
+	// Bootstrap servers that cannot answer: any lookup would fail the dial.
+	r := bootstrap.New([]string{"127.0.0.1:1"}, 200*time.Millisecond)
+	d, err := New("socks5h://"+p.addr, r, time.Second)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	roundTrip(t, d, "doh.example:443")
+	if got := p.lastTarget(); got != "doh.example:443" {
+		t.Fatalf("proxy was asked for %q, want the hostname", got)
+	}
+}
+
+func TestSOCKS5ResolvesLocally(t *testing.T) {
+	p := startSOCKS5(t, startEcho(t))
+	r := bootstrap.New(nil, time.Second)
+	if err := r.Pin("doh.example", []string{"192.0.2.7"}); err != nil {
+		t.Fatalf("Pin() error = %v", err)
+	}
+	d, err := New("socks5://"+p.addr, r, time.Second)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	roundTrip(t, d, "doh.example:443")
+	if got := p.lastTarget(); got != "192.0.2.7:443" {
+		t.Fatalf("proxy was asked for %q, want the resolved address", got)
+	}
+}
+
+func TestHTTPConnect(t *testing.T) {
+	p := startConnect(t, startEcho(t))
+	d, err := New("http://user:pass@"+p.addr, nil, time.Second)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	roundTrip(t, d, "doh.example:443")
+	if got := p.lastTarget(); got != "doh.example:443" {
+		t.Fatalf("proxy was asked for %q", got)
+	}
+
+	d, _ = New("http://"+p.addr, nil, time.Second)
+	if _, err := d.DialContext(context.Background(), "tcp", "doh.example:443"); err == nil {
+		t.Fatalf("expected an error when the proxy refuses the tunnel")
+	}
+}
+
+func TestNewRejectsUnknownScheme(t *testing.T) {
+	if _, err := New("ftp://127.0.0.1:21", nil, time.Second); err == nil {
+		t.Fatalf("expected an error for an unsupported proxy scheme")
+	}
+}
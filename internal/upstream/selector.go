@@ -0,0 +1,460 @@
+package upstream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Strategy decides how a Selector distributes queries across upstreams.
+type Strategy string
+
+const (
+	// StrategyOrder tries upstreams in configuration order.
+	StrategyOrder Strategy = "order"
+	// StrategyRoundRobin rotates the first upstream tried on every query.
+	StrategyRoundRobin Strategy = "round_robin"
+	// StrategyWeighted picks the first upstream at random, proportional to its weight.
+	StrategyWeighted Strategy = "weighted"
+	// StrategyFastest tries upstreams by ascending average latency.
+	StrategyFastest Strategy = "fastest"
+	// StrategyRace sends the query to several upstreams at once and keeps the first good answer.
+	StrategyRace Strategy = "race"
+)
+
+// ewmaWeight is the share a new latency sample contributes to the moving average.
+const ewmaWeight = 0.3
+
+// failurePenalty is added to the latency sample of a failed query so that
+// StrategyFastest moves away from upstreams that error quickly.
+const failurePenalty = time.Second
+
+// latencySamples is how many recent answer times are kept per upstream to
+// estimate the p95 latency used for hedging.
+const latencySamples = 64
+
+// minHedgeSamples is the number of answers needed before an upstream's p95
+// latency is trusted for hedging.
+const minHedgeSamples = 10
+
+// Candidate is an upstream together with its selection weight.
+type Candidate struct {
+	Upstream Upstream
+	Weight   int
+	// Timeout bounds a single query to this upstream; zero means no limit
+	// beyond the caller's context.
+	Timeout time.Duration
+}
+
+// Stat reports per-upstream counters.
+type Stat struct {
+	Name     string
+	Queries  uint64
+	Failures uint64
+	Wins     uint64
+	Latency  time.Duration
+	// P95 is the 95th percentile of recent answer times.
+	P95 time.Duration
+	// Circuit is the circuit breaker state and ConsecutiveFailures the
+	// current run of failed queries and probes.
+	Circuit             CircuitState
+	ConsecutiveFailures int
+}
+
+// Selector sends queries to a set of upstreams following a Strategy.
+// Failed upstreams (transport errors or SERVFAIL) are skipped in favor of the
+// remaining ones, and with EnableHealth upstreams whose circuit is open are
+// not tried at all.
+type Selector struct {
+	strategy Strategy
+	members  []*member
+	raceSize int
+	next     uint32
+
+	rndMu sync.Mutex
+	rnd   *rand.Rand
+
+	health     HealthOptions
+	stopProbes context.CancelFunc
+	probes     sync.WaitGroup
+	hedge      bool
+}
+
+type member struct {
+	sel     *Selector
+	up      Upstream
+	weight  int
+	timeout time.Duration
+
+	mu       sync.Mutex
+	ewma     time.Duration
+	queries  uint64
+	failures uint64
+	wins     uint64
+	breaker  breaker
+	samples  [latencySamples]time.Duration
+	sampled  int
+}
+
+// NewSelector builds a Selector. race is the number of upstreams queried in
+// parallel by StrategyRace; unknown strategies behave like StrategyOrder.
+func NewSelector(strategy Strategy, candidates []Candidate, race int) *Selector {
+	s := &Selector{
+		strategy: strategy,
+		raceSize: race,
+		rnd:      rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	if s.raceSize < 2 {
+		s.raceSize = 2
+	}
+	for _, c := range candidates {
+		w := c.Weight
+		if w < 1 {
+			w = 1
+		}
+		s.members = append(s.members, &member{sel: s, up: c.Upstream, weight: w, timeout: c.Timeout})
+	}
+	return s
+}
+
+// Query forwards msg according to the strategy and returns the first good
+// answer along with the upstream that produced it.
+func (s *Selector) Query(ctx context.Context, msg *dns.Msg) (*dns.Msg, Upstream, error) {
+	if len(s.members) == 0 {
+		return nil, nil, errors.New("no upstreams configured")
+	}
+
+	order := s.available(s.order())
+	if len(order) == 0 {
+		return nil, nil, ErrNoHealthyUpstream
+	}
+	if s.strategy == StrategyRace {
+		n := s.raceSize
+		if n > len(order) {
+			n = len(order)
+		}
+		resp, m, err := s.race(ctx, msg, order[:n])
+		if err == nil || ctx.Err() != nil || n == len(order) {
+			return resp, upstreamOf(m), err
+		}
+		resp, m, err2 := s.sequential(ctx, msg, order[n:])
+		if err2 != nil {
+			err2 = errors.Join(err, err2)
+		}
+		return resp, upstreamOf(m), err2
+	}
+
+	if s.hedge {
+		resp, m, err := s.hedged(ctx, msg, order)
+		return resp, upstreamOf(m), err
+	}
+	resp, m, err := s.sequential(ctx, msg, order)
+	return resp, upstreamOf(m), err
+}
+
+// EnableHedging makes the order, round_robin, weighted and fastest strategies
+// send the query to the next upstream as well (or again, when there is only
+// one) when the current one has not answered within its p95 latency; the
+// first good answer wins. It must be called before the selector is used.
+func (s *Selector) EnableHedging() {
+	s.hedge = true
+}
+
+// Stats returns a snapshot of the per-upstream counters in configuration order.
+func (s *Selector) Stats() []Stat {
+	out := make([]Stat, 0, len(s.members))
+	for _, m := range s.members {
+		m.mu.Lock()
+		out = append(out, Stat{
+			Name:                m.up.String(),
+			Queries:             m.queries,
+			Failures:            m.failures,
+			Wins:                m.wins,
+			Latency:             m.ewma,
+			P95:                 m.p95Locked(),
+			Circuit:             m.breaker.state,
+			ConsecutiveFailures: m.breaker.failures,
+		})
+		m.mu.Unlock()
+	}
+	return out
+}
+
+// Close stops health probes and closes every upstream owned by the selector.
+func (s *Selector) Close() error {
+	if s.stopProbes != nil {
+		s.stopProbes()
+		s.probes.Wait()
+	}
+	var errs []error
+	for _, m := range s.members {
+		if err := m.up.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", m.up, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// order returns the members in the sequence they should be tried.
+func (s *Selector) order() []*member {
+	n := len(s.members)
+	out := make([]*member, n)
+	copy(out, s.members)
+
+	switch s.strategy {
+	case StrategyRoundRobin:
+		start := int(atomic.AddUint32(&s.next, 1)-1) % n
+		for i := range out {
+			out[i] = s.members[(start+i)%n]
+		}
+	case StrategyWeighted:
+		first := s.pickWeighted()
+		out[0], out[first] = out[first], out[0]
+	case StrategyFastest, StrategyRace:
+		latency := make(map[*member]time.Duration, len(out))
+		for _, m := range out {
+			latency[m] = m.latency()
+		}
+		sort.SliceStable(out, func(i, j int) bool {
+			return latency[out[i]] < latency[out[j]]
+		})
+	}
+	return out
+}
+
+func (s *Selector) pickWeighted() int {
+	total := 0
+	for _, m := range s.members {
+		total += m.weight
+	}
+
+	s.rndMu.Lock()
+	n := s.rnd.Intn(total)
+	s.rndMu.Unlock()
+
+	for i, m := range s.members {
+		if n < m.weight {
+			return i
+		}
+		n -= m.weight
+	}
+	return 0
+}
+
+func (s *Selector) sequential(ctx context.Context, msg *dns.Msg, members []*member) (*dns.Msg, *member, error) {
+	var errs []error
+	for _, m := range members {
+		resp, err := m.query(ctx, msg)
+		if err == nil {
+			m.win()
+			return resp, m, nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", m.up, err))
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, nil, errors.Join(errs...)
+}
+
+// hedged tries members in order like sequential, but starts the next member
+// early when the current one is slower than its p95 latency. A lone member
+// is hedged by sending it the query a second time.
+func (s *Selector) hedged(ctx context.Context, msg *dns.Msg, members []*member) (*dns.Msg, *member, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		resp *dns.Msg
+		m    *member
+		err  error
+	}
+	// sends is the number of queries hedging may start: one per member, or
+	// two for a single member.
+	sends := len(members)
+	if sends == 1 {
+		sends = 2
+	}
+	results := make(chan result, sends)
+	next, inflight := 0, 0
+	launch := func() {
+		m := members[next%len(members)]
+		next++
+		inflight++
+		go func() {
+			resp, err := m.query(ctx, msg.Copy())
+			results <- result{resp: resp, m: m, err: err}
+		}()
+	}
+
+	var errs []error
+	launch()
+	for inflight > 0 {
+		var (
+			timer *time.Timer
+			hedge <-chan time.Time
+		)
+		if next < sends {
+			if d := members[(next-1)%len(members)].p95(); d > 0 {
+				timer = time.NewTimer(d)
+				hedge = timer.C
+			}
+		}
+
+		select {
+		case r := <-results:
+			inflight--
+			if r.err == nil {
+				r.m.win()
+				return r.resp, r.m, nil
+			}
+			errs = append(errs, fmt.Errorf("%s: %w", r.m.up, r.err))
+			if ctx.Err() != nil {
+				return nil, nil, errors.Join(errs...)
+			}
+			if inflight == 0 && next < len(members) {
+				launch()
+			}
+		case <-hedge:
+			launch()
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+	return nil, nil, errors.Join(errs...)
+}
+
+func (s *Selector) race(ctx context.Context, msg *dns.Msg, members []*member) (*dns.Msg, *member, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		resp *dns.Msg
+		m    *member
+		err  error
+	}
+	results := make(chan result, len(members))
+	for _, m := range members {
+		go func(m *member) {
+			resp, err := m.query(ctx, msg.Copy())
+			results <- result{resp: resp, m: m, err: err}
+		}(m)
+	}
+
+	var errs []error
+	for range members {
+		r := <-results
+		if r.err == nil {
+			r.m.win()
+			return r.resp, r.m, nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", r.m.up, r.err))
+	}
+	return nil, nil, errors.Join(errs...)
+}
+
+func (m *member) query(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	if m.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, m.timeout)
+		defer cancel()
+	}
+	return m.exchange(ctx, msg, false)
+}
+
+// exchange sends msg and records the outcome. Probes feed the latency average
+// and the circuit breaker but not the query counters.
+func (m *member) exchange(ctx context.Context, msg *dns.Msg, probe bool) (*dns.Msg, error) {
+	start := time.Now()
+	resp, err := m.up.Query(ctx, msg)
+	if err == nil && resp.Rcode == dns.RcodeServerFailure {
+		err = errors.New("SERVFAIL")
+	}
+
+	elapsed := time.Since(start)
+	// A query cancelled because another racer already won says nothing about this upstream.
+	if err != nil && errors.Is(ctx.Err(), context.Canceled) {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	if !probe {
+		m.queries++
+		if err != nil {
+			m.failures++
+		}
+	}
+	if err != nil {
+		elapsed += failurePenalty
+	} else {
+		m.samples[m.sampled%latencySamples] = elapsed
+		m.sampled++
+	}
+	if m.ewma == 0 {
+		m.ewma = elapsed
+	} else {
+		m.ewma = time.Duration(ewmaWeight*float64(elapsed) + (1-ewmaWeight)*float64(m.ewma))
+	}
+	from, wasDown := m.breaker.state, m.breaker.down
+	m.breaker.record(&m.sel.health, err == nil, len(m.sel.members) < 2, time.Now())
+	to, down, failures := m.breaker.state, m.breaker.down, m.breaker.failures
+	m.mu.Unlock()
+	m.sel.notify(m, from, to, failures)
+	if down != wasDown && m.sel.health.OnHealth != nil {
+		m.sel.health.OnHealth(m.up.String(), !down, failures)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (m *member) win() {
+	m.mu.Lock()
+	m.wins++
+	m.mu.Unlock()
+}
+
+func (m *member) latency() time.Duration {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.ewma
+}
+
+// p95 returns the 95th percentile of recent answer times, or zero while
+// there are too few samples.
+func (m *member) p95() time.Duration {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.p95Locked()
+}
+
+func (m *member) p95Locked() time.Duration {
+	n := m.sampled
+	if n > latencySamples {
+		n = latencySamples
+	}
+	if n < minHedgeSamples {
+		return 0
+	}
+	sorted := make([]time.Duration, n)
+	copy(sorted, m.samples[:n])
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted[(n*95+99)/100-1]
+}
+
+func upstreamOf(m *member) Upstream {
+	if m == nil {
+		return nil
+	}
+	return m.up
+}
@@ -0,0 +1,257 @@
+package upstream
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// fakeUpstream answers after delay, or fails when err is set.
+type fakeUpstream struct {
+	name  string
+	delay time.Duration
+	err   error
+	calls int32
+}
+
+func (f *fakeUpstream) Query(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	atomic.AddInt32(&f.calls, 1)
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-time.After(f.delay):
+	}
+	if f.err != nil {
+		return nil, f.err
+	}
+	resp := new(dns.Msg)
+	resp.SetReply(msg)
+	return resp, nil
+}
+
+func (f *fakeUpstream) String() string { return f.name }
+
+func (f *fakeUpstream) Close() error { return nil }
+
+func newQuery() *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeA)
+	return m
+}
+
+func candidates(ups ...*fakeUpstream) []Candidate {
+	out := make([]Candidate, 0, len(ups))
+	for _, u := range ups {
+		out = append(out, Candidate{Upstream: u})
+	}
+	return out
+}
+
+func TestSelectorOrderFailsOver(t *testing.T) {
+	a := &fakeUpstream{name: "a", err: errors.New("down")}
+	b := &fakeUpstream{name: "b"}
+	s := NewSelector(StrategyOrder, candidates(a, b), 0)
+
+	_, up, err := s.Query(context.Background(), newQuery())
+	if err != nil {
+		t.Fatalf("Query() error = %v", err)
+	}
+	if up != b {
+		t.Fatalf("expected answer from b, got %v", up)
+	}
+	stats := s.Stats()
+	if stats[0].Failures != 1 || stats[1].Wins != 1 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestSelectorRoundRobinRotates(t *testing.T) {
+	a := &fakeUpstream{name: "a"}
+	b := &fakeUpstream{name: "b"}
+	c := &fakeUpstream{name: "c"}
+	s := NewSelector(StrategyRoundRobin, candidates(a, b, c), 0)
+
+	for i := 0; i < 6; i++ {
+		if _, _, err := s.Query(context.Background(), newQuery()); err != nil {
+			t.Fatalf("Query() error = %v", err)
+		}
+	}
+	for _, u := range []*fakeUpstream{a, b, c} {
+		if got := atomic.LoadInt32(&u.calls); got != 2 {
+			t.Fatalf("%s: expected 2 calls, got %d", u.name, got)
+		}
+	}
+}
+
+func TestSelectorWeightedHonorsWeights(t *testing.T) {
+	heavy := &fakeUpstream{name: "heavy"}
+	light := &fakeUpstream{name: "light"}
+	s := NewSelector(StrategyWeighted, []Candidate{
+		{Upstream: heavy, Weight: 9},
+		{Upstream: light, Weight: 1},
+	}, 0)
+
+	for i := 0; i < 200; i++ {
+		if _, _, err := s.Query(context.Background(), newQuery()); err != nil {
+			t.Fatalf("Query() error = %v", err)
+		}
+	}
+	if h, l := atomic.LoadInt32(&heavy.calls), atomic.LoadInt32(&light.calls); h <= l*3 {
+		t.Fatalf("expected heavy upstream to dominate, got heavy=%d light=%d", h, l)
+	}
+}
+
+func TestSelectorFastestPrefersLowLatency(t *testing.T) {
+	slow := &fakeUpstream{name: "slow", delay: 20 * time.Millisecond}
+	fast := &fakeUpstream{name: "fast"}
+	s := NewSelector(StrategyFastest, candidates(slow, fast), 0)
+
+	// The first query measures slow; fast is then tried first while unmeasured.
+	if _, _, err := s.Query(context.Background(), newQuery()); err != nil {
+		t.Fatalf("Query() error = %v", err)
+	}
+	for i := 0; i < 5; i++ {
+		_, up, err := s.Query(context.Background(), newQuery())
+		if err != nil {
+			t.Fatalf("Query() error = %v", err)
+		}
+		if up != fast {
+			t.Fatalf("query %d: expected fast upstream, got %v", i, up)
+		}
+	}
+	if got := atomic.LoadInt32(&slow.calls); got != 1 {
+		t.Fatalf("expected slow upstream to be used once, got %d", got)
+	}
+}
+
+func TestSelectorRaceTakesFirstGoodAnswer(t *testing.T) {
+	slow := &fakeUpstream{name: "slow", delay: time.Second}
+	broken := &fakeUpstream{name: "broken", err: errors.New("down")}
+	fast := &fakeUpstream{name: "fast", delay: 5 * time.Millisecond}
+	s := NewSelector(StrategyRace, candidates(slow, broken, fast), 3)
+
+	start := time.Now()
+	_, up, err := s.Query(context.Background(), newQuery())
+	if err != nil {
+		t.Fatalf("Query() error = %v", err)
+	}
+	if up != fast {
+		t.Fatalf("expected fast upstream to win, got %v", up)
+	}
+	if time.Since(start) > 500*time.Millisecond {
+		t.Fatalf("race waited for the slow upstream")
+	}
+	for _, st := range s.Stats() {
+		if st.Name == "slow" && st.Failures != 0 {
+			t.Fatalf("cancelled racer should not count as a failure: %+v", st)
+		}
+	}
+}
+
+func TestSelectorAttemptTimeout(t *testing.T) {
+	slow := &fakeUpstream{name: "slow", delay: time.Second}
+	fast := &fakeUpstream{name: "fast"}
+	s := NewSelector(StrategyOrder, []Candidate{
+		{Upstream: slow, Timeout: 20 * time.Millisecond},
+		{Upstream: fast},
+	}, 0)
+
+	start := time.Now()
+	_, up, err := s.Query(context.Background(), newQuery())
+	if err != nil {
+		t.Fatalf("Query() error = %v", err)
+	}
+	if up != fast {
+		t.Fatalf("expected answer from fast, got %v", up)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("slow attempt was not cut short, took %v", elapsed)
+	}
+}
+
+// stallingUpstream answers after a short delay; while stall is set every
+// odd-numbered query hangs until canceled, like a lost packet.
+type stallingUpstream struct {
+	stall int32
+	calls int32
+}
+
+func (f *stallingUpstream) Query(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	n := atomic.AddInt32(&f.calls, 1)
+	if atomic.LoadInt32(&f.stall) != 0 && n%2 == 1 {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	time.Sleep(2 * time.Millisecond)
+	resp := new(dns.Msg)
+	resp.SetReply(msg)
+	return resp, nil
+}
+
+func (f *stallingUpstream) String() string { return "stalling" }
+
+func (f *stallingUpstream) Close() error { return nil }
+
+func TestSelectorHedgesSingleUpstream(t *testing.T) {
+	f := &stallingUpstream{}
+	s := NewSelector(StrategyOrder, []Candidate{{Upstream: f}}, 0)
+	s.EnableHedging()
+
+	for i := 0; i < minHedgeSamples; i++ {
+		if _, _, err := s.Query(context.Background(), newQuery()); err != nil {
+			t.Fatalf("warm-up query %d: %v", i, err)
+		}
+	}
+
+	atomic.StoreInt32(&f.calls, 0)
+	atomic.StoreInt32(&f.stall, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	start := time.Now()
+	if _, _, err := s.Query(ctx, newQuery()); err != nil {
+		t.Fatalf("expected the re-sent query to answer, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("hedge did not fire early, took %v", elapsed)
+	}
+	if got := atomic.LoadInt32(&f.calls); got != 2 {
+		t.Fatalf("expected the query to be sent twice, got %d", got)
+	}
+}
+
+func TestSelectorHedgesAfterP95(t *testing.T) {
+	a := &fakeUpstream{name: "a", delay: 5 * time.Millisecond}
+	b := &fakeUpstream{name: "b"}
+	s := NewSelector(StrategyOrder, candidates(a, b), 0)
+	s.EnableHedging()
+
+	// Warm up a's latency history, then make it stall.
+	for i := 0; i < minHedgeSamples; i++ {
+		if _, up, err := s.Query(context.Background(), newQuery()); err != nil || up != a {
+			t.Fatalf("warm-up query %d: up=%v err=%v", i, up, err)
+		}
+	}
+	if atomic.LoadInt32(&b.calls) != 0 {
+		t.Fatalf("b must not be queried while a answers within its p95")
+	}
+	if s.Stats()[0].P95 == 0 {
+		t.Fatalf("expected a p95 latency for a")
+	}
+
+	a.delay = time.Second
+	start := time.Now()
+	_, up, err := s.Query(context.Background(), newQuery())
+	if err != nil {
+		t.Fatalf("Query() error = %v", err)
+	}
+	if up != b {
+		t.Fatalf("expected the hedged request to b to win, got %v", up)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("hedge did not fire early, took %v", elapsed)
+	}
+}
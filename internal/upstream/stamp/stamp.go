@@ -0,0 +1,266 @@
+package stamp
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Proto identifies the protocol described by a stamp.
+type Proto byte
+
+const (
+	ProtoPlain      Proto = 0x00
+	ProtoDNSCrypt   Proto = 0x01
+	ProtoDoH        Proto = 0x02
+	ProtoDoT        Proto = 0x03
+	ProtoDoQ        Proto = 0x04
+	ProtoODoHTarget Proto = 0x05
+)
+
+func (p Proto) String() string {
+	switch p {
+	case ProtoPlain:
+		return "plain"
+	case ProtoDNSCrypt:
+		return "dnscrypt"
+	case ProtoDoH:
+		return "doh"
+	case ProtoDoT:
+		return "dot"
+	case ProtoDoQ:
+		return "doq"
+	case ProtoODoHTarget:
+		return "odoh-target"
+	default:
+		return fmt.Sprintf("proto(0x%02x)", byte(p))
+	}
+}
+
+// Stamp is a decoded DNS stamp (https://dnscrypt.info/stamps-specifications).
+type Stamp struct {
+	Proto Proto
+	// Props holds the informal properties bitmask (DNSSEC, no logs, no filter).
+	Props uint64
+	// Addr is the server IP with an optional port. It may be empty for DoH/DoT/DoQ.
+	Addr string
+	// PublicKey is the DNSCrypt provider's Ed25519 public key.
+	PublicKey []byte
+	// ProviderName is the DNSCrypt provider name, or the DoH/DoT/DoQ host name.
+	ProviderName string
+	// Hashes are SHA-256 digests of certificates in the server's chain.
+	Hashes [][]byte
+	// Path is the DoH request path.
+	Path string
+	// BootstrapIPs are resolvers suggested for resolving ProviderName.
+	BootstrapIPs []string
+}
+
+const prefix = "sdns://"
+
+// Parse decodes an sdns:// stamp.
+func Parse(s string) (Stamp, error) {
+	if !strings.HasPrefix(s, prefix) {
+		return Stamp{}, fmt.Errorf("stamp must start with %s", prefix)
+	}
+	bin, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s[len(prefix):], "="))
+	if err != nil {
+		return Stamp{}, fmt.Errorf("decode stamp: %w", err)
+	}
+	if len(bin) == 0 {
+		return Stamp{}, errors.New("empty stamp")
+	}
+
+	var st Stamp
+	r := &reader{buf: bin[1:]}
+	st.Proto = Proto(bin[0])
+
+	switch st.Proto {
+	case ProtoPlain:
+		st.Props = r.props()
+		st.Addr = string(r.lp())
+	case ProtoDNSCrypt:
+		st.Props = r.props()
+		st.Addr = string(r.lp())
+		st.PublicKey = r.lp()
+		st.ProviderName = string(r.lp())
+		if r.err == nil && len(st.PublicKey) != 32 {
+			return Stamp{}, fmt.Errorf("dnscrypt stamp public key must be 32 bytes, got %d", len(st.PublicKey))
+		}
+	case ProtoDoH:
+		st.Props = r.props()
+		st.Addr = string(r.lp())
+		st.Hashes = r.vlp()
+		st.ProviderName = string(r.lp())
+		st.Path = string(r.lp())
+		st.BootstrapIPs = r.optionalStrings()
+	case ProtoDoT, ProtoDoQ:
+		st.Props = r.props()
+		st.Addr = string(r.lp())
+		st.Hashes = r.vlp()
+		st.ProviderName = string(r.lp())
+		st.BootstrapIPs = r.optionalStrings()
+	case ProtoODoHTarget:
+		st.Props = r.props()
+		st.ProviderName = string(r.lp())
+		st.Path = string(r.lp())
+	default:
+		return Stamp{}, fmt.Errorf("unsupported stamp protocol %s", st.Proto)
+	}
+
+	if r.err != nil {
+		return Stamp{}, fmt.Errorf("decode %s stamp: %w", st.Proto, r.err)
+	}
+	if len(r.buf) != 0 {
+		return Stamp{}, fmt.Errorf("decode %s stamp: %d trailing bytes", st.Proto, len(r.buf))
+	}
+	return st, nil
+}
+
+// String encodes the stamp back into its sdns:// form.
+func (st Stamp) String() string {
+	w := &writer{}
+	w.buf = append(w.buf, byte(st.Proto))
+
+	switch st.Proto {
+	case ProtoPlain:
+		w.props(st.Props)
+		w.lp([]byte(st.Addr))
+	case ProtoDNSCrypt:
+		w.props(st.Props)
+		w.lp([]byte(st.Addr))
+		w.lp(st.PublicKey)
+		w.lp([]byte(st.ProviderName))
+	case ProtoDoH:
+		w.props(st.Props)
+		w.lp([]byte(st.Addr))
+		w.vlp(st.Hashes)
+		w.lp([]byte(st.ProviderName))
+		w.lp([]byte(st.Path))
+		w.strings(st.BootstrapIPs)
+	case ProtoDoT, ProtoDoQ:
+		w.props(st.Props)
+		w.lp([]byte(st.Addr))
+		w.vlp(st.Hashes)
+		w.lp([]byte(st.ProviderName))
+		w.strings(st.BootstrapIPs)
+	case ProtoODoHTarget:
+		w.props(st.Props)
+		w.lp([]byte(st.ProviderName))
+		w.lp([]byte(st.Path))
+	}
+	return prefix + base64.RawURLEncoding.EncodeToString(w.buf)
+}
+
+var errShort = errors.New("stamp is truncated")
+
+type reader struct {
+	buf []byte
+	err error
+}
+
+func (r *reader) props() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	if len(r.buf) < 8 {
+		r.err = errShort
+		return 0
+	}
+	v := binary.LittleEndian.Uint64(r.buf)
+	r.buf = r.buf[8:]
+	return v
+}
+
+// lp reads a length-prefixed byte string.
+func (r *reader) lp() []byte {
+	if r.err != nil {
+		return nil
+	}
+	if len(r.buf) < 1 || len(r.buf) < 1+int(r.buf[0]) {
+		r.err = errShort
+		return nil
+	}
+	n := int(r.buf[0])
+	out := r.buf[1 : 1+n]
+	r.buf = r.buf[1+n:]
+	return out
+}
+
+// vlp reads a variable-length set of byte strings; the high bit of each
+// length byte signals that another element follows.
+func (r *reader) vlp() [][]byte {
+	var out [][]byte
+	for r.err == nil {
+		if len(r.buf) < 1 {
+			r.err = errShort
+			return nil
+		}
+		more := r.buf[0]&0x80 != 0
+		n := int(r.buf[0] &^ 0x80)
+		if len(r.buf) < 1+n {
+			r.err = errShort
+			return nil
+		}
+		if n > 0 {
+			out = append(out, r.buf[1:1+n])
+		}
+		r.buf = r.buf[1+n:]
+		if !more {
+			break
+		}
+	}
+	return out
+}
+
+func (r *reader) optionalStrings() []string {
+	if r.err != nil || len(r.buf) == 0 {
+		return nil
+	}
+	var out []string
+	for _, b := range r.vlp() {
+		out = append(out, string(b))
+	}
+	return out
+}
+
+type writer struct {
+	buf []byte
+}
+
+func (w *writer) props(v uint64) {
+	w.buf = binary.LittleEndian.AppendUint64(w.buf, v)
+}
+
+func (w *writer) lp(b []byte) {
+	w.buf = append(w.buf, byte(len(b)))
+	w.buf = append(w.buf, b...)
+}
+
+func (w *writer) vlp(items [][]byte) {
+	if len(items) == 0 {
+		w.buf = append(w.buf, 0)
+		return
+	}
+	for i, b := range items {
+		n := byte(len(b))
+		if i < len(items)-1 {
+			n |= 0x80
+		}
+		w.buf = append(w.buf, n)
+		w.buf = append(w.buf, b...)
+	}
+}
+
+func (w *writer) strings(items []string) {
+	if len(items) == 0 {
+		return
+	}
+	bs := make([][]byte, 0, len(items))
+	for _, s := range items {
+		bs = append(bs, []byte(s))
+	}
+	w.vlp(bs)
+}
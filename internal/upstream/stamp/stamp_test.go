@@ -0,0 +1,151 @@
+package stamp
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ogpourya/dnsbro/internal/upstream"
+	_ "github.com/ogpourya/dnsbro/internal/upstream/doh"
+	_ "github.com/ogpourya/dnsbro/internal/upstream/dot"
+	"github.com/ogpourya/dnsbro/internal/upstream/testcert"
+
+	"github.com/miekg/dns"
+)
+
+func TestParseDoHStamp(t *testing.T) {
+	st, err := Parse("sdns://AgcAAAAAAAAABzEuMC4wLjEAEmRucy5jbG91ZGZsYXJlLmNvbQovZG5zLXF1ZXJ5")
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	if st.Proto != ProtoDoH || st.Addr != "1.0.0.1" || st.ProviderName != "dns.cloudflare.com" || st.Path != "/dns-query" {
+		t.Fatalf("unexpected stamp %+v", st)
+	}
+	if st.Props != 7 {
+		t.Fatalf("expected props 7, got %d", st.Props)
+	}
+}
+
+func TestStampRoundTrip(t *testing.T) {
+	want := Stamp{
+		Proto:        ProtoDNSCrypt,
+		Props:        1,
+		Addr:         "208.67.220.220:443",
+		PublicKey:    bytes.Repeat([]byte{0xab}, 32),
+		ProviderName: "2.dnscrypt-cert.opendns.com",
+	}
+	got, err := Parse(want.String())
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	if got.Proto != want.Proto || got.Addr != want.Addr || got.ProviderName != want.ProviderName || !bytes.Equal(got.PublicKey, want.PublicKey) {
+		t.Fatalf("round trip mismatch: got %+v want %+v", got, want)
+	}
+
+	dot := Stamp{Proto: ProtoDoT, Addr: "9.9.9.9", Hashes: [][]byte{{1, 2, 3}}, ProviderName: "dns.quad9.net", BootstrapIPs: []string{"9.9.9.10"}}
+	got, err = Parse(dot.String())
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	if got.ProviderName != dot.ProviderName || len(got.Hashes) != 1 || len(got.BootstrapIPs) != 1 || got.BootstrapIPs[0] != "9.9.9.10" {
+		t.Fatalf("round trip mismatch: got %+v", got)
+	}
+}
+
+func TestParseRejectsMalformed(t *testing.T) {
+	for _, s := range []string{
+		"https://dns.example",
+		"sdns://",
+		"sdns://AQ",           // dnscrypt stamp cut short
+		"sdns://AgcAAAAAAAAA", // doh stamp without address
+	} {
+		if _, err := Parse(s); err == nil {
+			t.Fatalf("Parse(%q) expected error", s)
+		}
+	}
+}
+
+func TestNewUpstreamFromStamps(t *testing.T) {
+	dnscrypt := Stamp{
+		Proto:        ProtoDNSCrypt,
+		Addr:         "208.67.220.220",
+		PublicKey:    bytes.Repeat([]byte{0xab}, 32),
+		ProviderName: "2.dnscrypt-cert.opendns.com",
+	}
+	dot := Stamp{Proto: ProtoDoT, Addr: "9.9.9.9", ProviderName: "dns.quad9.net"}
+
+	for _, tt := range []struct {
+		stamp string
+		want  string
+	}{
+		{"sdns://AgcAAAAAAAAABzEuMC4wLjEAEmRucy5jbG91ZGZsYXJlLmNvbQovZG5zLXF1ZXJ5", "https://dns.cloudflare.com/dns-query"},
+		{dnscrypt.String(), dnscrypt.String()},
+		{dot.String(), "tls://9.9.9.9:853"},
+	} {
+		up, err := upstream.New(tt.stamp, upstream.Options{Timeout: time.Second})
+		if err != nil {
+			t.Fatalf("New(%q) error = %v", tt.stamp, err)
+		}
+		if !strings.HasPrefix(up.String(), tt.want) {
+			t.Fatalf("New(%q) = %s, want %s", tt.stamp, up, tt.want)
+		}
+		_ = up.Close()
+	}
+}
+
+func TestStampHashesPinCertificate(t *testing.T) {
+	bundle := testcert.New(t, "dns.example")
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{bundle.Server}})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	srv := &dns.Server{Listener: ln, Net: "tcp-tls", Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		_ = w.WriteMsg(resp)
+	})}
+	go func() { _ = srv.ActivateAndServe() }()
+	t.Cleanup(func() { _ = srv.Shutdown() })
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: bundle.Server.Certificate[1]})
+	if err := os.WriteFile(caFile, ca, 0o644); err != nil {
+		t.Fatalf("write ca: %v", err)
+	}
+	caCert, _ := x509.ParseCertificate(bundle.Server.Certificate[1])
+	good := sha256.Sum256(caCert.RawTBSCertificate)
+	bad := sha256.Sum256([]byte("another certificate"))
+
+	for _, tt := range []struct {
+		hash    []byte
+		wantErr error
+	}{
+		{good[:], nil},
+		{bad[:], upstream.ErrCertHashMismatch},
+	} {
+		st := Stamp{Proto: ProtoDoT, Addr: ln.Addr().String(), Hashes: [][]byte{tt.hash}, ProviderName: "dns.example"}
+		up, err := upstream.New(st.String(), upstream.Options{Timeout: time.Second, TLS: upstream.TLSOptions{CAFile: caFile}})
+		if err != nil {
+			t.Fatalf("New() error = %v", err)
+		}
+		msg := new(dns.Msg)
+		msg.SetQuestion("example.com.", dns.TypeA)
+		_, err = up.Query(context.Background(), msg)
+		_ = up.Close()
+		if tt.wantErr == nil && err != nil {
+			t.Fatalf("expected the hashed CA to match, got %v", err)
+		}
+		if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+			t.Fatalf("Query() error = %v, want %v", err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package stamp
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/ogpourya/dnsbro/internal/upstream"
+	"github.com/ogpourya/dnsbro/internal/upstream/dnscrypt"
+)
+
+func init() {
+	upstream.Register("sdns", newUpstream)
+}
+
+// newUpstream decodes an sdns:// endpoint. DNSCrypt stamps get a DNSCrypt
+// client; the other protocols are turned back into the equivalent URL and
+// built by their own transport. Certificate hashes in DoH, DoT and DoQ stamps
+// pin the server's verified chain.
+func newUpstream(u *url.URL, opts upstream.Options) (upstream.Upstream, error) {
+	st, err := Parse(u.String())
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.Proxy != "" && st.Proto != ProtoDoH && st.Proto != ProtoODoHTarget {
+		return nil, fmt.Errorf("%s stamps cannot be used with a proxy", st.Proto)
+	}
+	if len(st.Hashes) > 0 {
+		opts.TLS.CertHashes = append(append([][]byte(nil), opts.TLS.CertHashes...), st.Hashes...)
+	}
+
+	switch st.Proto {
+	case ProtoDNSCrypt:
+		if st.Addr == "" {
+			return nil, errors.New("dnscrypt stamp has no server address")
+		}
+		return dnscrypt.New(hostPort(st.Addr, "443"), st.ProviderName, ed25519.PublicKey(st.PublicKey), opts.Timeout, u.String()), nil
+	case ProtoDoH:
+		host := st.ProviderName
+		if host == "" {
+			host = st.Addr
+		}
+		path := st.Path
+		if path == "" {
+			path = "/dns-query"
+		}
+		// The stamp's address pins the provider name, so no bootstrap
+		// lookup is needed.
+		if ip := strings.Trim(hostOnly(st.Addr), "[]"); net.ParseIP(ip) != nil && len(opts.BootstrapIPs) == 0 {
+			opts.BootstrapIPs = []string{ip}
+		}
+		return upstream.New("https://"+host+path, opts)
+	case ProtoDoT, ProtoDoQ:
+		scheme := "tls"
+		if st.Proto == ProtoDoQ {
+			scheme = "quic"
+		}
+		// Prefer the stamp's address and verify the certificate against the
+		// provider name, so no bootstrap lookup is needed.
+		host := st.ProviderName
+		if st.Addr != "" {
+			host = hostPort(st.Addr, "853")
+			if opts.TLS.ServerName == "" {
+				opts.TLS.ServerName = hostOnly(st.ProviderName)
+			}
+		}
+		if host == "" {
+			return nil, fmt.Errorf("%s stamp has no server address", st.Proto)
+		}
+		return upstream.New(scheme+"://"+host, opts)
+	case ProtoODoHTarget:
+		if st.ProviderName == "" {
+			return nil, errors.New("odoh stamp has no target host")
+		}
+		return upstream.New("odoh://"+st.ProviderName+st.Path, opts)
+	case ProtoPlain:
+		if st.Addr == "" {
+			return nil, errors.New("plain stamp has no server address")
+		}
+		return upstream.New("udp://"+hostPort(st.Addr, "53"), opts)
+	default:
+		return nil, fmt.Errorf("%s stamps are not supported as upstreams", st.Proto)
+	}
+}
+
+// hostPort adds port to addr unless it already has one. IPv6 addresses in
+// stamps are bracketed.
+func hostPort(addr, port string) string {
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		return addr
+	}
+	if len(addr) > 1 && addr[0] == '[' && addr[len(addr)-1] == ']' {
+		addr = addr[1 : len(addr)-1]
+	}
+	return net.JoinHostPort(addr, port)
+}
+
+func hostOnly(name string) string {
+	if host, _, err := net.SplitHostPort(name); err == nil {
+		return host
+	}
+	return name
+}
@@ -0,0 +1,149 @@
+package upstream
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// ErrPinMismatch is returned by handshakes whose certificate chain matches
+// none of the configured SPKI pins.
+var ErrPinMismatch = errors.New("tls: no certificate matches the pinned SPKI hashes")
+
+// ErrCertHashMismatch is returned by handshakes whose certificate chain
+// includes none of the configured certificate hashes.
+var ErrCertHashMismatch = errors.New("tls: no certificate matches the pinned certificate hashes")
+
+// Apply configures cfg with o: the server name, trusted CAs, minimum version,
+// client certificate and the pin and certificate hash checks run on every
+// handshake.
+func (o TLSOptions) Apply(cfg *tls.Config) error {
+	if o.ServerName != "" {
+		cfg.ServerName = o.ServerName
+	}
+	if o.CAFile != "" {
+		pem, err := os.ReadFile(o.CAFile)
+		if err != nil {
+			return fmt.Errorf("read ca_file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("ca_file %s holds no PEM certificates", o.CAFile)
+		}
+		cfg.RootCAs = pool
+	}
+	if o.MinVersion != "" {
+		v, err := ParseTLSVersion(o.MinVersion)
+		if err != nil {
+			return err
+		}
+		cfg.MinVersion = v
+	}
+	if o.CertFile != "" || o.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return fmt.Errorf("load client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	pins := make([][]byte, 0, len(o.SPKIPins))
+	for _, p := range o.SPKIPins {
+		pin, err := ParseSPKIPin(p)
+		if err != nil {
+			return err
+		}
+		pins = append(pins, pin)
+	}
+	for _, h := range o.CertHashes {
+		if len(h) != sha256.Size {
+			return fmt.Errorf("invalid certificate hash %x: want a SHA-256 digest", h)
+		}
+	}
+	if len(pins) > 0 || len(o.CertHashes) > 0 {
+		hashes := o.CertHashes
+		cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+			if len(pins) > 0 {
+				if err := checkPins(cs.VerifiedChains, pins); err != nil {
+					return err
+				}
+			}
+			if len(hashes) > 0 {
+				return checkCertHashes(cs.VerifiedChains, hashes)
+			}
+			return nil
+		}
+	}
+	return nil
+}
+
+// checkPins accepts the connection if the public key of a certificate in one
+// of the verified chains hashes to one of pins. Extra certificates the server
+// sends outside the chain do not count, while a pinned root it does not send
+// does.
+func checkPins(chains [][]*x509.Certificate, pins [][]byte) error {
+	for _, chain := range chains {
+		for _, cert := range chain {
+			sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+			for _, pin := range pins {
+				if bytes.Equal(sum[:], pin) {
+					return nil
+				}
+			}
+		}
+	}
+	return ErrPinMismatch
+}
+
+// checkCertHashes accepts the connection if the SHA-256 of the to-be-signed
+// part of a certificate in one of the verified chains is one of hashes, the
+// way DNS stamps pin their servers.
+func checkCertHashes(chains [][]*x509.Certificate, hashes [][]byte) error {
+	for _, chain := range chains {
+		for _, cert := range chain {
+			sum := sha256.Sum256(cert.RawTBSCertificate)
+			for _, h := range hashes {
+				if bytes.Equal(sum[:], h) {
+					return nil
+				}
+			}
+		}
+	}
+	return ErrCertHashMismatch
+}
+
+// SPKIPin returns the pin of cert: the base64 SHA-256 of its
+// SubjectPublicKeyInfo, as printed by
+// openssl x509 -pubkey -noout | openssl pkey -pubin -outform der | openssl dgst -sha256 -binary | base64.
+func SPKIPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// ParseSPKIPin decodes a base64 SHA-256 SPKI pin.
+func ParseSPKIPin(s string) ([]byte, error) {
+	pin, err := base64.StdEncoding.DecodeString(s)
+	if err != nil || len(pin) != sha256.Size {
+		return nil, fmt.Errorf("invalid spki pin %q: want the base64 SHA-256 of a SubjectPublicKeyInfo", s)
+	}
+	return pin, nil
+}
+
+// ParseTLSVersion maps "1.0" to "1.3" to the crypto/tls version constants.
+func ParseTLSVersion(s string) (uint16, error) {
+	switch s {
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("unsupported tls version %q (want 1.0, 1.1, 1.2 or 1.3)", s)
+}
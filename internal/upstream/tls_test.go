@@ -0,0 +1,80 @@
+package upstream
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/ogpourya/dnsbro/internal/upstream/testcert"
+)
+
+// handshake connects a client configured with opts to a server presenting
+// server, returning the client's handshake error.
+func handshake(t *testing.T, opts TLSOptions, roots *x509.CertPool, server tls.Certificate) error {
+	t.Helper()
+	cfg := &tls.Config{ServerName: "dns.example", RootCAs: roots}
+	if err := opts.Apply(cfg); err != nil {
+		t.Fatalf("Apply() error = %v", err)
+	}
+	c, s := net.Pipe()
+	defer c.Close()
+	go func() {
+		defer s.Close()
+		_ = tls.Server(s, &tls.Config{Certificates: []tls.Certificate{server}}).Handshake()
+	}()
+	return tls.Client(c, cfg).Handshake()
+}
+
+func TestSPKIPinsCheckVerifiedChain(t *testing.T) {
+	trusted := testcert.New(t, "dns.example")
+	other := testcert.New(t, "dns.example")
+	trustedCA, _ := x509.ParseCertificate(trusted.Server.Certificate[1])
+	otherCA, _ := x509.ParseCertificate(other.Server.Certificate[1])
+
+	// The pinned CA is only appended as an extra certificate; the chain the
+	// client verifies runs to the other root.
+	appended := tls.Certificate{
+		Certificate: [][]byte{trusted.Server.Certificate[0], trusted.Server.Certificate[1], otherCA.Raw},
+		PrivateKey:  trusted.Server.PrivateKey,
+	}
+	err := handshake(t, TLSOptions{SPKIPins: []string{SPKIPin(otherCA)}}, trusted.Pool, appended)
+	if !errors.Is(err, ErrPinMismatch) {
+		t.Fatalf("expected ErrPinMismatch for a pin outside the verified chain, got %v", err)
+	}
+
+	// A pinned root the server does not send still matches.
+	leafOnly := tls.Certificate{
+		Certificate: [][]byte{trusted.Server.Certificate[0]},
+		PrivateKey:  trusted.Server.PrivateKey,
+	}
+	if err := handshake(t, TLSOptions{SPKIPins: []string{SPKIPin(trustedCA)}}, trusted.Pool, leafOnly); err != nil {
+		t.Fatalf("expected the unsent pinned root to match, got %v", err)
+	}
+}
+
+func TestCertHashesCheckVerifiedChain(t *testing.T) {
+	trusted := testcert.New(t, "dns.example")
+	other := testcert.New(t, "dns.example")
+	trustedCA, _ := x509.ParseCertificate(trusted.Server.Certificate[1])
+	otherCA, _ := x509.ParseCertificate(other.Server.Certificate[1])
+	tbsHash := func(cert *x509.Certificate) []byte {
+		sum := sha256.Sum256(cert.RawTBSCertificate)
+		return sum[:]
+	}
+
+	if err := handshake(t, TLSOptions{CertHashes: [][]byte{tbsHash(trustedCA)}}, trusted.Pool, trusted.Server); err != nil {
+		t.Fatalf("expected the hashed CA to match, got %v", err)
+	}
+
+	appended := tls.Certificate{
+		Certificate: [][]byte{trusted.Server.Certificate[0], trusted.Server.Certificate[1], otherCA.Raw},
+		PrivateKey:  trusted.Server.PrivateKey,
+	}
+	err := handshake(t, TLSOptions{CertHashes: [][]byte{tbsHash(otherCA)}}, trusted.Pool, appended)
+	if !errors.Is(err, ErrCertHashMismatch) {
+		t.Fatalf("expected ErrCertHashMismatch for a hash outside the verified chain, got %v", err)
+	}
+}
@@ -0,0 +1,108 @@
+package upstream
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Upstream is a resolver that queries can be forwarded to.
+type Upstream interface {
+	// Query sends msg and returns the response.
+	Query(ctx context.Context, msg *dns.Msg) (*dns.Msg, error)
+	// String returns the endpoint the upstream was built from.
+	String() string
+	// Close releases connections held by the upstream.
+	Close() error
+}
+
+// Options carries the settings of an upstream. Transports ignore fields
+// that do not apply to them.
+type Options struct {
+	Timeout   time.Duration
+	Bootstrap []string
+	// BootstrapIPs pins the endpoint's hostname to these addresses, so it is
+	// never looked up via the bootstrap servers.
+	BootstrapIPs []string
+	TLS          TLSOptions
+	// Method selects the DoH request method: "get" or "post" (default).
+	Method string
+	// Relay is the URL of the ODoH relay that oblivious queries are sent through.
+	Relay string
+	// Proxy is a socks5://, socks5h:// or http:// proxy that DoH and ODoH
+	// connections are dialed through.
+	Proxy string
+}
+
+// TLSOptions tunes the TLS session of encrypted transports.
+type TLSOptions struct {
+	// ServerName overrides the name sent in SNI and checked against the certificate.
+	ServerName string
+	// CAFile is a PEM bundle that replaces the system roots.
+	CAFile string
+	// SPKIPins are base64 SHA-256 hashes of SubjectPublicKeyInfo; when set,
+	// every handshake must present a certificate matching one of them.
+	SPKIPins []string
+	// CertHashes are SHA-256 digests of the to-be-signed part of
+	// certificates, as carried by DNS stamps; when set, the verified chain
+	// must include one of them.
+	CertHashes [][]byte
+	// MinVersion is the lowest accepted TLS version, "1.0" to "1.3".
+	MinVersion string
+	// CertFile and KeyFile hold a client certificate for mutual TLS.
+	CertFile string
+	KeyFile  string
+}
+
+// Factory builds an Upstream for an endpoint URL.
+type Factory func(u *url.URL, opts Options) (Upstream, error)
+
+var (
+	registryMu sync.RWMutex
+	registry   = map[string]Factory{}
+)
+
+// Register makes a transport available for endpoints using scheme. It is
+// meant to be called from the init function of a transport package.
+func Register(scheme string, f Factory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	registry[strings.ToLower(scheme)] = f
+}
+
+// New builds an Upstream for endpoint using the transport registered for its scheme.
+func New(endpoint string, opts Options) (Upstream, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("parse upstream %q: %w", endpoint, err)
+	}
+	if u.Scheme == "" {
+		return nil, fmt.Errorf("upstream %q has no scheme", endpoint)
+	}
+
+	registryMu.RLock()
+	f, ok := registry[strings.ToLower(u.Scheme)]
+	registryMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unsupported upstream scheme %q (supported: %s)", u.Scheme, strings.Join(Schemes(), ", "))
+	}
+	return f(u, opts)
+}
+
+// Schemes returns the registered schemes in sorted order.
+func Schemes() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	out := make([]string, 0, len(registry))
+	for s := range registry {
+		out = append(out, s)
+	}
+	sort.Strings(out)
+	return out
+}
@@ -0,0 +1,32 @@
+package upstream
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewUsesRegisteredScheme(t *testing.T) {
+	Register("fake", func(u *url.URL, opts Options) (Upstream, error) {
+		return &fakeUpstream{name: u.Host, delay: opts.Timeout}, nil
+	})
+
+	up, err := New("FAKE://resolver.test", Options{Timeout: time.Second})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	if up.String() != "resolver.test" {
+		t.Fatalf("unexpected upstream %q", up.String())
+	}
+}
+
+func TestNewRejectsUnknownScheme(t *testing.T) {
+	_, err := New("gopher://resolver.test", Options{})
+	if err == nil || !strings.Contains(err.Error(), `unsupported upstream scheme "gopher"`) {
+		t.Fatalf("expected unsupported scheme error, got %v", err)
+	}
+	if _, err := New("resolver.test", Options{}); err == nil {
+		t.Fatalf("expected error for endpoint without scheme")
+	}
+}
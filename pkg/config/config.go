@@ -1,11 +1,20 @@
 package config
 
 import (
+	"crypto/sha256"
+	"encoding/base64"
 	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
+	"github.com/ogpourya/dnsbro/internal/rules"
+
 	"gopkg.in/yaml.v3"
 )
 
@@ -16,17 +25,156 @@ type Config struct {
 		DoHEndpoint string        `yaml:"doh_endpoint"`
 		Timeout     time.Duration `yaml:"timeout"`
 		Bootstrap   []string      `yaml:"bootstrap"`
+		// BootstrapIPs pins the DoHEndpoint hostname to fixed addresses so
+		// no bootstrap lookup is sent.
+		BootstrapIPs []string `yaml:"bootstrap_ips,omitempty"`
+		// Servers lists upstreams in failover order. When empty, DoHEndpoint
+		// is used as the only upstream.
+		Servers []UpstreamServer `yaml:"servers,omitempty"`
+		// Strategy picks how queries are spread across Servers: order,
+		// round_robin, weighted, fastest or race.
+		Strategy string `yaml:"strategy,omitempty"`
+		// Race is how many upstreams the race strategy queries at once.
+		Race int `yaml:"race,omitempty"`
+		// Health probes every upstream with a canary query and skips those
+		// that fail Failures times in a row for Cooldown.
+		Health struct {
+			Interval time.Duration `yaml:"interval"`
+			Query    string        `yaml:"query"`
+			Failures int           `yaml:"failures"`
+			Cooldown time.Duration `yaml:"cooldown"`
+		} `yaml:"health"`
+		// Retry controls how a query is retried when every upstream fails.
+		Retry struct {
+			// Attempts is the number of passes over the upstreams.
+			Attempts int `yaml:"attempts"`
+			// AttemptTimeout bounds each query to a single upstream, so a hung
+			// one leaves time to retry. Servers that set their own timeout
+			// keep it; zero uses upstream.timeout.
+			AttemptTimeout time.Duration `yaml:"attempt_timeout"`
+			// Timeout bounds the whole query including retries; zero allows
+			// one full pass over the upstreams, but at least upstream.timeout.
+			Timeout time.Duration `yaml:"timeout"`
+			// Backoff is the pause before the first retry; it doubles for
+			// every further retry and is jittered.
+			Backoff time.Duration `yaml:"backoff"`
+			// MaxInflight limits how many queries may be retrying at once;
+			// zero means no limit.
+			MaxInflight int `yaml:"max_inflight"`
+			// Hedge sends the query to the next upstream too when the current
+			// one is slower than its p95 latency.
+			Hedge bool `yaml:"hedge"`
+		} `yaml:"retry"`
 	} `yaml:"upstream"`
+	// Forward sends queries for the listed domains and their subdomains to
+	// dedicated upstreams, e.g. VPN resolvers. The longest matching suffix wins;
+	// everything else uses the upstream section.
+	Forward []ForwardZone `yaml:"forward,omitempty"`
+	// ECS controls the EDNS Client Subnet option sent upstream (RFC 7871).
+	ECS struct {
+		// Policy is strip (default), passthrough, anonymize (truncate to /24
+		// or /56) or fixed.
+		Policy string `yaml:"policy"`
+		// Subnet is sent by the fixed policy, e.g. 203.0.113.0/24.
+		Subnet string `yaml:"subnet,omitempty"`
+	} `yaml:"ecs"`
 	Rules struct {
+		// Blocklist and Allowlist hold domains (matching subdomains too),
+		// wildcards such as ads.* and /regular expressions/, each optionally
+		// limited to some query types with $dnstype=HTTPS|SVCB.
 		Blocklist []string `yaml:"blocklist"`
 		Allowlist []string `yaml:"allowlist"`
+		// Sources are rule files or URLs, read in addition to the inline lists.
+		Sources []RuleSource `yaml:"sources,omitempty"`
+		// CacheDir keeps the last good download of every URL source, so the
+		// daemon starts without network access.
+		CacheDir string `yaml:"cache_dir,omitempty"`
+		// Refresh is how often URL sources are downloaded again.
+		Refresh time.Duration `yaml:"refresh,omitempty"`
 	} `yaml:"rules"`
+	Cache struct {
+		Enabled bool          `yaml:"enabled"`
+		Size    int           `yaml:"size"`
+		MinTTL  time.Duration `yaml:"min_ttl"`
+		MaxTTL  time.Duration `yaml:"max_ttl"`
+		// ServeStale keeps expired answers this long for use when the upstream fails.
+		ServeStale time.Duration `yaml:"serve_stale"`
+		// Prefetch refreshes popular entries shortly before they expire.
+		Prefetch struct {
+			Hits    int `yaml:"hits"`
+			Percent int `yaml:"percent"`
+		} `yaml:"prefetch"`
+	} `yaml:"cache"`
 	Log struct {
 		File  string `yaml:"file"`
 		Level string `yaml:"level"`
 	} `yaml:"log"`
 }
 
+// UpstreamServer describes a single upstream resolver. Zero Timeout and empty
+// Bootstrap inherit the values set directly under upstream.
+type UpstreamServer struct {
+	Endpoint  string        `yaml:"endpoint"`
+	Timeout   time.Duration `yaml:"timeout,omitempty"`
+	Bootstrap []string      `yaml:"bootstrap,omitempty"`
+	// BootstrapIPs pins the endpoint's hostname to fixed addresses, skipping
+	// bootstrap lookups. They are not inherited.
+	BootstrapIPs []string `yaml:"bootstrap_ips,omitempty"`
+	// Weight is used by the weighted strategy; values below 1 count as 1.
+	Weight int `yaml:"weight,omitempty"`
+	// AttemptTimeout bounds one attempt at this server within a retried
+	// query. It is not configured here: servers without their own Timeout
+	// get retry.attempt_timeout, and zero means Timeout.
+	AttemptTimeout time.Duration `yaml:"-"`
+	// Method is the DoH request method: get or post (default).
+	Method string `yaml:"method,omitempty"`
+	// Relay is the ODoH relay URL that odoh:// queries are sent through.
+	Relay string `yaml:"relay,omitempty"`
+	// Proxy is a socks5://, socks5h:// or http:// proxy that DoH and ODoH
+	// traffic is sent through. With socks5h the proxy resolves the hostname.
+	Proxy string      `yaml:"proxy,omitempty"`
+	TLS   UpstreamTLS `yaml:"tls,omitempty"`
+}
+
+// ForwardZone routes queries for Domains to Servers. A leading "*." on a
+// domain is accepted and ignored since subdomains always match.
+type ForwardZone struct {
+	Domains []string         `yaml:"domains"`
+	Servers []UpstreamServer `yaml:"servers"`
+}
+
+// UpstreamTLS holds TLS settings for encrypted upstream transports.
+type UpstreamTLS struct {
+	// ServerName overrides the SNI and certificate name, e.g. for IP-literal endpoints.
+	ServerName string `yaml:"server_name,omitempty"`
+	// CAFile is a PEM bundle trusted instead of the system roots.
+	CAFile string `yaml:"ca_file,omitempty"`
+	// SPKIPins are base64 SHA-256 hashes of a SubjectPublicKeyInfo in the
+	// server's chain, checked on every handshake.
+	SPKIPins []string `yaml:"spki_pins,omitempty"`
+	// MinVersion is the lowest accepted TLS version: 1.0, 1.1, 1.2 or 1.3.
+	MinVersion string `yaml:"min_version,omitempty"`
+	// CertFile and KeyFile are a client certificate for mTLS-protected resolvers.
+	CertFile string `yaml:"cert_file,omitempty"`
+	KeyFile  string `yaml:"key_file,omitempty"`
+}
+
+// RuleSource is a local file or a downloaded list of block or allow rules.
+// Exactly one of Path and URL is set.
+type RuleSource struct {
+	// Path is the file to read; relative paths start at the config file's directory.
+	Path string `yaml:"path,omitempty"`
+	// URL is an http(s) list downloaded every Refresh into rules.cache_dir.
+	URL string `yaml:"url,omitempty"`
+	// Format is hosts, adblock, dnsmasq or domains.
+	Format string `yaml:"format"`
+	// Refresh overrides rules.refresh for this URL.
+	Refresh time.Duration `yaml:"refresh,omitempty"`
+}
+
+// DefaultListsDir is the default rules.cache_dir.
+const DefaultListsDir = "/var/lib/dnsbro/lists"
+
 // Defaults returns a Config populated with sensible defaults.
 func Defaults() Config {
 	var cfg Config
@@ -34,6 +182,22 @@ func Defaults() Config {
 	cfg.Upstream.DoHEndpoint = "https://1.1.1.1/dns-query"
 	cfg.Upstream.Timeout = 5 * time.Second
 	cfg.Upstream.Bootstrap = defaultBootstrapServers()
+	cfg.Upstream.Health.Interval = 30 * time.Second
+	cfg.Upstream.Health.Query = "."
+	cfg.Upstream.Health.Failures = 3
+	cfg.Upstream.Health.Cooldown = 30 * time.Second
+	cfg.Upstream.Retry.Attempts = 3
+	cfg.Upstream.Retry.AttemptTimeout = 2 * time.Second
+	cfg.Upstream.Retry.Backoff = 100 * time.Millisecond
+	cfg.Upstream.Retry.MaxInflight = 64
+	cfg.Cache.Enabled = true
+	cfg.Cache.Size = 4096
+	cfg.Cache.MaxTTL = 24 * time.Hour
+	cfg.Cache.Prefetch.Hits = 3
+	cfg.Cache.Prefetch.Percent = 10
+	cfg.ECS.Policy = "strip"
+	cfg.Rules.CacheDir = DefaultListsDir
+	cfg.Rules.Refresh = 24 * time.Hour
 	cfg.Log.Level = "info"
 	return cfg
 }
@@ -54,8 +218,123 @@ func Load(path string) (Config, error) {
 	if cfg.Listen == "" {
 		return cfg, errors.New("listen address required")
 	}
-	if cfg.Upstream.DoHEndpoint == "" {
-		return cfg, errors.New("upstream.doh_endpoint required")
+	if cfg.Upstream.DoHEndpoint == "" && len(cfg.Upstream.Servers) == 0 {
+		return cfg, errors.New("upstream.doh_endpoint or upstream.servers required")
+	}
+	for _, ip := range cfg.Upstream.BootstrapIPs {
+		if net.ParseIP(strings.Trim(ip, "[]")) == nil {
+			return cfg, fmt.Errorf("upstream.bootstrap_ips: %q is not an IP address", ip)
+		}
+	}
+	for i, s := range cfg.Upstream.Servers {
+		if err := validateServer(fmt.Sprintf("upstream.servers[%d]", i), s); err != nil {
+			return cfg, err
+		}
+	}
+	for _, s := range cfg.UpstreamServers() {
+		if err := validateEndpoint(s.Endpoint); err != nil {
+			return cfg, err
+		}
+	}
+	seen := make(map[string]bool)
+	for i, z := range cfg.Forward {
+		if len(z.Domains) == 0 {
+			return cfg, fmt.Errorf("forward[%d].domains required", i)
+		}
+		if len(z.Servers) == 0 {
+			return cfg, fmt.Errorf("forward[%d].servers required", i)
+		}
+		for _, d := range z.Domains {
+			name := ForwardDomain(d)
+			if name == "." {
+				return cfg, fmt.Errorf("forward[%d] has an empty domain", i)
+			}
+			if seen[name] {
+				return cfg, fmt.Errorf("forward domain %q is listed more than once", d)
+			}
+			seen[name] = true
+		}
+		for j, s := range z.Servers {
+			if err := validateServer(fmt.Sprintf("forward[%d].servers[%d]", i, j), s); err != nil {
+				return cfg, err
+			}
+			if err := validateEndpoint(s.Endpoint); err != nil {
+				return cfg, err
+			}
+		}
+	}
+	switch cfg.Upstream.Strategy {
+	case "", "order", "round_robin", "weighted", "fastest", "race":
+	default:
+		return cfg, fmt.Errorf("unknown upstream.strategy %q", cfg.Upstream.Strategy)
+	}
+	if cfg.Upstream.Race < 0 {
+		return cfg, errors.New("upstream.race must not be negative")
+	}
+	if cfg.Upstream.Health.Interval < 0 || cfg.Upstream.Health.Cooldown < 0 {
+		return cfg, errors.New("upstream.health interval and cooldown must not be negative")
+	}
+	if cfg.Upstream.Health.Failures < 0 {
+		return cfg, errors.New("upstream.health.failures must not be negative")
+	}
+	if r := cfg.Upstream.Retry; r.AttemptTimeout < 0 || r.Timeout < 0 || r.Backoff < 0 {
+		return cfg, errors.New("upstream.retry timeouts and backoff must not be negative")
+	}
+	if cfg.Upstream.Retry.MaxInflight < 0 {
+		return cfg, errors.New("upstream.retry.max_inflight must not be negative")
+	}
+	if cfg.Upstream.Retry.Attempts < 1 {
+		cfg.Upstream.Retry.Attempts = 1
+	}
+	for i, r := range cfg.Rules.Blocklist {
+		if err := rules.ValidateRule(r); err != nil {
+			return cfg, fmt.Errorf("rules.blocklist[%d]: %w", i, err)
+		}
+	}
+	for i, r := range cfg.Rules.Allowlist {
+		if err := rules.ValidateRule(r); err != nil {
+			return cfg, fmt.Errorf("rules.allowlist[%d]: %w", i, err)
+		}
+	}
+	if cfg.Rules.Refresh <= 0 {
+		return cfg, errors.New("rules.refresh must be positive")
+	}
+	for i, s := range cfg.Rules.Sources {
+		if (s.Path == "") == (s.URL == "") {
+			return cfg, fmt.Errorf("rules.sources[%d] needs exactly one of path and url", i)
+		}
+		switch s.Format {
+		case "hosts", "adblock", "dnsmasq", "domains":
+		default:
+			return cfg, fmt.Errorf("rules.sources[%d].format must be hosts, adblock, dnsmasq or domains", i)
+		}
+		if s.Refresh < 0 {
+			return cfg, fmt.Errorf("rules.sources[%d].refresh must not be negative", i)
+		}
+		if s.URL != "" {
+			u, err := url.Parse(s.URL)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return cfg, fmt.Errorf("rules.sources[%d].url must be an http or https URL", i)
+			}
+			continue
+		}
+		if !filepath.IsAbs(s.Path) {
+			cfg.Rules.Sources[i].Path = filepath.Join(filepath.Dir(path), s.Path)
+		}
+	}
+	if cfg.Rules.CacheDir == "" {
+		cfg.Rules.CacheDir = DefaultListsDir
+	} else if !filepath.IsAbs(cfg.Rules.CacheDir) {
+		cfg.Rules.CacheDir = filepath.Join(filepath.Dir(path), cfg.Rules.CacheDir)
+	}
+	switch strings.ToLower(cfg.ECS.Policy) {
+	case "", "strip", "passthrough", "anonymize":
+	case "fixed":
+		if _, err := netip.ParsePrefix(cfg.ECS.Subnet); err != nil {
+			return cfg, errors.New("ecs.subnet must be a prefix such as 203.0.113.0/24 for the fixed policy")
+		}
+	default:
+		return cfg, errors.New("ecs.policy must be strip, passthrough, anonymize or fixed")
 	}
 	if cfg.Upstream.Timeout == 0 {
 		cfg.Upstream.Timeout = 5 * time.Second
@@ -63,9 +342,131 @@ func Load(path string) (Config, error) {
 	if len(cfg.Upstream.Bootstrap) == 0 {
 		cfg.Upstream.Bootstrap = defaultBootstrapServers()
 	}
+	if cfg.Cache.Size < 0 {
+		return cfg, errors.New("cache.size must not be negative")
+	}
+	if cfg.Cache.Size == 0 {
+		cfg.Cache.Size = 4096
+	}
+	if cfg.Cache.MaxTTL != 0 && cfg.Cache.MaxTTL < cfg.Cache.MinTTL {
+		return cfg, errors.New("cache.max_ttl must not be below cache.min_ttl")
+	}
+	if cfg.Cache.ServeStale < 0 {
+		return cfg, errors.New("cache.serve_stale must not be negative")
+	}
+	if cfg.Cache.Prefetch.Hits < 0 {
+		return cfg, errors.New("cache.prefetch.hits must not be negative")
+	}
+	if cfg.Cache.Prefetch.Percent < 0 || cfg.Cache.Prefetch.Percent > 100 {
+		return cfg, errors.New("cache.prefetch.percent must be between 0 and 100")
+	}
 	return cfg, nil
 }
 
+func validateServer(field string, s UpstreamServer) error {
+	if s.Endpoint == "" {
+		return fmt.Errorf("%s.endpoint required", field)
+	}
+	switch strings.ToLower(s.Method) {
+	case "", "get", "post":
+	default:
+		return fmt.Errorf("%s.method must be get or post", field)
+	}
+	if s.Relay != "" {
+		if u, err := url.Parse(s.Relay); err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("%s.relay must be a URL such as https://relay/proxy", field)
+		}
+	}
+	if s.Proxy != "" {
+		u, err := url.Parse(s.Proxy)
+		if err != nil || u.Host == "" {
+			return fmt.Errorf("%s.proxy must be a URL such as socks5h://127.0.0.1:9050", field)
+		}
+		switch strings.ToLower(u.Scheme) {
+		case "socks5", "socks5h", "http":
+		default:
+			return fmt.Errorf("%s.proxy scheme must be socks5, socks5h or http", field)
+		}
+		switch scheme, _, _ := strings.Cut(s.Endpoint, "://"); strings.ToLower(scheme) {
+		case "https", "http", "odoh", "sdns":
+		default:
+			return fmt.Errorf("%s.proxy is only supported for DoH and ODoH endpoints", field)
+		}
+	}
+	for _, ip := range s.BootstrapIPs {
+		if net.ParseIP(strings.Trim(ip, "[]")) == nil {
+			return fmt.Errorf("%s.bootstrap_ips: %q is not an IP address", field, ip)
+		}
+	}
+	switch s.TLS.MinVersion {
+	case "", "1.0", "1.1", "1.2", "1.3":
+	default:
+		return fmt.Errorf("%s.tls.min_version must be 1.0, 1.1, 1.2 or 1.3", field)
+	}
+	for _, p := range s.TLS.SPKIPins {
+		if pin, err := base64.StdEncoding.DecodeString(p); err != nil || len(pin) != sha256.Size {
+			return fmt.Errorf("%s.tls.spki_pins: %q is not a base64 SHA-256 hash", field, p)
+		}
+	}
+	if (s.TLS.CertFile == "") != (s.TLS.KeyFile == "") {
+		return fmt.Errorf("%s.tls.cert_file and key_file must be set together", field)
+	}
+	return nil
+}
+
+func validateEndpoint(endpoint string) error {
+	if u, err := url.Parse(endpoint); err != nil || u.Scheme == "" {
+		return fmt.Errorf("upstream endpoint %q must be a URL such as https://host/dns-query", endpoint)
+	}
+	return nil
+}
+
+// UpstreamServers returns the configured upstreams in failover order with
+// timeout and bootstrap defaults applied.
+func (c Config) UpstreamServers() []UpstreamServer {
+	servers := c.Upstream.Servers
+	if len(servers) == 0 {
+		servers = []UpstreamServer{{Endpoint: c.Upstream.DoHEndpoint, BootstrapIPs: c.Upstream.BootstrapIPs}}
+	}
+	return c.withUpstreamDefaults(servers)
+}
+
+// ForwardZones returns the forward zones with timeout and bootstrap defaults
+// applied to their servers.
+func (c Config) ForwardZones() []ForwardZone {
+	out := make([]ForwardZone, 0, len(c.Forward))
+	for _, z := range c.Forward {
+		z.Servers = c.withUpstreamDefaults(z.Servers)
+		out = append(out, z)
+	}
+	return out
+}
+
+func (c Config) withUpstreamDefaults(servers []UpstreamServer) []UpstreamServer {
+	out := make([]UpstreamServer, 0, len(servers))
+	for _, s := range servers {
+		if s.Timeout == 0 {
+			s.Timeout = c.Upstream.Timeout
+			if a := c.Upstream.Retry.AttemptTimeout; a < s.Timeout {
+				s.AttemptTimeout = a
+			}
+		}
+		if len(s.Bootstrap) == 0 {
+			s.Bootstrap = c.Upstream.Bootstrap
+		}
+		out = append(out, s)
+	}
+	return out
+}
+
+// ForwardDomain normalizes a forward zone domain to a lower-case FQDN,
+// dropping a leading "*.".
+func ForwardDomain(d string) string {
+	d = strings.ToLower(strings.TrimSpace(d))
+	d = strings.TrimPrefix(d, "*.")
+	return strings.TrimSuffix(d, ".") + "."
+}
+
 // Write persists the config to the given path, creating parent directories when needed.
 func Write(path string, cfg Config) error {
 	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
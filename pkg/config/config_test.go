@@ -3,6 +3,7 @@ package config
 import (
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 )
@@ -68,3 +69,196 @@ rules:
 		t.Fatalf("expected default bootstrap servers, got none")
 	}
 }
+
+func TestUpstreamServersInheritDefaults(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.yaml")
+
+	content := []byte(`listen: 127.0.0.1:5353
+upstream:
+  timeout: 2s
+  bootstrap: [9.9.9.9:53]
+  servers:
+    - endpoint: https://one.example/dns-query
+    - endpoint: https://two.example/dns-query
+      timeout: 1s
+      bootstrap: [1.1.1.1:53]`)
+
+	if err := os.WriteFile(path, content, 0o644); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+
+	servers := cfg.UpstreamServers()
+	if len(servers) != 2 {
+		t.Fatalf("expected 2 upstreams, got %d", len(servers))
+	}
+	if servers[0].Timeout != 2*time.Second || servers[0].Bootstrap[0] != "9.9.9.9:53" {
+		t.Fatalf("first upstream did not inherit defaults: %+v", servers[0])
+	}
+	if servers[1].Timeout != time.Second || servers[1].Bootstrap[0] != "1.1.1.1:53" {
+		t.Fatalf("second upstream lost its overrides: %+v", servers[1])
+	}
+}
+
+func TestUpstreamServersFallsBackToDoHEndpoint(t *testing.T) {
+	cfg := Defaults()
+	servers := cfg.UpstreamServers()
+	if len(servers) != 1 || servers[0].Endpoint != cfg.Upstream.DoHEndpoint {
+		t.Fatalf("expected doh_endpoint as the only upstream, got %+v", servers)
+	}
+}
+
+func TestLoadForwardZones(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.yaml")
+
+	content := []byte(`listen: 127.0.0.1:5353
+upstream:
+  doh_endpoint: https://example.com/dns-query
+  timeout: 2s
+forward:
+  - domains: [corp.example.com, "*.internal"]
+    servers:
+      - endpoint: udp://10.0.0.53
+`)
+	if err := os.WriteFile(path, content, 0o644); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	zones := cfg.ForwardZones()
+	if len(zones) != 1 || len(zones[0].Servers) != 1 {
+		t.Fatalf("expected one zone with one server, got %+v", zones)
+	}
+	if zones[0].Servers[0].Timeout != 2*time.Second {
+		t.Fatalf("forward server did not inherit the timeout: %+v", zones[0].Servers[0])
+	}
+	if got := ForwardDomain(zones[0].Domains[1]); got != "internal." {
+		t.Fatalf("ForwardDomain(%q) = %q, want internal.", zones[0].Domains[1], got)
+	}
+
+	content = append(content, []byte(`  - domains: [Internal.]
+    servers:
+      - endpoint: udp://10.0.0.54
+`)...)
+	if err := os.WriteFile(path, content, 0o644); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	if _, err := Load(path); err == nil {
+		t.Fatalf("expected an error for a domain listed twice")
+	}
+}
+
+func TestLoadValidatesUpstreamTLS(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	base := `upstream:
+  servers:
+    - endpoint: https://10.0.0.1/dns-query
+      tls:
+        server_name: doh.corp.example
+`
+	tests := []struct {
+		name    string
+		extra   string
+		wantErr bool
+	}{
+		{name: "valid", extra: "        min_version: \"1.3\"\n        spki_pins: [\"47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=\"]\n"},
+		{name: "bad version", extra: "        min_version: \"1.4\"\n", wantErr: true},
+		{name: "bad pin", extra: "        spki_pins: [not-a-pin]\n", wantErr: true},
+		{name: "cert without key", extra: "        cert_file: /etc/dnsbro/client.pem\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		if err := os.WriteFile(path, []byte(base+tt.extra), 0o644); err != nil {
+			t.Fatalf("write config: %v", err)
+		}
+		_, err := Load(path)
+		if (err != nil) != tt.wantErr {
+			t.Fatalf("%s: Load() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestLoadValidatesProxy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	tests := []struct {
+		endpoint, proxy string
+		wantErr         bool
+	}{
+		{endpoint: "https://dns.example/dns-query", proxy: "socks5h://127.0.0.1:9050"},
+		{endpoint: "odoh://odoh.example/dns-query", proxy: "http://proxy.corp:3128"},
+		{endpoint: "https://dns.example/dns-query", proxy: "ftp://127.0.0.1", wantErr: true},
+		{endpoint: "tls://1.1.1.1", proxy: "socks5://127.0.0.1:1080", wantErr: true},
+	}
+	for _, tt := range tests {
+		content := "upstream:\n  servers:\n    - endpoint: " + tt.endpoint + "\n      relay: https://relay.example/proxy\n      proxy: " + tt.proxy + "\n"
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatalf("write config: %v", err)
+		}
+		if _, err := Load(path); (err != nil) != tt.wantErr {
+			t.Fatalf("%s via %s: Load() error = %v, wantErr %v", tt.endpoint, tt.proxy, err, tt.wantErr)
+		}
+	}
+}
+
+func TestLoadValidatesRuleSources(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.yaml")
+	tests := []struct {
+		name    string
+		rules   string
+		wantErr bool
+	}{
+		{name: "url", rules: "  cache_dir: lists\n  sources:\n    - url: https://lists.example/hosts.txt\n      format: hosts\n      refresh: 6h\n"},
+		{name: "path and url", rules: "  sources:\n    - path: block.txt\n      url: https://lists.example/hosts.txt\n      format: hosts\n", wantErr: true},
+		{name: "bad scheme", rules: "  sources:\n    - url: ftp://lists.example/hosts.txt\n      format: hosts\n", wantErr: true},
+		{name: "zero refresh", rules: "  refresh: 0s\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		content := "upstream:\n  doh_endpoint: https://1.1.1.1/dns-query\nrules:\n" + tt.rules
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatalf("write config: %v", err)
+		}
+		cfg, err := Load(path)
+		if (err != nil) != tt.wantErr {
+			t.Fatalf("%s: Load() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+		if tt.name == "url" && cfg.Rules.CacheDir != filepath.Join(dir, "lists") {
+			t.Fatalf("cache_dir = %q, want it relative to the config file", cfg.Rules.CacheDir)
+		}
+	}
+}
+
+func TestLoadValidatesRulePatterns(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	tests := []struct {
+		rules   string
+		wantErr string
+	}{
+		{rules: "  blocklist: [\"ads.*\", \"*-tracker.example.com\", '/^[a-z0-9]{20,}\\.cloudfront\\.net$/']\n"},
+		{rules: "  blocklist: [ok.example, '/ads(/']\n", wantErr: "rules.blocklist[1]: invalid regular expression"},
+		{rules: "  allowlist: [\"good..*\"]\n", wantErr: "rules.allowlist[0]: invalid wildcard"},
+		{rules: "  blocklist: [\"*$dnstype=ANY\", \"ech.example$dnstype=HTTPS|SVCB\"]\n"},
+		{rules: "  blocklist: [\"ech.example$dnstype=HTTPZ\"]\n", wantErr: "rules.blocklist[0]: rule \"ech.example$dnstype=HTTPZ\": unknown query type"},
+	}
+	for _, tt := range tests {
+		content := "upstream:\n  doh_endpoint: https://1.1.1.1/dns-query\nrules:\n" + tt.rules
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatalf("write config: %v", err)
+		}
+		_, err := Load(path)
+		if tt.wantErr == "" && err != nil {
+			t.Fatalf("Load() error = %v", err)
+		}
+		if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+			t.Fatalf("Load() error = %v, want %q", err, tt.wantErr)
+		}
+	}
+}